@@ -68,6 +68,16 @@ func (cn Connection) Read(hdl ReadHandler) error {
 	return nil
 }
 
+// Snapshot - чтение без регистрации конфликтов, для транзакций только на чтение
+func (cn Connection) Snapshot(hdl ReadHandler) error {
+	if _, err := cn.db.ReadTransact(func(tx fdb.ReadTransaction) (interface{}, error) {
+		return nil, hdl(Reader{Connection: cn, tx: tx.Snapshot()})
+	}); err != nil {
+		return ErrRead.WithReason(err)
+	}
+	return nil
+}
+
 func (cn Connection) Write(hdl WriteHandler) error {
 	if _, err := cn.db.Transact(func(tx fdb.Transaction) (interface{}, error) {
 		return nil, hdl(Writer{Reader: Reader{Connection: cn, tx: tx}, tx: tx})
@@ -77,6 +87,28 @@ func (cn Connection) Write(hdl WriteHandler) error {
 	return nil
 }
 
+// SplitPoints - границы шардов FDB внутри диапазона, по ним удобно делить диапазон для параллельной обработки
+func (cn Connection) SplitPoints(from, last fdb.Key) (res []fdb.Key, err error) {
+	var keys []fdb.Key
+
+	rng := fdb.KeyRange{Begin: cn.usrWrap(from), End: cn.endWrap(last)}
+
+	if keys, err = cn.db.LocalityGetBoundaryKeys(rng, 0, 0); err != nil {
+		return nil, ErrSplitPoints.WithReason(err)
+	}
+
+	res = make([]fdb.Key, 0, len(keys))
+
+	// Границы возвращаются как есть, поэтому отрезаем байт базы данных
+	for i := range keys {
+		if len(keys[i]) > 1 && keys[i][0] == cn.ID {
+			res = append(res, keys[i][1:])
+		}
+	}
+
+	return res, nil
+}
+
 func (cn Connection) Clear() error {
 	if _, err := cn.db.Transact(func(tx fdb.Transaction) (interface{}, error) {
 		tx.ClearRange(fdb.KeyRange{Begin: cn.usrWrap(nil), End: cn.endWrap(nil)})
@@ -30,6 +30,12 @@ func (w Writer) Increment(key fdb.Key, delta int64) {
 	w.tx.Add(w.usrWrap(key), data[:])
 }
 
+// Vanish - удаление счетчика, если после атомарных прибавлений он стал нулевым
+func (w Writer) Vanish(key fdb.Key) {
+	var zero [8]byte
+	w.tx.CompareAndClear(w.usrWrap(key), zero[:])
+}
+
 func (w Writer) Erase(from, to fdb.Key) {
 	w.tx.ClearRange(fdb.KeyRange{
 		Begin: w.usrWrap(from),
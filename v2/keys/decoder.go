@@ -0,0 +1,338 @@
+package keys
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"time"
+)
+
+/*
+	Decoder - последовательное чтение частей ключа.
+
+	Части читаются в том же порядке, в каком добавлялись. Перед чтением части, добавленной через AppendDesc,
+	нужно вызвать Desc. При ошибке (например, не совпал тип) позиция чтения не сдвигается.
+*/
+type Decoder struct {
+	buf  []byte
+	desc bool
+}
+
+// Desc - следующая часть записана в обратном порядке сортировки
+func (d *Decoder) Desc() *Decoder {
+	d.desc = true
+	return d
+}
+
+// Empty - прочитаны все части ключа
+func (d *Decoder) Empty() bool { return len(d.buf) == 0 }
+
+// Rest - непрочитанный остаток ключа
+func (d *Decoder) Rest() []byte { return d.buf }
+
+// Skip - пропуск очередной части любого типа
+func (d *Decoder) Skip() error {
+	_, _, size, err := d.next(0)
+
+	if err != nil {
+		return err
+	}
+
+	d.commit(size)
+	return nil
+}
+
+// ReadNil - чтение пустого значения
+func (d *Decoder) ReadNil() error {
+	_, _, size, err := d.next(codeNil)
+
+	if err != nil {
+		return err
+	}
+
+	d.commit(size)
+	return nil
+}
+
+// ReadBytes - чтение среза байт
+func (d *Decoder) ReadBytes() ([]byte, error) {
+	_, elem, size, err := d.next(codeBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.commit(size)
+	return unescape(elem), nil
+}
+
+// ReadString - чтение строки
+func (d *Decoder) ReadString() (string, error) {
+	_, elem, size, err := d.next(codeString)
+
+	if err != nil {
+		return "", err
+	}
+
+	d.commit(size)
+	return string(unescape(elem)), nil
+}
+
+// ReadInt - чтение целого числа
+func (d *Decoder) ReadInt() (int64, error) {
+	code, elem, size, err := d.next(codeInt)
+
+	if err != nil {
+		return 0, err
+	}
+
+	val := readUint(elem)
+
+	if code < codeInt {
+		d.commit(size)
+		return int64(val - sizeLimit(int(codeInt-code))), nil
+	}
+
+	if val > math.MaxInt64 {
+		return 0, ErrDecode.WithDetail("Integer overflow: %d", val)
+	}
+
+	d.commit(size)
+	return int64(val), nil
+}
+
+// ReadUint - чтение неотрицательного целого числа
+func (d *Decoder) ReadUint() (uint64, error) {
+	code, elem, size, err := d.next(codeInt)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if code < codeInt {
+		return 0, ErrDecode.WithDetail("Negative integer")
+	}
+
+	d.commit(size)
+	return readUint(elem), nil
+}
+
+// ReadFloat - чтение числа с плавающей точкой, в том числе одинарной точности
+func (d *Decoder) ReadFloat() (float64, error) {
+	code, elem, size, err := d.next(codeDouble)
+
+	if err != nil {
+		return 0, err
+	}
+
+	d.commit(size)
+
+	if code == codeFloat {
+		val := uint64(binary.BigEndian.Uint32(elem)) << 32
+		return float64(math.Float32frombits(uint32(unorderFloat(val) >> 32))), nil
+	}
+
+	return math.Float64frombits(unorderFloat(binary.BigEndian.Uint64(elem))), nil
+}
+
+// ReadBool - чтение логического значения
+func (d *Decoder) ReadBool() (bool, error) {
+	code, _, size, err := d.next(codeTrue)
+
+	if err != nil {
+		return false, err
+	}
+
+	d.commit(size)
+	return code == codeTrue, nil
+}
+
+// ReadUUID - чтение идентификатора из 16 байт
+func (d *Decoder) ReadUUID() ([]byte, error) {
+	_, elem, size, err := d.next(codeUUID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.commit(size)
+	return elem, nil
+}
+
+// ReadTime - чтение момента времени, записанного AppendTime
+func (d *Decoder) ReadTime() (time.Time, error) {
+	val, err := d.ReadInt()
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, val).UTC(), nil
+}
+
+/*
+	next - выделение очередной части ключа ожидаемого типа (0 - любого).
+
+	Возвращает фактический код типа, содержимое части без кода (уже в прямом порядке байт) и ее размер.
+	Позицию чтения не сдвигает, это делает commit после успешного разбора.
+*/
+func (d *Decoder) next(want byte) (code byte, elem []byte, size int, err error) {
+	if len(d.buf) == 0 {
+		return 0, nil, 0, ErrDecode.WithDetail("Unexpected end of key")
+	}
+
+	mask := byte(0)
+	if d.desc {
+		mask = 0xFF
+	}
+
+	code = d.buf[0] ^ mask
+
+	switch {
+	case code == codeNil, code == codeFalse, code == codeTrue:
+		size = 1
+	case code == codeBytes, code == codeString:
+		if size, err = escapedSize(d.buf, mask); err != nil {
+			return 0, nil, 0, err
+		}
+	case code >= codeInt-8 && code <= codeInt+8:
+		if code > codeInt {
+			size = 1 + int(code-codeInt)
+		} else {
+			size = 1 + int(codeInt-code)
+		}
+	case code == codeFloat:
+		size = 5
+	case code == codeDouble:
+		size = 9
+	case code == codeUUID:
+		size = 17
+	default:
+		return 0, nil, 0, ErrDecode.WithDetail("Unknown type code %X", code)
+	}
+
+	if want != 0 && !sameType(want, code) {
+		return 0, nil, 0, ErrDecode.WithDetail("Unexpected type code %X", code)
+	}
+
+	if size > len(d.buf) {
+		return 0, nil, 0, ErrDecode.WithDetail("Not enough bytes for type code %X", code)
+	}
+
+	elem = make([]byte, size-1)
+
+	for i := range elem {
+		elem[i] = d.buf[i+1] ^ mask
+	}
+
+	return code, elem, size, nil
+}
+
+// commit - сдвиг позиции чтения после успешного разбора части
+func (d *Decoder) commit(size int) {
+	d.buf = d.buf[size:]
+	d.desc = false
+}
+
+// sameType - коды одного типа: целые разной длины, дробные разной точности, истина и ложь
+func sameType(want, code byte) bool {
+	switch want {
+	case codeInt:
+		return code >= codeInt-8 && code <= codeInt+8
+	case codeDouble:
+		return code == codeFloat || code == codeDouble
+	case codeTrue:
+		return code == codeFalse || code == codeTrue
+	}
+
+	return want == code
+}
+
+// escapedSize - длина части с экранированными нулевыми байтами, вместе с кодом и завершающим нулем
+func escapedSize(buf []byte, mask byte) (int, error) {
+	for i := 1; i < len(buf); i++ {
+		if buf[i]^mask != 0 {
+			continue
+		}
+
+		// Экранированный нулевой байт
+		if i+1 < len(buf) && buf[i+1]^mask == 0xFF {
+			i++
+			continue
+		}
+
+		return i + 1, nil
+	}
+
+	return 0, ErrDecode.WithDetail("Unterminated bytes")
+}
+
+// unescape - содержимое без завершающего нуля и экранирования
+func unescape(elem []byte) []byte {
+	res := make([]byte, 0, len(elem))
+
+	for i := 0; i < len(elem)-1; i++ {
+		res = append(res, elem[i])
+
+		if elem[i] == 0 {
+			i++
+		}
+	}
+
+	return res
+}
+
+func appendEscaped(res []byte, code byte, val []byte) []byte {
+	res = append(res, code)
+
+	for i := range val {
+		if res = append(res, val[i]); val[i] == 0 {
+			res = append(res, 0xFF)
+		}
+	}
+
+	return append(res, 0x00)
+}
+
+func readUint(elem []byte) uint64 {
+	var buf [8]byte
+	copy(buf[8-len(elem):], elem)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// intSize - минимальное кол-во байт для записи числа
+func intSize(val uint64) int {
+	return (bits.Len64(val) + 7) / 8
+}
+
+// sizeLimit - максимальное число, которое помещается в n байт
+func sizeLimit(n int) uint64 {
+	if n >= 8 {
+		return math.MaxUint64
+	}
+
+	return 1<<(8*uint(n)) - 1
+}
+
+// orderFloat - у положительных выставляем знаковый бит, отрицательные инвертируем полностью
+func orderFloat(val uint64) uint64 {
+	if val&(1<<63) != 0 {
+		return ^val
+	}
+
+	return val | 1<<63
+}
+
+func unorderFloat(val uint64) uint64 {
+	if val&(1<<63) != 0 {
+		return val &^ (1 << 63)
+	}
+
+	return ^val
+}
+
+func clone(key []byte, extra int) []byte {
+	res := make([]byte, len(key), len(key)+extra)
+	copy(res, key)
+	return res
+}
@@ -0,0 +1,147 @@
+/*
+	Package keys - построение составных ключей с сохранением порядка сортировки.
+
+	Каждое значение кодируется так же, как в tuple layer FoundationDB, поэтому ключи можно
+	разбирать и стандартным fdb/tuple. Порядок байт ключа совпадает с естественным порядком значений:
+	отрицательные числа раньше положительных, строки - лексикографически, время - хронологически.
+	Строки и срезы байт завершаются нулевым байтом, так что префикс "a" не совпадет с "ab".
+
+	Обратный порядок сортировки части ключа задается через AppendDesc, а читать ее надо через Decoder.Desc.
+*/
+package keys
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/shestakovda/errx"
+)
+
+// Коды типов tuple layer
+const (
+	codeNil    byte = 0x00
+	codeBytes  byte = 0x01
+	codeString byte = 0x02
+	codeInt    byte = 0x14
+	codeFloat  byte = 0x20
+	codeDouble byte = 0x21
+	codeFalse  byte = 0x26
+	codeTrue   byte = 0x27
+	codeUUID   byte = 0x30
+)
+
+// AppendNil - добавление пустого значения, оно меньше любого другого
+func AppendNil(key []byte) []byte {
+	return append(clone(key, 1), codeNil)
+}
+
+// AppendBytes - добавление среза байт, нулевые байты экранируются
+func AppendBytes(key []byte, val []byte) []byte {
+	return appendEscaped(clone(key, len(val)+2), codeBytes, val)
+}
+
+// AppendString - добавление строки в UTF-8, нулевые байты экранируются
+func AppendString(key []byte, val string) []byte {
+	return appendEscaped(clone(key, len(val)+2), codeString, []byte(val))
+}
+
+// AppendInt - добавление целого числа, кодируется минимально необходимым кол-вом байт
+func AppendInt(key []byte, val int64) []byte {
+	var buf [8]byte
+
+	if val >= 0 {
+		return AppendUint(key, uint64(val))
+	}
+
+	// Отрицательные хранятся в обратном коде, чтобы по модулю больше были раньше
+	n := intSize(uint64(-val))
+	binary.BigEndian.PutUint64(buf[:], sizeLimit(n)+uint64(val))
+	res := append(clone(key, n+1), codeInt-byte(n))
+	return append(res, buf[8-n:]...)
+}
+
+// AppendUint - добавление неотрицательного целого числа
+func AppendUint(key []byte, val uint64) []byte {
+	var buf [8]byte
+
+	n := intSize(val)
+	binary.BigEndian.PutUint64(buf[:], val)
+	res := append(clone(key, n+1), codeInt+byte(n))
+	return append(res, buf[8-n:]...)
+}
+
+// AppendFloat - добавление числа с плавающей точкой двойной точности
+func AppendFloat(key []byte, val float64) []byte {
+	var buf [8]byte
+
+	binary.BigEndian.PutUint64(buf[:], orderFloat(math.Float64bits(val)))
+	return append(append(clone(key, 9), codeDouble), buf[:]...)
+}
+
+// AppendBool - добавление логического значения, ложь раньше истины
+func AppendBool(key []byte, val bool) []byte {
+	if val {
+		return append(clone(key, 1), codeTrue)
+	}
+
+	return append(clone(key, 1), codeFalse)
+}
+
+// AppendUUID - добавление идентификатора из 16 байт
+func AppendUUID(key []byte, val []byte) ([]byte, error) {
+	if len(val) != 16 {
+		return nil, ErrAppend.WithDetail("Invalid UUID length: %d", len(val))
+	}
+
+	return append(append(clone(key, 17), codeUUID), val...), nil
+}
+
+// AppendTime - добавление момента времени, хранится как целое число наносекунд с начала эпохи Unix
+func AppendTime(key []byte, val time.Time) []byte {
+	return AppendInt(key, val.UnixNano())
+}
+
+// AppendDesc - добавление части ключа в обратном порядке сортировки, часть должна быть построена функциями Append
+func AppendDesc(key []byte, part []byte) []byte {
+	res := clone(key, len(part))
+
+	for i := range part {
+		res = append(res, ^part[i])
+	}
+
+	return res
+}
+
+/*
+	AppendFixedTime - добавление момента времени фиксированной длины (8 байт), без кода типа.
+
+	Такой формат не совместим с tuple layer, но занимает ровно 8 байт и удобен, если время
+	стоит внутри служебного ключа и его надо отрезать по длине. Порядок сохраняется для времени после 1970 года.
+*/
+func AppendFixedTime(key []byte, val time.Time) []byte {
+	var buf [8]byte
+
+	binary.BigEndian.PutUint64(buf[:], uint64(val.UTC().UnixNano()))
+	return append(clone(key, 8), buf[:]...)
+}
+
+// FixedTime - чтение момента времени фиксированной длины, записанного AppendFixedTime
+func FixedTime(buf []byte) (time.Time, error) {
+	if len(buf) < 8 {
+		return time.Time{}, ErrDecode.WithDetail("Not enough bytes for fixed time: %d", len(buf))
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8]))).UTC(), nil
+}
+
+// NewDecoder - последовательное чтение частей ключа, построенного функциями Append
+func NewDecoder(key []byte) *Decoder {
+	return &Decoder{buf: key}
+}
+
+// Ошибки модуля
+var (
+	ErrAppend = errx.New("Ошибка построения ключа")
+	ErrDecode = errx.New("Ошибка разбора ключа")
+)
@@ -0,0 +1,172 @@
+package keys_test
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/shestakovda/fdbx/v2/keys"
+)
+
+func TestKeys(t *testing.T) {
+	suite.Run(t, new(KeysSuite))
+}
+
+type KeysSuite struct {
+	suite.Suite
+}
+
+func (s *KeysSuite) TestTupleCompatible() {
+	// Эталонные значения кодирования tuple layer
+	s.Equal([]byte{0x00}, keys.AppendNil(nil))
+	s.Equal([]byte{0x14}, keys.AppendInt(nil, 0))
+	s.Equal([]byte{0x15, 0x01}, keys.AppendInt(nil, 1))
+	s.Equal([]byte{0x15, 0xFF}, keys.AppendInt(nil, 255))
+	s.Equal([]byte{0x16, 0x01, 0x00}, keys.AppendInt(nil, 256))
+	s.Equal([]byte{0x13, 0xFE}, keys.AppendInt(nil, -1))
+	s.Equal([]byte{0x12, 0xFE, 0xFF}, keys.AppendInt(nil, -256))
+	s.Equal([]byte{0x1C, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, keys.AppendUint(nil, math.MaxUint64))
+	s.Equal([]byte{0x02, 'a', 0x00, 0xFF, 'b', 0x00}, keys.AppendString(nil, "a\x00b"))
+	s.Equal([]byte{0x01, 0x00, 0xFF, 0x01, 0x00}, keys.AppendBytes(nil, []byte{0x00, 0x01}))
+	s.Equal([]byte{0x26}, keys.AppendBool(nil, false))
+	s.Equal([]byte{0x27}, keys.AppendBool(nil, true))
+	s.Equal([]byte{0x21, 0xBF, 0xF0, 0, 0, 0, 0, 0, 0}, keys.AppendFloat(nil, 1))
+	s.Equal([]byte{0x21, 0x40, 0x0F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, keys.AppendFloat(nil, -1))
+
+	// Исходный ключ не меняется
+	base := make([]byte, 1, 16)
+	key := keys.AppendInt(base, 1)
+	s.Equal([]byte{0x00}, base)
+	s.Equal([]byte{0x00, 0x15, 0x01}, key)
+}
+
+func (s *KeysSuite) TestOrder() {
+	check := func(list [][]byte) {
+		sorted := make([][]byte, len(list))
+		copy(sorted, list)
+		sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+		s.Equal(list, sorted)
+	}
+
+	ints := []int64{math.MinInt64, -70000, -256, -255, -1, 0, 1, 255, 256, 70000, math.MaxInt64}
+	list := make([][]byte, len(ints))
+	desc := make([][]byte, len(ints))
+	for i := range ints {
+		list[i] = keys.AppendInt(nil, ints[i])
+		desc[len(ints)-1-i] = keys.AppendDesc(nil, keys.AppendInt(nil, ints[i]))
+	}
+	check(list)
+	check(desc)
+
+	floats := []float64{math.Inf(-1), -1e10, -1, -1e-10, 0, 1e-10, 1, 1e10, math.Inf(1)}
+	list = make([][]byte, len(floats))
+	for i := range floats {
+		list[i] = keys.AppendFloat(nil, floats[i])
+	}
+	check(list)
+
+	strs := []string{"", "a", "a\x00", "a\x00b", "ab", "b"}
+	list = make([][]byte, len(strs))
+	desc = make([][]byte, len(strs))
+	for i := range strs {
+		list[i] = keys.AppendInt(keys.AppendString(nil, strs[i]), 1)
+		desc[len(strs)-1-i] = keys.AppendInt(keys.AppendDesc(nil, keys.AppendString(nil, strs[i])), 1)
+	}
+	check(list)
+	check(desc)
+
+	now := time.Now()
+	times := []time.Time{time.Unix(-100, 0), time.Unix(0, 0), now, now.Add(time.Nanosecond), now.Add(time.Hour)}
+	list = make([][]byte, len(times))
+	for i := range times {
+		list[i] = keys.AppendTime(nil, times[i])
+	}
+	check(list)
+}
+
+func (s *KeysSuite) TestDecode() {
+	now := time.Now()
+	uid := bytes.Repeat([]byte{0xAB}, 16)
+
+	key := keys.AppendString(nil, "a\x00b")
+	key = keys.AppendDesc(key, keys.AppendInt(nil, -300))
+	key = keys.AppendBytes(key, []byte{0x00, 0xFF})
+	key = keys.AppendDesc(key, keys.AppendString(nil, "desc\x00"))
+	key = keys.AppendUint(key, math.MaxUint64)
+	key = keys.AppendFloat(key, -2.5)
+	key = keys.AppendBool(key, true)
+	key = keys.AppendTime(key, now)
+	key = keys.AppendNil(key)
+	key, err := keys.AppendUUID(key, uid)
+	s.Require().NoError(err)
+
+	dec := keys.NewDecoder(key)
+
+	if str, err := dec.ReadString(); s.NoError(err) {
+		s.Equal("a\x00b", str)
+	}
+
+	// Тип не совпал - позиция остается прежней
+	_, err = dec.ReadString()
+	s.Error(err)
+
+	if num, err := dec.Desc().ReadInt(); s.NoError(err) {
+		s.Equal(int64(-300), num)
+	}
+
+	if buf, err := dec.ReadBytes(); s.NoError(err) {
+		s.Equal([]byte{0x00, 0xFF}, buf)
+	}
+
+	if str, err := dec.Desc().ReadString(); s.NoError(err) {
+		s.Equal("desc\x00", str)
+	}
+
+	_, err = dec.ReadInt()
+	s.Error(err)
+
+	if num, err := dec.ReadUint(); s.NoError(err) {
+		s.Equal(uint64(math.MaxUint64), num)
+	}
+
+	if num, err := dec.ReadFloat(); s.NoError(err) {
+		s.Equal(-2.5, num)
+	}
+
+	if ok, err := dec.ReadBool(); s.NoError(err) {
+		s.True(ok)
+	}
+
+	if tm, err := dec.ReadTime(); s.NoError(err) {
+		s.True(now.Equal(tm))
+	}
+
+	s.NoError(dec.ReadNil())
+
+	if buf, err := dec.ReadUUID(); s.NoError(err) {
+		s.Equal(uid, buf)
+	}
+
+	s.True(dec.Empty())
+	s.Error(dec.Skip())
+
+	_, err = keys.AppendUUID(nil, []byte{1})
+	s.Error(err)
+}
+
+func (s *KeysSuite) TestFixedTime() {
+	now := time.Now()
+	buf := keys.AppendFixedTime([]byte{0x01}, now)
+	s.Len(buf, 9)
+
+	if tm, err := keys.FixedTime(buf[1:]); s.NoError(err) {
+		s.True(now.Equal(tm))
+	}
+
+	_, err := keys.FixedTime(buf[:3])
+	s.Error(err)
+}
@@ -16,6 +16,7 @@ type QueryT struct {
 	IdxFrom []byte
 	IdxLast []byte
 	QueryID []byte
+	Covered bool
 }
 
 func (t *QueryT) Pack(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
@@ -48,6 +49,7 @@ func (t *QueryT) Pack(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	QueryAddIdxFrom(builder, idxFromOffset)
 	QueryAddIdxLast(builder, idxLastOffset)
 	QueryAddQueryID(builder, queryIDOffset)
+	QueryAddCovered(builder, t.Covered)
 	return QueryEnd(builder)
 }
 
@@ -61,6 +63,7 @@ func (rcv *Query) UnPackTo(t *QueryT) {
 	t.IdxFrom = rcv.IdxFromBytes()
 	t.IdxLast = rcv.IdxLastBytes()
 	t.QueryID = rcv.QueryIDBytes()
+	t.Covered = rcv.Covered()
 }
 
 func (rcv *Query) UnPack() *QueryT {
@@ -288,8 +291,20 @@ func (rcv *Query) MutateQueryID(j int, n byte) bool {
 	return false
 }
 
+func (rcv *Query) Covered() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(22))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Query) MutateCovered(n bool) bool {
+	return rcv._tab.MutateBoolSlot(22, n)
+}
+
 func QueryStart(builder *flatbuffers.Builder) {
-	builder.StartObject(9)
+	builder.StartObject(10)
 }
 func QueryAddSize(builder *flatbuffers.Builder, size uint32) {
 	builder.PrependUint32Slot(0, size, 0)
@@ -330,6 +345,9 @@ func QueryAddQueryID(builder *flatbuffers.Builder, queryID flatbuffers.UOffsetT)
 func QueryStartQueryIDVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(1, numElems, 1)
 }
+func QueryAddCovered(builder *flatbuffers.Builder, covered bool) {
+	builder.PrependBoolSlot(9, covered, false)
+}
 func QueryEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
@@ -7,8 +7,9 @@ import (
 )
 
 type TransactionT struct {
-	Start  int64
-	Status byte
+	Start     int64
+	Status    byte
+	Heartbeat int64
 }
 
 func (t *TransactionT) Pack(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
@@ -18,12 +19,14 @@ func (t *TransactionT) Pack(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	TransactionStart(builder)
 	TransactionAddStart(builder, t.Start)
 	TransactionAddStatus(builder, t.Status)
+	TransactionAddHeartbeat(builder, t.Heartbeat)
 	return TransactionEnd(builder)
 }
 
 func (rcv *Transaction) UnPackTo(t *TransactionT) {
 	t.Start = rcv.Start()
 	t.Status = rcv.Status()
+	t.Heartbeat = rcv.Heartbeat()
 }
 
 func (rcv *Transaction) UnPack() *TransactionT {
@@ -79,8 +82,20 @@ func (rcv *Transaction) MutateStatus(n byte) bool {
 	return rcv._tab.MutateByteSlot(6, n)
 }
 
+func (rcv *Transaction) Heartbeat() int64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(8))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *Transaction) MutateHeartbeat(n int64) bool {
+	return rcv._tab.MutateInt64Slot(8, n)
+}
+
 func TransactionStart(builder *flatbuffers.Builder) {
-	builder.StartObject(2)
+	builder.StartObject(3)
 }
 func TransactionAddStart(builder *flatbuffers.Builder, start int64) {
 	builder.PrependInt64Slot(0, start, 0)
@@ -88,6 +103,9 @@ func TransactionAddStart(builder *flatbuffers.Builder, start int64) {
 func TransactionAddStatus(builder *flatbuffers.Builder, status byte) {
 	builder.PrependByteSlot(1, status, 3)
 }
+func TransactionAddHeartbeat(builder *flatbuffers.Builder, heartbeat int64) {
+	builder.PrependInt64Slot(2, heartbeat, 0)
+}
 func TransactionEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
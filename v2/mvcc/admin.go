@@ -0,0 +1,301 @@
+package mvcc
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/models"
+)
+
+// TxInfo - сведения о выполняемой логической транзакции
+type TxInfo struct {
+	ID        string
+	Start     time.Time
+	Age       time.Duration
+	Heartbeat time.Time
+	Cancelled bool
+}
+
+// LockInfo - сведения о блокировке SharedLock и ожидающих ее транзакциях
+type LockInfo struct {
+	Key     fdb.Key
+	Holder  string
+	Updated time.Time
+	Waiters []LockWaiter
+}
+
+// LockWaiter - сведения о транзакции, ожидающей блокировку
+type LockWaiter struct {
+	ID    string
+	Since time.Time
+}
+
+/*
+	ListTx - список выполняемых в данный момент транзакций.
+
+	В реестр попадают только транзакции, которые что-то изменяли, поскольку транзакции на чтение
+	не оставляют в БД никаких следов. Отметка активности обновляется при каждой записи, но не чаще раза в секунду.
+	Если транзакция уже отменена принудительно, но еще не завершилась, у нее выставлен флаг Cancelled.
+
+	Транзакции, которые не отмечались дольше AliveTimeout, скорее всего потеряны вместе с упавшим процессом.
+	В список они не попадают, а их записи удаляются из реестра. Если такая транзакция все же жива,
+	она снова появится в реестре при следующей записи.
+*/
+func ListTx(dbc db.Connection) (res []TxInfo, err error) {
+	ids := make([]suid, 0, 64)
+	now := time.Now()
+	stale := make([]fdb.KeyValue, 0, 8)
+
+	if err = scanPrefix(dbc, fdb.Key{nsAlive}, func(kv fdb.KeyValue) error {
+		var txid suid
+
+		if len(kv.Key) != len(txid)+1 {
+			return nil
+		}
+
+		copy(txid[:], kv.Key[1:])
+		mod := models.GetRootAsTransaction(kv.Value, 0)
+
+		if now.Sub(time.Unix(0, mod.Heartbeat())) > AliveTimeout {
+			stale = append(stale, kv)
+			return nil
+		}
+
+		ids = append(ids, txid)
+		res = append(res, TxInfo{
+			ID:        txid.String(),
+			Start:     time.Unix(0, mod.Start()).UTC(),
+			Age:       now.Sub(time.Unix(0, mod.Start())),
+			Heartbeat: time.Unix(0, mod.Heartbeat()).UTC(),
+		})
+		return nil
+	}); err != nil {
+		return nil, ErrListTx.WithReason(err)
+	}
+
+	if len(stale) > 0 {
+		if err = dbc.Write(func(w db.Writer) error {
+			for i := range stale {
+				// Транзакция могла ожить и отметиться снова, тогда запись не трогаем
+				if bytes.Equal(w.Data(stale[i].Key), stale[i].Value) {
+					w.Delete(stale[i].Key)
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return nil, ErrListTx.WithReason(err)
+		}
+	}
+
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	// Отдельно проверяем, какие из них уже отменены, но еще не узнали об этом
+	if err = dbc.Read(func(r db.Reader) error {
+		vals := make([]fdb.FutureByteSlice, len(ids))
+
+		for i := range ids {
+			vals[i] = r.Item(WrapTxKey(ids[i][:]))
+		}
+
+		for i := range vals {
+			if val := vals[i].MustGet(); len(val) > 0 {
+				res[i].Cancelled = models.GetRootAsTransaction(val, 0).Status() == txStatusCancelled
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, ErrListTx.WithReason(err)
+	}
+
+	return res, nil
+}
+
+/*
+	ListLocks - список блокировок SharedLock с владельцами и ожидающими транзакциями.
+
+	Владелец может быть неизвестен (пустой Holder), если блокировка уже освобождена, но ее кто-то еще ждет.
+*/
+func ListLocks(dbc db.Connection) (res []LockInfo, err error) {
+	locks := make(map[string]int, 64)
+
+	lockInfo := func(key fdb.Key) *LockInfo {
+		skey := key.String()
+
+		if i, ok := locks[skey]; ok {
+			return &res[i]
+		}
+
+		locks[skey] = len(res)
+		res = append(res, LockInfo{Key: key})
+		return &res[len(res)-1]
+	}
+
+	if err = scanPrefix(dbc, fdb.Key{nsLock}, func(kv fdb.KeyValue) (exp error) {
+		info := lockInfo(kv.Key[1:])
+
+		if info.Updated, exp = fdbx.Byte2Time(kv.Value); exp != nil {
+			return
+		}
+
+		if len(kv.Value) > 8 {
+			var txid suid
+			copy(txid[:], kv.Value[8:])
+			info.Holder = txid.String()
+		}
+
+		return nil
+	}); err != nil {
+		return nil, ErrListLocks.WithReason(err)
+	}
+
+	if err = scanPrefix(dbc, fdb.Key{nsWait}, func(kv fdb.KeyValue) (exp error) {
+		var txid suid
+		var wait LockWaiter
+
+		if len(kv.Key) <= len(txid)+1 {
+			return nil
+		}
+
+		copy(txid[:], kv.Key[len(kv.Key)-len(txid):])
+		wait.ID = txid.String()
+
+		if wait.Since, exp = fdbx.Byte2Time(kv.Value); exp != nil {
+			return
+		}
+
+		info := lockInfo(kv.Key[1 : len(kv.Key)-len(txid)])
+		info.Waiters = append(info.Waiters, wait)
+		return nil
+	}); err != nil {
+		return nil, ErrListLocks.WithReason(err)
+	}
+
+	return res, nil
+}
+
+/*
+	CancelTx - принудительная отмена выполняемой транзакции по ее идентификатору.
+
+	Транзакции выставляется статус "отменено", после чего все ее изменения перестают быть видны
+	и будут удалены при очистке. Блокировки транзакции освобождаются сразу же.
+	Сама транзакция узнает об отмене при попытке коммита и получит ошибку ErrKilled.
+*/
+func CancelTx(dbc db.Connection, id string) (err error) {
+	var txid suid
+
+	if txid, err = parseTxID(id); err != nil {
+		return ErrCancelTx.WithReason(err)
+	}
+
+	locks := make([]fdb.Key, 0, 8)
+	waits := make([]fdb.Key, 0, 8)
+
+	// Собираем блокировки, которые держит или ждет транзакция
+	if err = scanPrefix(dbc, fdb.Key{nsLock}, func(kv fdb.KeyValue) error {
+		if len(kv.Value) > 8 && bytes.Equal(kv.Value[8:], txid[:]) {
+			locks = append(locks, kv.Key)
+		}
+		return nil
+	}); err != nil {
+		return ErrCancelTx.WithReason(err)
+	}
+
+	if err = scanPrefix(dbc, fdb.Key{nsWait}, func(kv fdb.KeyValue) error {
+		if len(kv.Key) > len(txid)+1 && bytes.Equal(kv.Key[len(kv.Key)-len(txid):], txid[:]) {
+			waits = append(waits, kv.Key)
+		}
+		return nil
+	}); err != nil {
+		return ErrCancelTx.WithReason(err)
+	}
+
+	if err = dbc.Write(func(w db.Writer) error {
+		var mod models.TransactionT
+
+		tkey := WrapTxKey(txid[:])
+		akey := WrapAliveKey(txid[:])
+
+		if val := w.Data(tkey); len(val) > 0 {
+			switch models.GetRootAsTransaction(val, 0).Status() {
+			case txStatusCommitted:
+				return ErrCancelTx.WithDetail("Transaction %s already committed", id)
+			case txStatusCancelled:
+				return nil
+			}
+		}
+
+		val := w.Data(akey)
+
+		if len(val) == 0 {
+			return ErrNotFound.WithDebug(errx.Debug{"txid": id})
+		}
+
+		models.GetRootAsTransaction(val, 0).UnPackTo(&mod)
+		mod.Status = txStatusCancelled
+
+		w.Delete(akey)
+		w.Upsert(fdb.KeyValue{Key: tkey, Value: fdbx.FlatPack(&mod)})
+
+		for i := range locks {
+			// Блокировку могли уже освободить или перехватить, проверяем владельца еще раз
+			if val = w.Data(locks[i]); len(val) > 8 && bytes.Equal(val[8:], txid[:]) {
+				w.Delete(locks[i])
+			}
+		}
+
+		for i := range waits {
+			w.Delete(waits[i])
+		}
+
+		return nil
+	}); err != nil {
+		return ErrCancelTx.WithReason(err)
+	}
+
+	globCache.set(txid, txStatusCancelled)
+	return nil
+}
+
+// scanPrefix - постраничная выборка служебных ключей по префиксу, каждая страница в отдельной физ.транзакции
+func scanPrefix(dbc db.Connection, prefix fdb.Key, hdl func(fdb.KeyValue) error) (err error) {
+	const pack = 1000
+
+	var rows []fdb.KeyValue
+
+	skip := false
+	from := prefix
+	list := func(r db.Reader) error {
+		rows = r.List(from, prefix, pack, false, skip).GetSliceOrPanic()
+		return nil
+	}
+
+	for {
+		if err = dbc.Read(list); err != nil {
+			return
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		for i := range rows {
+			rows[i].Key = rows[i].Key[1:]
+
+			if err = hdl(rows[i]); err != nil {
+				return
+			}
+		}
+
+		from = rows[len(rows)-1].Key
+		skip = true
+	}
+}
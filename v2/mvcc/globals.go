@@ -2,8 +2,11 @@ package mvcc
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"math/rand"
 	"time"
+
+	"github.com/shestakovda/errx"
 )
 
 var globCache = makeCache()
@@ -13,6 +16,8 @@ const (
 	nsTx    byte = 1
 	nsLock  byte = 2
 	nsWatch byte = 3
+	nsAlive byte = 4
+	nsWait  byte = 5
 )
 
 const (
@@ -30,3 +35,20 @@ func newTxID() (uid suid) {
 	binary.BigEndian.PutUint32(uid[8:12], rand.New(rand.NewSource(now)).Uint32())
 	return
 }
+
+func (uid suid) String() string { return hex.EncodeToString(uid[:]) }
+
+func parseTxID(id string) (uid suid, err error) {
+	var buf []byte
+
+	if buf, err = hex.DecodeString(id); err != nil {
+		return uid, ErrTxID.WithReason(err)
+	}
+
+	if len(buf) != len(uid) {
+		return uid, ErrTxID.WithDebug(errx.Debug{"id": id})
+	}
+
+	copy(uid[:], buf)
+	return uid, nil
+}
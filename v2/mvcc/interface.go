@@ -2,6 +2,7 @@ package mvcc
 
 import (
 	"context"
+	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/shestakovda/errx"
@@ -13,9 +14,18 @@ import (
 // TxCacheSize - размер глобального кеша статусов завершенных транзакций
 var TxCacheSize = 8000000
 
+// AliveTimeout - срок, после которого транзакция без отметок активности считается завершенной аварийно
+var AliveTimeout = 10 * time.Minute
+
 // Begin - создание и старт новой транзакции
 func Begin(dbc db.Connection) Tx { return newTx64(dbc) }
 
+// BeginReadOnly - создание и старт новой транзакции только на чтение
+//
+// Такая транзакция не сохраняет свой статус в БД, читает данные снимком без конфликтов
+// и отклоняет любые операции изменения данных и блокировки.
+func BeginReadOnly(dbc db.Connection) Tx { return newTx64ReadOnly(dbc) }
+
 // WithTx - выполнение метода в рамках транзакции
 func WithTx(dbc db.Connection, hdl TxHandler) (err error) {
 	tx := Begin(dbc)
@@ -43,25 +53,27 @@ type Tx interface {
 	Commit(args ...Option) error
 
 	// Выборка актуального значения для ключа
+	// С опцией Conflict возвращает ErrConflict, если ключ изменяет еще не завершенная параллельная транзакция
+	// Транзакция без отметок активности дольше AliveTimeout при этом отменяется, как через CancelTx
 	Select(fdb.Key, ...Option) (fdb.KeyValue, error)
 
 	// Выборка нескольких объектов, в результате использовано печатное представление ключа
 	SelectMany(keys []fdb.Key, args ...Option) (res map[string]fdb.KeyValue, err error)
 
 	// Удаление значения для ключа
-	// Поддерживает опции Writer
+	// Поддерживает опции Writer, Conflict
 	Delete([]fdb.Key, ...Option) error
 
 	// Вставка или обновление значения для ключа
-	// Поддерживает опции Writer
+	// Поддерживает опции Writer, Conflict
 	Upsert([]fdb.KeyValue, ...Option) error
 
 	// Последовательная выборка всех активных ключей в диапазоне
-	// Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Writer
+	// Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Conflict, Writer
 	ListAll(context.Context, ...Option) ([]fdb.KeyValue, error)
 
 	// Последовательная выборка всех активных ключей в диапазоне
-	// Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Writer
+	// Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Conflict, Writer
 	SeqScan(context.Context, ...Option) (<-chan fdb.KeyValue, <-chan error)
 
 	// Загрузка бинарных данных по ключу, указывается ожидаемый размер
@@ -84,7 +96,8 @@ type Tx interface {
 	OnCommit(CommitHandler)
 
 	// Запуск очистки устаревших записей ключей по указанному префиксу
-	Vacuum(fdb.Key, ...Option) error
+	// Поддерживает опции From, OnVacuum, OnVacuumPart, VacuumContext, VacuumRate, VacuumBytes, VacuumWorkers, Writer
+	Vacuum(fdb.Key, ...Option) (VacuumReport, error)
 
 	// Изменение сигнального ключа, чтобы сработали Watch
 	// По сути, выставляет хук OnCommit с правильным содержимым
@@ -94,6 +107,21 @@ type Tx interface {
 	Watch(fdb.Key) (db.Waiter, error)
 }
 
+// VacuumReport - статистика очистки устаревших записей
+type VacuumReport struct {
+	// Кол-во просмотренных версий строк
+	Rows uint64
+
+	// Кол-во удаленных устаревших версий
+	Removed uint64
+
+	// Кол-во использованных физических транзакций
+	Physical uint64
+
+	// Общее время очистки
+	Duration time.Duration
+}
+
 // Option - дополнительный аргумент при выполнении команды
 type Option func(*options)
 
@@ -103,6 +131,10 @@ type TxHandler func(Tx) error
 // RowHandler - обработчик события операции с записью в рамках физической транзакции
 type RowHandler func(Tx, db.Writer, fdb.KeyValue) error
 
+// VacuumHandler - обработчик завершения очередной физической транзакции очистки
+// Получает ключ, на котором остановилась очистка, или пустой ключ, если префикс пройден до конца
+type VacuumHandler func(db.Writer, fdb.Key) error
+
 // CommitHandler - обработчик события завершения логической транзакции
 type CommitHandler func(db.Writer) error
 
@@ -131,6 +163,16 @@ func WrapWatchKey(key fdb.Key) fdb.Key {
 	return fdbx.AppendLeft(key, nsWatch)
 }
 
+// WrapAliveKey - обертка для получения системного ключа реестра выполняемых транзакций
+func WrapAliveKey(key fdb.Key) fdb.Key {
+	return fdbx.AppendLeft(key, nsAlive)
+}
+
+// WrapWaitKey - обертка для получения системного ключа ожидания блокировки транзакцией
+func WrapWaitKey(key fdb.Key, txid []byte) fdb.Key {
+	return fdbx.AppendLeft(fdbx.AppendRight(key, txid...), nsWait)
+}
+
 // Ошибки модуля
 var (
 	ErrClose         = errx.New("Ошибка завершения транзакции")
@@ -140,6 +182,7 @@ var (
 	ErrSeqScan       = errx.New("Ошибка полной выборки данных")
 	ErrNotFound      = errx.New("Отсутствует значение")
 	ErrDuplicate     = errx.New("Дублирующее значение")
+	ErrConflict      = errx.New("Значение изменяет параллельная транзакция")
 	ErrBLOBLoad      = errx.New("Ошибка загрузки BLOB")
 	ErrBLOBDrop      = errx.New("Ошибка удаления BLOB")
 	ErrBLOBSave      = errx.New("Ошибка сохранения BLOB")
@@ -147,4 +190,10 @@ var (
 	ErrReleaseLock   = errx.New("Ошибка освобождения блокировки")
 	ErrVacuum        = errx.New("Ошибка автоочистки значений")
 	ErrAlreadyLocked = errx.New("Уже получена другая блокировка, нужно сначала освободить ее")
+	ErrReadOnly      = errx.New("Транзакция открыта только на чтение")
+	ErrKilled        = errx.New("Транзакция принудительно отменена")
+	ErrTxID          = errx.New("Некорректный идентификатор транзакции")
+	ErrListTx        = errx.New("Ошибка получения списка транзакций")
+	ErrListLocks     = errx.New("Ошибка получения списка блокировок")
+	ErrCancelTx      = errx.New("Ошибка принудительной отмены транзакции")
 )
@@ -189,6 +189,139 @@ func (s *MVCCSuite) TestUpsertIsolationSameTx() {
 	}
 }
 
+func (s *MVCCSuite) TestReadOnly() {
+	key := fdb.Key("key1")
+	val := []byte("val1")
+
+	s.Require().NoError(s.tx.Upsert([]fdb.KeyValue{{key, val}}))
+	s.Require().NoError(s.tx.Commit())
+
+	tx := mvcc.BeginReadOnly(s.cn)
+	defer tx.Cancel()
+
+	// Чтение работает как обычно
+	if sel, err := tx.Select(key); s.NoError(err) {
+		s.Equal(string(val), string(sel.Value))
+	}
+
+	if list, err := tx.ListAll(context.Background()); s.NoError(err) {
+		s.Len(list, 1)
+	}
+
+	// А любые изменения и блокировки запрещены
+	if err := tx.Upsert([]fdb.KeyValue{{key, val}}); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrUpsert, mvcc.ErrReadOnly))
+	}
+
+	if err := tx.Delete([]fdb.Key{key}); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrDelete, mvcc.ErrReadOnly))
+	}
+
+	if err := tx.SaveBLOB(key, val); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrBLOBSave, mvcc.ErrReadOnly))
+	}
+
+	if err := tx.DropBLOB(key); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrBLOBDrop, mvcc.ErrReadOnly))
+	}
+
+	if err := tx.SharedLock(key); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrSharedLock, mvcc.ErrReadOnly))
+	}
+
+	if _, err := tx.Select(key, mvcc.Lock()); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrSelect, mvcc.ErrReadOnly))
+	}
+
+	if _, err := tx.ListAll(context.Background(), mvcc.Lock()); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrSeqScan, mvcc.ErrReadOnly))
+	}
+
+	// Коммит ничего не пишет в БД
+	s.Require().NoError(tx.Commit())
+
+	s.Require().NoError(s.cn.Read(func(r db.Reader) error {
+		s.Len(r.List(fdb.Key{0x01}, fdb.Key{0x01}, 0, false, false).GetSliceOrPanic(), 1)
+		return nil
+	}))
+}
+
+func (s *MVCCSuite) TestAdmin() {
+	key := fdb.Key("key1")
+	lock := fdb.Key("lock")
+
+	// Транзакция без изменений в реестр не попадает
+	if list, err := mvcc.ListTx(s.cn); s.NoError(err) {
+		s.Len(list, 0)
+	}
+
+	tx := mvcc.Begin(s.cn)
+	defer tx.Cancel()
+
+	s.Require().NoError(tx.Upsert([]fdb.KeyValue{{key, []byte("val1")}}))
+	s.Require().NoError(tx.SharedLock(lock))
+
+	list, err := mvcc.ListTx(s.cn)
+	s.Require().NoError(err)
+	s.Require().Len(list, 1)
+	s.False(list[0].Cancelled)
+	s.False(list[0].Start.IsZero())
+	s.False(list[0].Heartbeat.IsZero())
+
+	if locks, err := mvcc.ListLocks(s.cn); s.NoError(err) && s.Len(locks, 1) {
+		s.Equal(lock, locks[0].Key)
+		s.Equal(list[0].ID, locks[0].Holder)
+		s.Len(locks[0].Waiters, 0)
+	}
+
+	// Отменяем принудительно, блокировка должна освободиться сразу
+	s.Require().NoError(mvcc.CancelTx(s.cn, list[0].ID))
+
+	if locks, err := mvcc.ListLocks(s.cn); s.NoError(err) {
+		s.Len(locks, 0)
+	}
+
+	if list, err := mvcc.ListTx(s.cn); s.NoError(err) {
+		s.Len(list, 0)
+	}
+
+	// Изменения отмененной транзакции не видны
+	tx2 := mvcc.Begin(s.cn)
+	defer tx2.Cancel()
+
+	if _, err := tx2.Select(key); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrNotFound))
+	}
+
+	// А сама транзакция узнает об отмене при коммите
+	if err := tx.Commit(); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrClose, mvcc.ErrKilled))
+	}
+
+	if err := mvcc.CancelTx(s.cn, "bad id"); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrCancelTx, mvcc.ErrTxID))
+	}
+
+	// Транзакция, давно не отмечавшая активность, считается потерянной и убирается из реестра
+	tx3 := mvcc.Begin(s.cn)
+	defer tx3.Cancel()
+	s.Require().NoError(tx3.Upsert([]fdb.KeyValue{{key, []byte("val3")}}))
+
+	defer func(d time.Duration) { mvcc.AliveTimeout = d }(mvcc.AliveTimeout)
+	mvcc.AliveTimeout = 10 * time.Millisecond
+	time.Sleep(50 * time.Millisecond)
+
+	if list, err := mvcc.ListTx(s.cn); s.NoError(err) {
+		s.Len(list, 0)
+	}
+
+	mvcc.AliveTimeout = time.Minute
+
+	if list, err := mvcc.ListTx(s.cn); s.NoError(err) {
+		s.Len(list, 0)
+	}
+}
+
 func (s *MVCCSuite) TestConcurrentInsideTx() {
 	var wg sync.WaitGroup
 
@@ -379,6 +512,82 @@ func (s *MVCCSuite) TestListAll() {
 	tx2.Cancel()
 }
 
+func (s *MVCCSuite) TestExclusiveConflict() {
+	key := fdb.Key("key")
+	hdlr := func(tx mvcc.Tx, w db.Writer, p fdb.KeyValue) error {
+		return tx.Upsert([]fdb.KeyValue{{p.Key, append(p.Value, '+')}}, mvcc.Writer(w))
+	}
+
+	s.Require().NoError(s.tx.Upsert([]fdb.KeyValue{{key, []byte("val")}}))
+	s.Require().NoError(s.tx.Commit())
+
+	// Своя незавершенная версия не мешает, чужая - конфликт
+	tx1 := mvcc.Begin(s.cn)
+	tx2 := mvcc.Begin(s.cn)
+
+	_, err := tx1.Select(key, mvcc.Exclusive(hdlr), mvcc.Conflict())
+	s.Require().NoError(err)
+	_, err = tx1.Select(key, mvcc.Exclusive(hdlr), mvcc.Conflict())
+	s.Require().NoError(err)
+	_, err = tx2.Select(key, mvcc.Exclusive(hdlr), mvcc.Conflict())
+	s.True(errx.Is(err, mvcc.ErrConflict))
+
+	// Без проверки блокировка только физическая
+	_, err = tx2.Select(key, mvcc.Lock())
+	s.NoError(err)
+
+	// Обычная выборка видит закоммиченное значение
+	if sel, err := tx2.Select(key); s.NoError(err) {
+		s.Equal("val", string(sel.Value))
+	}
+
+	// После отмены конфликта больше нет
+	tx1.Cancel()
+
+	if sel, err := tx2.Select(key, mvcc.Exclusive(hdlr), mvcc.Conflict()); s.NoError(err) {
+		s.Equal("val", string(sel.Value))
+	}
+
+	s.Require().NoError(tx2.Commit())
+
+	tx3 := mvcc.Begin(s.cn)
+	defer tx3.Cancel()
+
+	if sel, err := tx3.Select(key); s.NoError(err) {
+		s.Equal("val+", string(sel.Value))
+	}
+
+	// Брошенная транзакция без отметок активности дольше AliveTimeout не мешает вечно, ее отменяют
+	lost := mvcc.Begin(s.cn)
+	s.Require().NoError(lost.Upsert([]fdb.KeyValue{{key, []byte("lost")}}))
+
+	tx4 := mvcc.Begin(s.cn)
+	_, err = tx4.Select(key, mvcc.Exclusive(hdlr), mvcc.Conflict())
+	s.True(errx.Is(err, mvcc.ErrConflict))
+
+	defer func(d time.Duration) { mvcc.AliveTimeout = d }(mvcc.AliveTimeout)
+	mvcc.AliveTimeout = 10 * time.Millisecond
+	time.Sleep(50 * time.Millisecond)
+
+	if sel, err := tx4.Select(key, mvcc.Exclusive(hdlr), mvcc.Conflict()); s.NoError(err) {
+		s.Equal("val+", string(sel.Value))
+	}
+
+	s.Require().NoError(tx4.Commit())
+
+	// Если брошенная транзакция все же жива, закоммитить она уже не сможет
+	if err = lost.Commit(); s.Error(err) {
+		s.True(errx.Is(err, mvcc.ErrClose, mvcc.ErrKilled))
+	}
+
+	tx5 := mvcc.Begin(s.cn)
+	defer tx5.Cancel()
+
+	if sel, err := tx5.Select(key); s.NoError(err) {
+		s.Equal("val++", string(sel.Value))
+	}
+}
+
 func (s *MVCCSuite) TestSharedLock() {
 	key := fdb.Key("key")
 	lock := fdb.Key("lock")
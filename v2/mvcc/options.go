@@ -1,6 +1,8 @@
 package mvcc
 
 import (
+	"context"
+
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 
 	"github.com/shestakovda/fdbx/v2/db"
@@ -28,12 +30,16 @@ func getOpts(args []Option) (o options) {
 
 type options struct {
 	lock     bool
+	conflict bool
 	reverse  bool
 	physical bool
 	limit    int
 	rowmem   int
 	rowsize  int
 	vpack    uint64
+	vrate    int
+	vsize    int
+	vworkers int
 	spack    uint64
 	from     fdb.Key
 	last     fdb.Key
@@ -43,9 +49,12 @@ type options struct {
 	onVacuum RowHandler
 	onLock   RowHandler
 	writer   db.Writer
+	vacPart  VacuumHandler
+	vacCtx   context.Context
 }
 
 func Lock() Option                    { return func(o *options) { o.lock = true } }
+func Conflict() Option                { return func(o *options) { o.lock = true; o.conflict = true } }
 func Last(k fdb.Key) Option           { return func(o *options) { o.last = k } }
 func From(k fdb.Key) Option           { return func(o *options) { o.from = k } }
 func Limit(l int) Option              { return func(o *options) { o.limit = l } }
@@ -60,3 +69,9 @@ func Exclusive(hdl RowHandler) Option { return func(o *options) { o.lock = true;
 func SelectPack(size int) Option      { return func(o *options) { o.spack = uint64(size) } }
 func MaxRowMem(size int) Option       { return func(o *options) { o.rowmem = size } }
 func MaxRowSize(size int) Option      { return func(o *options) { o.rowsize = size } }
+func VacuumRate(rows int) Option      { return func(o *options) { o.vrate = rows } }
+func VacuumBytes(size int) Option     { return func(o *options) { o.vsize = size } }
+func VacuumWorkers(n int) Option      { return func(o *options) { o.vworkers = n } }
+
+func OnVacuumPart(hdl VacuumHandler) Option    { return func(o *options) { o.vacPart = hdl } }
+func VacuumContext(ctx context.Context) Option { return func(o *options) { o.vacCtx = ctx } }
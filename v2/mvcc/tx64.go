@@ -44,6 +44,13 @@ func newTx64(conn db.Connection) *tx64 {
 	}
 }
 
+// newTx64ReadOnly - транзакция только на чтение, статус которой никогда не попадает в БД
+func newTx64ReadOnly(conn db.Connection) *tx64 {
+	tx := newTx64(conn)
+	tx.ronly = true
+	return tx
+}
+
 /*
 tx64 - объект "логической" транзакции MVCC поверх "физической" транзакции FDB
 */
@@ -54,10 +61,12 @@ type tx64 struct {
 	txid  suid
 	conn  db.Connection
 	start int64
+	ronly bool
 
 	// Atomic
 	opid uint32
 	mods uint32
+	beat int64
 
 	// RWMutex
 	status byte
@@ -107,11 +116,21 @@ func (t *tx64) onCommit(w db.Writer) (err error) {
 		return nil
 	}
 
+	// Хуки коммита всегда что-то пишут, а транзакция на чтение писать не может
+	if t.ronly {
+		return ErrReadOnly.WithStack()
+	}
+
 	return t.applyWriteHandler(w, t.applyOnCommit, true)
 }
 
 // Применяет все установленные в процессе транзакции патчи на коммит
 func (t *tx64) applyOnCommit(w db.Writer) (err error) {
+	// Если транзакцию уже отменили принудительно, хуки применять нельзя
+	if t.isKilled(w.Reader) {
+		return ErrKilled.WithDebug(errx.Debug{"txid": t.txid.String()})
+	}
+
 	for i := range t.oncomm {
 		if err = t.oncomm[i](w); err != nil {
 			return
@@ -125,6 +144,7 @@ func (t *tx64) applyOnCommit(w db.Writer) (err error) {
 func (t *tx64) applyWriteHandler(w db.Writer, h db.WriteHandler, mod bool) error {
 	if mod {
 		atomic.AddUint32(&t.mods, 1)
+		h = t.heartbeat(h)
 	}
 
 	if w.Empty() {
@@ -134,6 +154,46 @@ func (t *tx64) applyWriteHandler(w db.Writer, h db.WriteHandler, mod bool) error
 	return h(w)
 }
 
+// Отмечает активность транзакции в реестре выполняемых, но не чаще раза в секунду
+func (t *tx64) heartbeat(h db.WriteHandler) db.WriteHandler {
+	now := time.Now().UTC().UnixNano()
+	last := atomic.LoadInt64(&t.beat)
+
+	if now-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&t.beat, last, now) {
+		return h
+	}
+
+	return func(w db.Writer) error {
+		w.Upsert(fdb.KeyValue{
+			Key: WrapAliveKey(t.txid[:]),
+			Value: fdbx.FlatPack(&models.TransactionT{
+				Start:     t.start,
+				Status:    txStatusRunning,
+				Heartbeat: now,
+			}),
+		})
+		return h(w)
+	}
+}
+
+// Применяет обработчик чтения: снимком для транзакции на чтение, либо обычной физ.транзакцией
+func (t *tx64) applyReadHandler(h db.ReadHandler) error {
+	if t.ronly {
+		return t.conn.Snapshot(h)
+	}
+
+	return t.conn.Read(h)
+}
+
+// Проверка возможности изменять данные в рамках транзакции
+func (t *tx64) checkWrite() error {
+	if t.ronly {
+		return ErrReadOnly.WithStack()
+	}
+
+	return nil
+}
+
 // Cancel - Неудачное завершение (отклонение) транзакции
 // Поддерживает опции Writer
 func (t *tx64) Cancel(args ...Option) {
@@ -147,8 +207,13 @@ func (t *tx64) Cancel(args ...Option) {
 	Чтобы найти актуальную запись, нужно сделать по сути обычный Select.
 	Удалить - значит обновить значение в служебных полях и записать в тот же ключ.
 	Важно, чтобы выборка и обновление шли строго в одной внутренней FDB транзакции.
+	С опцией Conflict удаляются только версии, созданные и удаленные завершенными транзакциями, иначе ErrConflict.
 */
 func (t *tx64) Delete(keys []fdb.Key, args ...Option) (err error) {
+	if err = t.checkWrite(); err != nil {
+		return ErrDelete.WithReason(err)
+	}
+
 	opts := getOpts(args)
 	opid := atomic.AddUint32(&t.opid, 1)
 	hdlr := func(w db.Writer) (exp error) {
@@ -169,6 +234,10 @@ func (t *tx64) Delete(keys []fdb.Key, args ...Option) (err error) {
 				return
 			}
 
+			if exp = t.checkConflicts(w, lc, rows, opts.conflict); exp != nil {
+				return
+			}
+
 			if exp = t.dropRows(w, opid, rows, opts.onDelete, opts.physical); exp != nil {
 				return
 			}
@@ -192,8 +261,13 @@ func (t *tx64) Delete(keys []fdb.Key, args ...Option) (err error) {
 	Обновить - значит удалить актуальное значение и добавить новое.
 
 	Важно, чтобы выборка и обновление шли строго в одной внутренней FDB транзакции.
+	С опцией Conflict заменяются только версии, созданные и удаленные завершенными транзакциями, иначе ErrConflict.
 */
 func (t *tx64) Upsert(pairs []fdb.KeyValue, args ...Option) (err error) {
+	if err = t.checkWrite(); err != nil {
+		return ErrUpsert.WithReason(err)
+	}
+
 	opts := getOpts(args)
 	opid := atomic.AddUint32(&t.opid, 1)
 	hdlr := func(w db.Writer) (exp error) {
@@ -214,6 +288,10 @@ func (t *tx64) Upsert(pairs []fdb.KeyValue, args ...Option) (err error) {
 				return
 			}
 
+			if exp = t.checkConflicts(w, lc, rows, opts.conflict); exp != nil {
+				return
+			}
+
 			if opts.onUpdate != nil && len(rows) > 0 {
 				if exp = opts.onUpdate(t, w, pairs[i]); exp != nil {
 					return
@@ -278,6 +356,21 @@ func (t *tx64) Select(key fdb.Key, args ...Option) (res fdb.KeyValue, err error)
 			w.Lock(ukey, ukey)
 		}
 
+		if opts.conflict {
+			lc := makeCache()
+			rows := w.List(ukey, ukey, 0, true, false).GetSliceOrPanic()
+
+			for i := range rows {
+				if rows[i].Key = rows[i].Key[1:]; len(rows[i].Key) != (len(ukey) + 16) {
+					continue
+				}
+
+				if exp = t.checkConflict(w, lc, rows[i]); exp != nil {
+					return
+				}
+			}
+		}
+
 		if exp = read(w.Reader); exp != nil {
 			return
 		}
@@ -290,9 +383,11 @@ func (t *tx64) Select(key fdb.Key, args ...Option) (res fdb.KeyValue, err error)
 	}
 
 	if opts.lock {
-		err = t.applyWriteHandler(opts.writer, hdlr, opts.onLock != nil)
+		if err = t.checkWrite(); err == nil {
+			err = t.applyWriteHandler(opts.writer, hdlr, opts.onLock != nil)
+		}
 	} else {
-		err = t.conn.Read(read)
+		err = t.applyReadHandler(read)
 	}
 
 	if err != nil {
@@ -366,9 +461,11 @@ func (t *tx64) SelectMany(keys []fdb.Key, args ...Option) (res map[string]fdb.Ke
 	}
 
 	if opts.lock {
-		err = t.applyWriteHandler(opts.writer, hdlr, opts.onLock != nil)
+		if err = t.checkWrite(); err == nil {
+			err = t.applyWriteHandler(opts.writer, hdlr, opts.onLock != nil)
+		}
 	} else {
-		err = t.conn.Read(read)
+		err = t.applyReadHandler(read)
 	}
 
 	if err != nil {
@@ -380,7 +477,7 @@ func (t *tx64) SelectMany(keys []fdb.Key, args ...Option) (res map[string]fdb.Ke
 
 /*
 	ListAll - Последовательная выборка всех активных ключей в диапазоне
-	Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Writer
+	Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Conflict, Writer
 */
 func (t *tx64) ListAll(ctx context.Context, args ...Option) (_ []fdb.KeyValue, err error) {
 	ctx, cancel := context.WithCancel(ctx)
@@ -404,7 +501,7 @@ func (t *tx64) ListAll(ctx context.Context, args ...Option) (_ []fdb.KeyValue, e
 
 /*
 	SeqScan - Последовательная выборка всех активных ключей в диапазоне
-	Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Writer
+	Поддерживает опции From, To, Reverse, Limit, PackSize, Exclusive, Conflict, Writer
 */
 func (t *tx64) SeqScan(ctx context.Context, args ...Option) (<-chan fdb.KeyValue, <-chan error) {
 	list := make(chan fdb.KeyValue)
@@ -425,25 +522,40 @@ func (t *tx64) SeqScan(ctx context.Context, args ...Option) (<-chan fdb.KeyValue
 		from := WrapKey(opts.from)
 		last := WrapKey(opts.last)
 		opid := atomic.AddUint32(&t.opid, 1)
-		hdlr := func(w db.Writer) (exp error) {
+		read := func(r db.Reader, w db.Writer) (exp error) {
 			if opts.reverse {
-				rows, part, last, exp = t.selectPart(ctx, w, lcch, from, last, size, skip, opid, &opts)
+				rows, part, last, exp = t.selectPart(ctx, r, w, lcch, from, last, size, skip, opid, &opts)
 			} else {
-				rows, part, from, exp = t.selectPart(ctx, w, lcch, from, last, size, skip, opid, &opts)
+				rows, part, from, exp = t.selectPart(ctx, r, w, lcch, from, last, size, skip, opid, &opts)
 			}
 			return exp
 		}
+		hdlr := func(w db.Writer) error { return read(w.Reader, w) }
+		scan := func() error { return t.applyWriteHandler(opts.writer, hdlr, opts.onLock != nil) }
 
 		if opts.limit > 0 && (opts.spack > uint64(10*opts.limit)) {
 			opts.spack = uint64(10 * opts.limit)
 		}
 
+		// Транзакция на чтение не может блокировать, зато может читать снимком без физ.транзакции записи
+		if t.ronly {
+			if opts.lock {
+				errs <- ErrSeqScan.WithReason(ErrReadOnly.WithStack())
+				return
+			}
+
+			if opts.writer.Empty() {
+				snap := func(r db.Reader) error { return read(r, db.Writer{}) }
+				scan = func() error { return t.applyReadHandler(snap) }
+			}
+		}
+
 		for {
 			if ctx.Err() != nil {
 				return
 			}
 
-			if err = t.applyWriteHandler(opts.writer, hdlr, opts.onLock != nil); err != nil {
+			if err = scan(); err != nil {
 				errs <- ErrSeqScan.WithReason(err)
 				return
 			}
@@ -475,6 +587,7 @@ func (t *tx64) SeqScan(ctx context.Context, args ...Option) (<-chan fdb.KeyValue
 
 func (t *tx64) selectPart(
 	ctx context.Context,
+	r db.Reader,
 	w db.Writer,
 	lc *txCache,
 	from, to fdb.Key,
@@ -493,7 +606,7 @@ func (t *tx64) selectPart(
 	wctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	iter := w.List(from, to, opts.spack, opts.reverse, skip).Iterator()
+	iter := r.List(from, to, opts.spack, opts.reverse, skip).Iterator()
 	part = make([]fdb.KeyValue, 0, 2048)
 
 	// Может оказаться, что данных слишком много или сервер перегружен, тогда мы можем не успеть
@@ -503,7 +616,13 @@ func (t *tx64) selectPart(
 		item := iter.MustGet()
 		item.Key = item.Key[1:]
 
-		if ok, err = t.isVisible(w.Reader, lc, opid, item, false); err != nil {
+		if opts.conflict {
+			if err = t.checkConflict(w, lc, item); err != nil {
+				return
+			}
+		}
+
+		if ok, err = t.isVisible(r, lc, opid, item, false); err != nil {
 			// Скорее всего кончилась транзакция, в следующей пачке получим
 			return rows, part, last, nil
 		}
@@ -541,6 +660,10 @@ func (t *tx64) selectPart(
 	SaveBLOB - Сохранение больших бинарных данных по ключу
 */
 func (t *tx64) SaveBLOB(key fdb.Key, blob []byte, args ...Option) (err error) {
+	if err = t.checkWrite(); err != nil {
+		return ErrBLOBSave.WithReason(err)
+	}
+
 	opts := getOpts(args)
 
 	sum := 0
@@ -605,7 +728,7 @@ func (t *tx64) LoadBLOB(key fdb.Key, _ ...Option) (_ []byte, err error) {
 	}
 
 	for {
-		if err = t.conn.Read(fnc); err != nil {
+		if err = t.applyReadHandler(fnc); err != nil {
 			return nil, ErrBLOBLoad.WithReason(err)
 		}
 
@@ -629,6 +752,10 @@ func (t *tx64) LoadBLOB(key fdb.Key, _ ...Option) (_ []byte, err error) {
 	Поддерживает опции Writer
 */
 func (t *tx64) DropBLOB(key fdb.Key, args ...Option) (err error) {
+	if err = t.checkWrite(); err != nil {
+		return ErrBLOBDrop.WithReason(err)
+	}
+
 	opts := getOpts(args)
 	ukey := WrapKey(key)
 	hdlr := func(w db.Writer) error { w.Erase(ukey, ukey); return nil }
@@ -647,6 +774,10 @@ func (t *tx64) SharedLock(keys ...fdb.Key) (err error) {
 	var lock db.Waiter
 	var exist bool
 
+	if err = t.checkWrite(); err != nil {
+		return ErrSharedLock.WithReason(err)
+	}
+
 	usrKeys := make([]fdb.Key, len(keys))
 	for i := range keys {
 		usrKeys[i] = WrapLockKey(keys[i])
@@ -662,8 +793,22 @@ func (t *tx64) SharedLock(keys ...fdb.Key) (err error) {
 		return nil
 	}
 
+	// Отметки в списке ожидающих удаляются вместе с получением блокировки, а если ее не дождались - здесь
+	waited := false
+	defer func() {
+		if err != nil && waited {
+			_ = t.conn.Write(func(w db.Writer) error {
+				for i := range keys {
+					w.Delete(WrapWaitKey(keys[i], t.txid[:]))
+				}
+				return nil
+			})
+		}
+	}()
+
 	// Стараемся получить блокировку, если занято - ожидаем
 	cnt := 0
+	since := fdbx.Time2Byte(time.Now())
 	for {
 		ack := false
 		start := time.Now()
@@ -672,7 +817,7 @@ func (t *tx64) SharedLock(keys ...fdb.Key) (err error) {
 		if err = t.conn.Write(func(w db.Writer) (exp error) {
 			var val []byte
 
-			now := fdbx.Time2Byte(time.Now())
+			now := t.lockValue()
 			pairs := make([]fdb.KeyValue, len(usrKeys))
 			items := make([]fdb.FutureByteSlice, len(usrKeys))
 
@@ -693,6 +838,9 @@ func (t *tx64) SharedLock(keys ...fdb.Key) (err error) {
 					}
 
 					if time.Since(upd) < 30*time.Second {
+						// Отмечаемся в списке ожидающих, чтобы было видно, кто чего ждет
+						w.Upsert(fdb.KeyValue{Key: WrapWaitKey(keys[i], t.txid[:]), Value: since})
+						waited = true
 						lock = w.Watch(usrKeys[i])
 						return nil
 					}
@@ -701,6 +849,12 @@ func (t *tx64) SharedLock(keys ...fdb.Key) (err error) {
 
 			// Если нам все-таки удается поставить значение - значит блокировка наша
 			w.Upsert(pairs...)
+
+			// И больше мы ничего не ждем
+			for i := range keys {
+				w.Delete(WrapWaitKey(keys[i], t.txid[:]))
+			}
+
 			ack = true
 			return nil
 		}); err != nil {
@@ -765,6 +919,17 @@ func (t *tx64) waitLocks() bool {
 	return true
 }
 
+// Значение ключа блокировки: время последнего обновления и идентификатор владельца
+func (t *tx64) lockValue() []byte {
+	return fdbx.AppendRight(fdbx.Time2Byte(time.Now()), t.txid[:]...)
+}
+
+// Проверка, не была ли транзакция принудительно отменена через CancelTx
+func (t *tx64) isKilled(r db.Reader) bool {
+	val := r.Data(WrapTxKey(t.txid[:]))
+	return len(val) > 0 && models.GetRootAsTransaction(val, 0).Status() == txStatusCancelled
+}
+
 func (t *tx64) isCommitted(local *txCache, r db.Reader, txid suid) (_ bool, err error) {
 	var status byte
 
@@ -842,6 +1007,11 @@ func (t *tx64) close(w db.Writer, status byte) (err error) {
 	}
 	t.status = status
 
+	// Транзакция на чтение не оставляет следов ни в БД, ни в кеше статусов
+	if t.ronly {
+		return nil
+	}
+
 	// Если в рамках транзакции не было никаких изменений (флаг mods), то обходимся только установкой кеша
 	// Это оптимизация транзакций на чтение, поскольку они должны быть максимально "бесплатны" для юзера
 	if atomic.LoadUint32(&t.mods) == 0 {
@@ -856,11 +1026,24 @@ func (t *tx64) close(w db.Writer, status byte) (err error) {
 
 	// При удачном стечении обстоятельств - устанавливаем глобальный кеш
 	globCache.set(t.txid, t.status)
+
+	// Транзакцию успели отменить принудительно, так что коммит не состоялся
+	if t.status != status {
+		return ErrClose.WithReason(ErrKilled.WithDebug(errx.Debug{"txid": t.txid.String()}))
+	}
+
 	return nil
 }
 
 // Cохраняем в БД объект с текущим статусом
 func (t *tx64) save(w db.Writer) error {
+	// Принудительно отмененную транзакцию закоммитить уже нельзя, статус остается прежним
+	if t.status == txStatusCommitted && t.isKilled(w.Reader) {
+		t.status = txStatusCancelled
+	}
+
+	// Из реестра выполняемых транзакций удаляем в любом случае
+	w.Delete(WrapAliveKey(t.txid[:]))
 	w.Upsert(fdb.KeyValue{
 		Key: WrapTxKey(t.txid[:]),
 		Value: fdbx.FlatPack(&models.TransactionT{
@@ -998,6 +1181,89 @@ func (t *tx64) isVisible(r db.Reader, lc *txCache, opid uint32, item fdb.KeyValu
 	return true, nil
 }
 
+/*
+	checkConflict - ошибка ErrConflict, если версию ключа создала или удалила еще не завершенная параллельная транзакция.
+
+	Транзакция, которая не отмечалась дольше AliveTimeout, считается потерянной вместе с упавшим процессом
+	и отменяется, иначе ее записи блокировали бы изменения навсегда. Если она все же жива,
+	то при коммите получит ошибку ErrKilled, как после CancelTx.
+*/
+func (t *tx64) checkConflict(w db.Writer, lc *txCache, item fdb.KeyValue) (err error) {
+	var status byte
+
+	xmin, _ := t.rowTxData(item.Key)
+	txs := []suid{xmin}
+
+	if len(item.Value) > 0 {
+		mod := models.GetRootAsRow(item.Value, 0)
+		ptr := new(models.TxPtr)
+
+		for i := 0; i < mod.DropLength(); i++ {
+			var dtx suid
+
+			if mod.Drop(ptr, i) {
+				copy(dtx[:], ptr.TxBytes())
+				txs = append(txs, dtx)
+			}
+		}
+	}
+
+	for _, txid := range txs {
+		if txid == t.txid {
+			continue
+		}
+
+		if status, err = t.txStatus(lc, w.Reader, txid); err != nil {
+			return
+		}
+
+		if status != txStatusCommitted && status != txStatusCancelled && !t.killLost(w, lc, txid) {
+			return ErrConflict.WithDebug(errx.Debug{"key": UnwrapKey(item.Key), "tx": txid.String()})
+		}
+	}
+
+	return nil
+}
+
+// checkConflicts - проверка checkConflict всех версий, если она нужна
+func (t *tx64) checkConflicts(w db.Writer, lc *txCache, rows []fdb.KeyValue, need bool) (err error) {
+	if !need {
+		return nil
+	}
+
+	for i := range rows {
+		if err = t.checkConflict(w, lc, rows[i]); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// killLost - отмена транзакции без свежей отметки активности, как в CancelTx. Возвращает true, если транзакция отменена
+func (t *tx64) killLost(w db.Writer, lc *txCache, txid suid) bool {
+	var mod models.TransactionT
+
+	akey := WrapAliveKey(txid[:])
+
+	if val := w.Data(akey); len(val) > 0 {
+		models.GetRootAsTransaction(val, 0).UnPackTo(&mod)
+
+		if time.Since(time.Unix(0, mod.Heartbeat)) <= AliveTimeout {
+			return false
+		}
+	}
+
+	mod.Status = txStatusCancelled
+
+	w.Delete(akey)
+	w.Upsert(fdb.KeyValue{Key: WrapTxKey(txid[:]), Value: fdbx.FlatPack(&mod)})
+
+	// В глобальный кеш статус попадет из БД, когда физ.транзакция будет применена
+	lc.set(txid, txStatusCancelled)
+	return true
+}
+
 // fetchRows - все актуальные версии всех ключей по диапазону
 func (t *tx64) fetchRows(
 	r db.Reader,
@@ -1102,44 +1368,315 @@ func (t *tx64) Watch(key fdb.Key) (wait db.Waiter, err error) {
 
 /*
 Vacuum - Запуск очистки устаревших записей ключей по указанному префиксу
+Поддерживает опции From, OnVacuum, OnVacuumPart, VacuumContext, VacuumRate, VacuumBytes, VacuumWorkers, Writer
+
+Если указана опция From, очистка продолжается после этого ключа, а не с начала префикса.
+Обработчик OnVacuumPart вызывается в каждой физической транзакции с ключом, на котором она остановилась,
+поэтому его можно сохранить и потом продолжить очистку с того же места. По завершении префикса ключ пустой.
+
+Если указано несколько обработчиков VacuumWorkers, то префикс делится по границам шардов FDB
+и диапазоны очищаются параллельно. В этом случае OnVacuumPart получает ключ, до которого
+очищены все диапазоны без пропусков, а обработчик OnVacuum может вызываться параллельно.
 */
-func (t *tx64) Vacuum(prefix fdb.Key, args ...Option) (err error) {
+func (t *tx64) Vacuum(prefix fdb.Key, args ...Option) (rep VacuumReport, err error) {
+	if err = t.checkWrite(); err != nil {
+		return rep, ErrVacuum.WithReason(err)
+	}
+
 	skip := false
 	opts := getOpts(args)
 	from := WrapKey(prefix)
 	last := WrapKey(prefix)
+	start := time.Now()
+
+	if len(opts.from) > 0 {
+		from = WrapKey(opts.from)
+		skip = true
+	}
+
+	// Обработчику отдаем пользовательский ключ, без пространства имен
+	onPart := func(w db.Writer, next fdb.Key) error {
+		if opts.vacPart == nil {
+			return nil
+		}
+
+		if len(next) > 0 {
+			next = next[1:]
+		}
+
+		return opts.vacPart(w, next)
+	}
+
+	// Параллельно можно только в отдельных физических транзакциях
+	if opts.vworkers > 1 && opts.writer.Empty() {
+		rep, err = t.vacuumParallel(from, last, skip, &opts, onPart)
+	} else {
+		rep, err = t.vacuumRange(from, last, nil, skip, &opts, onPart, nil)
+	}
+
+	rep.Duration = time.Since(start)
+
+	if err != nil {
+		return rep, ErrVacuum.WithReason(err)
+	}
+
+	return rep, nil
+}
+
+// vacuumSpan - диапазон параллельной очистки и его зафиксированный в БД прогресс
+type vacuumSpan struct {
+	from fdb.Key
+	stop fdb.Key
+	skip bool
+	next fdb.Key
+	done bool
+}
+
+// vacuumParallel - очистка префикса по диапазонам между границами шардов в несколько потоков
+func (t *tx64) vacuumParallel(
+	from, last fdb.Key,
+	skip bool,
+	opts *options,
+	onPart VacuumHandler,
+) (rep VacuumReport, err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var bounds []fdb.Key
+
+	if bounds, err = t.conn.SplitPoints(from, last); err != nil {
+		return
+	}
+
+	spans := make([]vacuumSpan, 1, len(bounds)+1)
+	spans[0] = vacuumSpan{from: from, skip: skip}
+
+	for i := range bounds {
+		// Граница шарда может оказаться до точки продолжения очистки
+		if bytes.Compare(bounds[i], from) <= 0 {
+			continue
+		}
+
+		spans[len(spans)-1].stop = bounds[i]
+		spans = append(spans, vacuumSpan{from: bounds[i]})
+	}
+
+	parent := opts.vacCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// Ограничение скорости общее, делим его поровну между потоками
+	wopt := *opts
+	wopt.vacCtx = ctx
+	if wopt.vrate > 0 {
+		if wopt.vrate /= wopt.vworkers; wopt.vrate == 0 {
+			wopt.vrate = 1
+		}
+	}
+
+	jobs := make(chan int, len(spans))
+	for i := range spans {
+		jobs <- i
+	}
+	close(jobs)
+
+	// Прогресс сохраняем только тот, до которого все диапазоны очищены без пропусков.
+	// Свой прогресс поток учитывает заранее, в той же физ.транзакции, что и удаление строк.
+	// Чужой - только после успешного завершения их физ.транзакций.
+	markPart := func(i int) VacuumHandler {
+		return func(w db.Writer, next fdb.Key) error {
+			mu.Lock()
+			mark := vacuumMark(spans, i, next)
+			mu.Unlock()
+
+			if mark == nil {
+				return nil
+			}
+
+			return onPart(w, mark)
+		}
+	}
+	markDone := func(i int) func(fdb.Key) {
+		return func(next fdb.Key) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if next == nil {
+				spans[i].done = true
+			} else {
+				spans[i].next = next
+			}
+		}
+	}
+
+	workers := opts.vworkers
+	if workers > len(spans) {
+		workers = len(spans)
+	}
+
+	for k := 0; k < workers; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+
+				part, exp := t.vacuumRange(spans[i].from, last, spans[i].stop, spans[i].skip, &wopt, markPart(i), markDone(i))
+
+				mu.Lock()
+				rep.Rows += part.Rows
+				rep.Removed += part.Removed
+				rep.Physical += part.Physical
+				if exp != nil && err == nil {
+					err = exp
+				}
+				mu.Unlock()
+
+				// Одна ошибка останавливает все потоки, прогресс остальных уже сохранен
+				if exp != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err != nil {
+		return
+	}
+
+	// Все диапазоны пройдены, можно сообщить о завершении префикса
+	if err = t.applyWriteHandler(opts.writer, func(w db.Writer) error { return onPart(w, nil) }, true); err != nil {
+		return
+	}
+
+	rep.Physical++
+	return rep, nil
+}
+
+// vacuumMark - последний ключ, до которого очищены все диапазоны, с учетом еще не зафиксированного прогресса i-го
+func vacuumMark(spans []vacuumSpan, i int, next fdb.Key) (mark fdb.Key) {
+	for j := range spans {
+		key, done := spans[j].next, spans[j].done
+
+		if j == i {
+			if next != nil {
+				key = next
+			} else {
+				done = true
+			}
+		}
+
+		if key != nil {
+			mark = key
+		}
+
+		if !done {
+			return mark
+		}
+	}
+
+	return mark
+}
+
+// vacuumRange - последовательная очистка диапазона, по одной физической транзакции за раз
+func (t *tx64) vacuumRange(
+	from, last, stop fdb.Key,
+	skip bool,
+	opts *options,
+	onPart VacuumHandler,
+	onDone func(fdb.Key),
+) (rep VacuumReport, err error) {
+	var next fdb.Key
+	var part VacuumReport
+
 	hdlr := func(w db.Writer) (exp error) {
 		lg := w.List(from, last, opts.vpack, false, skip)
 
-		if from, exp = t.vacuumPart(w, lg, opts.onVacuum); exp != nil {
+		// Физическая транзакция может повторяться, поэтому результат фиксируем только после ее успеха
+		if next, part, exp = t.vacuumPart(w, lg, stop, opts); exp != nil {
 			return
 		}
 
+		if onPart != nil {
+			if exp = onPart(w, next); exp != nil {
+				return
+			}
+		}
+
 		return nil
 	}
 
 	for {
+		begin := time.Now()
+
+		if opts.vacCtx != nil && opts.vacCtx.Err() != nil {
+			return rep, opts.vacCtx.Err()
+		}
+
 		if err = t.applyWriteHandler(opts.writer, hdlr, true); err != nil {
-			return ErrVacuum.WithReason(err)
+			return
+		}
+
+		rep.Rows += part.Rows
+		rep.Removed += part.Removed
+		rep.Physical++
+
+		if onDone != nil {
+			onDone(next)
 		}
 
 		// Пустой ключ - значит больше не было строк, условие выхода
-		if len(from) == 0 {
-			return nil
+		if len(next) == 0 {
+			return rep, nil
 		}
+		from = next
 		skip = true
 
 		// Передышка, чтобы не слишком грузить бд
-		time.Sleep(time.Second)
+		// Если задано ограничение скорости, то ждем ровно столько, чтобы в него уложиться
+		pause := time.Second
+		if opts.vrate > 0 {
+			pause = time.Duration(part.Rows)*time.Second/time.Duration(opts.vrate) - time.Since(begin)
+		}
+
+		if pause <= 0 {
+			continue
+		}
+
+		if opts.vacCtx == nil {
+			time.Sleep(pause)
+			continue
+		}
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-opts.vacCtx.Done():
+			timer.Stop()
+		}
 	}
 }
 
 // vacuumPart - функция обратная fetchRows, в том смысле, что она удаляет все ключи, которые больше не нужны в БД
-func (t *tx64) vacuumPart(w db.Writer, lg fdb.RangeResult, onVacuum RowHandler) (last fdb.Key, err error) {
+func (t *tx64) vacuumPart(
+	w db.Writer,
+	lg fdb.RangeResult,
+	stop fdb.Key,
+	opts *options,
+) (last fdb.Key, rep VacuumReport, err error) {
 	var ok bool
 
 	lc := makeCache()
-	rows := 0
+	size := 0
 	iter := lg.Iterator()
 	opid := atomic.AddUint32(&t.opid, 1)
 	wctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -1148,36 +1685,46 @@ func (t *tx64) vacuumPart(w db.Writer, lg fdb.RangeResult, onVacuum RowHandler)
 	for iter.Advance() {
 		item := iter.MustGet()
 		item.Key = item.Key[1:]
+
+		// Дальше начинается чужой диапазон - условие выхода
+		if stop != nil && bytes.Compare(item.Key, stop) >= 0 {
+			return nil, rep, nil
+		}
+
 		last = item.Key
-		rows++
+		size += len(item.Key) + len(item.Value)
+		rep.Rows++
 
 		if ok, err = t.isVisible(w.Reader, lc, opid, item, true); err != nil {
 			// Ошибку игнорим, потому что это вакуум, важно не удалить лишнего
+			err = nil
 			continue
 		}
 
 		if !ok {
-			if onVacuum != nil {
-				if err = onVacuum(t, w, usrPair(item)); err != nil {
+			if opts.onVacuum != nil {
+				if err = opts.onVacuum(t, w, usrPair(item)); err != nil {
 					return
 				}
 			}
 
 			w.Delete(item.Key)
+			rep.Removed++
 		}
 
-		if wctx.Err() != nil {
-			return
+		// Ограничение по времени и объему физической транзакции
+		if wctx.Err() != nil || (opts.vsize > 0 && size >= opts.vsize) {
+			return last, rep, nil
 		}
 	}
 
 	// Больше нечего получить - условие выхода
-	if rows == 0 {
-		return nil, nil
+	if rep.Rows == 0 {
+		return nil, rep, nil
 	}
 
 	// Возвращаем последний проверенный ключ, с которого надо начать след. цикл
-	return last, nil
+	return last, rep, nil
 }
 
 func (t *tx64) checkLock(keys []fdb.Key) (exist bool, err error) {
@@ -1231,8 +1778,13 @@ func (t *tx64) updateLocks() {
 					t.exit()
 					return nil
 				}
+				// Принудительно отмененная транзакция больше не держит блокировки
+				if t.isKilled(w.Reader) {
+					t.exit()
+					return t.onRelease(w)
+				}
 				for _, key := range t.locks {
-					w.Upsert(fdb.KeyValue{Key: key, Value: fdbx.Time2Byte(time.Now())})
+					w.Upsert(fdb.KeyValue{Key: key, Value: t.lockValue()})
 				}
 				return nil
 			}); err != nil {
@@ -1246,7 +1798,16 @@ func (t *tx64) updateLocks() {
 }
 
 func (t *tx64) onRelease(w db.Writer) error {
-	for _, lk := range t.locks {
+	vals := make(map[string]fdb.FutureByteSlice, len(t.locks))
+	for skey, lk := range t.locks {
+		vals[skey] = w.Item(lk)
+	}
+
+	for skey, lk := range t.locks {
+		// Блокировку мог уже забрать кто-то другой, например после принудительной отмены
+		if val := vals[skey].MustGet(); len(val) > 8 && !bytes.Equal(val[8:], t.txid[:]) {
+			continue
+		}
 		w.Delete(lk)
 	}
 	return nil
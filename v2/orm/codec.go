@@ -0,0 +1,102 @@
+package orm
+
+import (
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/shestakovda/fdbx/v2"
+)
+
+// Codec - преобразование значений типизированной коллекции в байты и обратно
+type Codec[V any] interface {
+	Encode(V) ([]byte, error)
+	Decode([]byte) (V, error)
+}
+
+// NewJSONCodec - кодек значений в формате JSON
+func NewJSONCodec[V any]() Codec[V] { return jsonCodec[V]{} }
+
+// NewFlatCodec - кодек объектов FlatBuffers, сгенерированных с --gen-object-api
+//
+// Для распаковки нужна функция вида func(buf []byte) *models.TaskT { return models.GetRootAsTask(buf, 0).UnPack() }
+func NewFlatCodec[V fdbx.FlatPacker](unpack func([]byte) V) Codec[V] { return flatCodec[V]{unpack: unpack} }
+
+// NewProtoCodec - кодек сообщений protobuf, указывается тип сообщения: NewProtoCodec[pb.User]()
+func NewProtoCodec[T any, V interface {
+	*T
+	proto.Message
+}]() Codec[V] {
+	return protoCodec[T, V]{}
+}
+
+// IndexOf - индекс по значению типизированной коллекции
+func IndexOf[V any](c Codec[V], id uint16, f func(V) (fdb.Key, error)) Option {
+	return Index(id, func(buf []byte) (_ fdb.Key, err error) {
+		var val V
+
+		if val, err = c.Decode(buf); err != nil {
+			return nil, ErrValUnpack.WithReason(err)
+		}
+
+		return f(val)
+	})
+}
+
+// MultiIndexOf - индекс по значению типизированной коллекции, с несколькими ключами на значение
+func MultiIndexOf[V any](c Codec[V], id uint16, f func(V) ([]fdb.Key, error)) Option {
+	return MultiIndex(id, func(buf []byte) (_ []fdb.Key, err error) {
+		var val V
+
+		if val, err = c.Decode(buf); err != nil {
+			return nil, ErrValUnpack.WithReason(err)
+		}
+
+		return f(val)
+	})
+}
+
+type jsonCodec[V any] struct{}
+
+func (jsonCodec[V]) Encode(val V) ([]byte, error) { return json.Marshal(val) }
+
+func (jsonCodec[V]) Decode(buf []byte) (val V, err error) {
+	err = json.Unmarshal(buf, &val)
+	return val, err
+}
+
+type flatCodec[V fdbx.FlatPacker] struct {
+	unpack func([]byte) V
+}
+
+func (c flatCodec[V]) Encode(val V) ([]byte, error) { return fdbx.FlatPack(val), nil }
+
+func (c flatCodec[V]) Decode(buf []byte) (_ V, err error) {
+	// Сгенерированный код не проверяет буфер, поэтому битые данные приводят к панике
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = ErrValUnpack.WithDebug(errx.Debug{"panic": rec})
+		}
+	}()
+
+	return c.unpack(buf), nil
+}
+
+type protoCodec[T any, V interface {
+	*T
+	proto.Message
+}] struct{}
+
+func (protoCodec[T, V]) Encode(val V) ([]byte, error) { return proto.Marshal(val) }
+
+func (protoCodec[T, V]) Decode(buf []byte) (V, error) {
+	val := V(new(T))
+
+	if err := proto.Unmarshal(buf, val); err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
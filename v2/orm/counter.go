@@ -0,0 +1,160 @@
+package orm
+
+import (
+	"encoding/binary"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	Count - кол-во строк коллекции по счетчику, без обхода строк. Счетчик ведется с опцией Counters.
+
+	Счетчики изменяются при коммите транзакций, поэтому учитывают все завершенные транзакции,
+	но не изменения текущей. Если коллекция уже была заполнена до включения счетчиков, их надо пересчитать
+	миграцией, иначе строки, вставленные до этого, учтены не будут.
+*/
+func (t *v1Table) Count(tx mvcc.Tx) (res uint64, err error) {
+	if !t.options.counters {
+		return 0, ErrCount.WithReason(ErrNoCounter.WithDebug(errx.Debug{"table": t.id}))
+	}
+
+	skey := t.counterKey(cTable, nil)
+
+	if err = tx.Conn().Read(func(r db.Reader) error {
+		res = counterValue(r.Data(skey))
+		return nil
+	}); err != nil {
+		return 0, ErrCount.WithReason(err)
+	}
+
+	return res, nil
+}
+
+// IndexCount - кол-во строк со значениями индекса в диапазоне, по счетчикам значений. Счетчики ведутся с опцией Counters
+func (t *v1Table) IndexCount(tx mvcc.Tx, idx uint16, from, last fdb.Key) (res uint64, err error) {
+	if _, ok := t.options.counted[idx]; !ok {
+		return 0, ErrCount.WithReason(ErrNoCounter.WithDebug(errx.Debug{"table": t.id, "index": idx}))
+	}
+
+	fkey := t.counterKey(cIndex, fdbx.AppendLeft(from, byte(idx>>8), byte(idx)))
+	lkey := t.counterKey(cIndex, fdbx.AppendLeft(last, byte(idx>>8), byte(idx)))
+
+	if err = tx.Conn().Read(func(r db.Reader) error {
+		rows := r.List(fkey, lkey, 0, false, false).GetSliceOrPanic()
+
+		for i := range rows {
+			res += counterValue(rows[i].Value)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, ErrCount.WithReason(err)
+	}
+
+	return res, nil
+}
+
+/*
+	count - изменение счетчиков по изменениям строк операции.
+
+	Счетчики изменяются при коммите транзакции, чтобы другие транзакции видели их только после него.
+	Изменение строки без смены ключей индексов счетчики не меняет.
+*/
+func (t *v1Table) count(tx mvcc.Tx, list []RowChange) (err error) {
+	var rows int64
+
+	if !t.options.counters || len(list) == 0 {
+		return nil
+	}
+
+	delta := make(map[string]int64, 8)
+
+	for i := range list {
+		switch list[i].Kind {
+		case ChangeInsert:
+			rows++
+		case ChangeDelete:
+			rows--
+		}
+
+		if len(t.options.counted) == 0 {
+			continue
+		}
+
+		if list[i].Kind != ChangeInsert {
+			if err = t.countKeys(delta, -1, fdb.KeyValue{Key: list[i].Key, Value: list[i].Old}); err != nil {
+				return ErrCount.WithReason(err)
+			}
+		}
+
+		if list[i].Kind != ChangeDelete {
+			if err = t.countKeys(delta, 1, fdb.KeyValue{Key: list[i].Key, Value: list[i].New}); err != nil {
+				return ErrCount.WithReason(err)
+			}
+		}
+	}
+
+	for skey := range delta {
+		if delta[skey] == 0 {
+			delete(delta, skey)
+		}
+	}
+
+	if rows == 0 && len(delta) == 0 {
+		return nil
+	}
+
+	tx.OnCommit(func(w db.Writer) error {
+		if rows != 0 {
+			w.Increment(t.counterKey(cTable, nil), rows)
+		}
+
+		for skey := range delta {
+			w.Increment(fdb.Key(skey), delta[skey])
+		}
+
+		return nil
+	})
+
+	return nil
+}
+
+// countKeys - изменение счетчиков значений индексов строки, для которых они ведутся
+func (t *v1Table) countKeys(delta map[string]int64, sign int64, usr fdb.KeyValue) (err error) {
+	var dict map[uint16][]fdb.Key
+
+	if dict, err = t.rowIndexKeys(usr); err != nil {
+		return
+	}
+
+	for idx := range t.options.counted {
+		for _, key := range dict[idx] {
+			delta[string(t.counterKey(cIndex, fdbx.AppendLeft(key, byte(idx>>8), byte(idx))))] += sign
+		}
+	}
+
+	return nil
+}
+
+// counterKey - служебный ключ счетчика, вне пространства версий строк
+func (t *v1Table) counterKey(kind byte, key fdb.Key) fdb.Key {
+	return mvcc.WrapKey(fdbx.AppendLeft(key, byte(t.id>>8), byte(t.id), nsCount, kind))
+}
+
+// counterValue - значение счетчика после атомарных прибавлений, отрицательным оно быть не должно
+func counterValue(val []byte) uint64 {
+	if len(val) < 8 {
+		return 0
+	}
+
+	if num := int64(binary.LittleEndian.Uint64(val)); num > 0 {
+		return uint64(num)
+	}
+
+	return 0
+}
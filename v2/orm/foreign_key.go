@@ -0,0 +1,154 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// foreignKey - ссылка ключей индекса на строки родительской коллекции
+type foreignKey struct {
+	parent Table
+	policy byte
+	reset  UpdateHandler
+}
+
+// tableRef - ссылка на строки коллекции из индекса дочерней коллекции
+type tableRef struct {
+	foreignKey
+	child *v1Table
+	idx   uint16
+}
+
+func (t *v1Table) reference(ref tableRef) {
+	t.rmux.Lock()
+	defer t.rmux.Unlock()
+	t.refs = append(t.refs, ref)
+}
+
+func (t *v1Table) references() []tableRef {
+	t.rmux.RLock()
+	defer t.rmux.RUnlock()
+	return t.refs
+}
+
+/*
+	checkForeign - проверка, что строка родительской коллекции существует.
+
+	Строка читается в той же физической транзакции, что и вставка, с блокировкой ключа,
+	поэтому параллельное удаление родительской строки приведет к конфликту и повтору.
+	Если родительскую строку изменяет или удаляет еще не завершенная транзакция, возвращается mvcc.ErrConflict.
+*/
+func (t *v1Table) checkForeign(tx mvcc.Tx, w db.Writer, idx uint16, key fdb.Key) (err error) {
+	fk := t.options.foreign[idx]
+
+	if _, err = tx.Select(WrapTableKey(fk.parent.ID(), key), mvcc.Conflict(), mvcc.Writer(w)); err != nil {
+		if errx.Is(err, mvcc.ErrNotFound) {
+			return ErrForeignKey.WithDetail("Referenced row not found").WithDebug(errx.Debug{
+				"index":  idx,
+				"parent": fk.parent.ID(),
+				"key":    key,
+			})
+		}
+
+		return ErrForeignKey.WithReason(err)
+	}
+
+	return nil
+}
+
+// onDrop - удаление строки: сначала действия со ссылающимися на нее строками, затем очистка индексов
+func (t *v1Table) onDrop(tx mvcc.Tx, w db.Writer, pair fdb.KeyValue) (err error) {
+	pkey := UnwrapTableKey(pair.Key)
+
+	for _, ref := range t.references() {
+		if err = ref.apply(tx, pkey); err != nil {
+			return
+		}
+	}
+
+	return t.onDelete(tx, w, pair)
+}
+
+// apply - действие со строками дочерней коллекции при удалении строки, на которую они ссылаются
+func (r tableRef) apply(tx mvcc.Tx, pkey fdb.Key) (err error) {
+	var list []fdb.KeyValue
+
+	if list, err = r.child.referencing(tx, r.idx, pkey); err != nil || len(list) == 0 {
+		return
+	}
+
+	dbg := errx.Debug{"table": r.child.id, "index": r.idx, "key": pkey, "rows": len(list)}
+
+	switch r.policy {
+	case RefCascade:
+		keys := make([]fdb.Key, len(list))
+
+		for i := range list {
+			keys[i] = list[i].Key
+		}
+
+		if err = r.child.Delete(tx, keys...); err != nil {
+			return ErrForeignKey.WithReason(err).WithDebug(dbg)
+		}
+	case RefSetNull:
+		if r.reset == nil {
+			return ErrForeignKey.WithDetail("Reset handler is required").WithDebug(dbg)
+		}
+
+		for i := range list {
+			if err = r.child.Update(tx, list[i].Key, r.reset); err != nil {
+				return ErrForeignKey.WithReason(err).WithDebug(dbg)
+			}
+		}
+	default:
+		return ErrForeignKey.WithDetail("Row is referenced").WithDebug(dbg)
+	}
+
+	return nil
+}
+
+/*
+	referencing - строки коллекции, у которых ключ индекса в точности равен ключу родительской строки.
+
+	Ссылки, которые добавляет или удаляет еще не завершенная транзакция, в выборку не попадут,
+	поэтому для них возвращается mvcc.ErrConflict. Проверка идет по префиксу ключа индекса,
+	так что конфликт может дать и ссылка на другую строку с тем же префиксом ключа.
+*/
+func (t *v1Table) referencing(tx mvcc.Tx, idx uint16, pkey fdb.Key) (res []fdb.KeyValue, err error) {
+	var list []fdb.KeyValue
+	var dict map[uint16][]fdb.Key
+
+	ikey := WrapIndexKey(t.id, idx, pkey)
+
+	if _, err = tx.ListAll(context.Background(), mvcc.From(ikey), mvcc.Last(ikey), mvcc.Conflict()); err != nil {
+		return nil, ErrForeignKey.WithReason(err)
+	}
+
+	// Выборка по индексу идет по префиксу, поэтому лишние строки отсеиваем по их ключам индекса
+	if list, err = t.Select(tx).ByIndex(idx, pkey).All(); err != nil {
+		return nil, ErrForeignKey.WithReason(err)
+	}
+
+	res = list[:0]
+
+	for i := range list {
+		if dict, err = t.rowIndexKeys(list[i]); err != nil {
+			return nil, ErrForeignKey.WithReason(err)
+		}
+
+		for _, key := range dict[idx] {
+			if bytes.Equal(key, pkey) {
+				res = append(res, list[i])
+				break
+			}
+		}
+	}
+
+	return res, nil
+}
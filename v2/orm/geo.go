@@ -0,0 +1,220 @@
+package orm
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+)
+
+// Средний радиус Земли в метрах, для расстояний между точками
+const geoRadius = 6371008.8
+
+// Наибольшее кол-во ячеек, которыми покрывается область запроса. Чем их больше, тем меньше лишних строк в выборке
+const geoCells = 16
+
+/*
+	GeoKey - ключ геоиндекса точки: широта и долгота квантуются до 32 бит (около сантиметра)
+	и перемежаются по битам, поэтому у близких точек обычно общий префикс ключа.
+*/
+func GeoKey(p GeoPoint) (fdb.Key, error) {
+	if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 || math.IsNaN(p.Lat) || math.IsNaN(p.Lon) {
+		return nil, ErrValPack.WithDetail("Invalid geo point").WithDebug(errx.Debug{"lat": p.Lat, "lon": p.Lon})
+	}
+
+	return geoBytes(geoCode(geoQuant(p.Lon, 360), geoQuant(p.Lat, 180))), nil
+}
+
+// GeoDistance - расстояние между точками по поверхности Земли в метрах
+func GeoDistance(a, b GeoPoint) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dlat := lat2 - lat1
+	dlon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * geoRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geoQuant - квантование координаты в отрезке ширины span с центром в нуле
+func geoQuant(val, span float64) uint32 {
+	return uint32(math.Min((val+span/2)/span*(1<<32), math.MaxUint32))
+}
+
+// geoPoint - точка по ключу геоиндекса, с точностью квантования
+func geoPoint(code uint64) GeoPoint {
+	x, y := geoSplit(code)
+
+	return GeoPoint{
+		Lat: (float64(y)+0.5)/(1<<32)*180 - 90,
+		Lon: (float64(x)+0.5)/(1<<32)*360 - 180,
+	}
+}
+
+// geoCode - перемежение битов долготы и широты, старший бит - долготы
+func geoCode(x, y uint32) uint64 {
+	return geoSpread(x)<<1 | geoSpread(y)
+}
+
+func geoSplit(code uint64) (x, y uint32) {
+	return geoSqueeze(code >> 1), geoSqueeze(code)
+}
+
+func geoSpread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000FFFF0000FFFF
+	x = (x | x<<8) & 0x00FF00FF00FF00FF
+	x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+func geoSqueeze(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x>>4) & 0x00FF00FF00FF00FF
+	x = (x | x>>8) & 0x0000FFFF0000FFFF
+	x = (x | x>>16) & 0x00000000FFFFFFFF
+	return uint32(x)
+}
+
+func geoBytes(code uint64) fdb.Key {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], code)
+	return buf[:]
+}
+
+// geoBox - прямоугольник квантованных координат, границы включаются
+type geoBox struct {
+	minX, maxX uint32
+	minY, maxY uint32
+}
+
+func (b geoBox) has(x, y uint32) bool {
+	return x >= b.minX && x <= b.maxX && y >= b.minY && y <= b.maxY
+}
+
+// geoBoxes - прямоугольники области. Если область пересекает 180-й меридиан, она делится на две
+func geoBoxes(min, max GeoPoint) []geoBox {
+	minY := geoQuant(math.Max(min.Lat, -90), 180)
+	maxY := geoQuant(math.Min(max.Lat, 90), 180)
+
+	if min.Lon <= max.Lon {
+		return []geoBox{{geoQuant(math.Max(min.Lon, -180), 360), geoQuant(math.Min(max.Lon, 180), 360), minY, maxY}}
+	}
+
+	return []geoBox{
+		{geoQuant(math.Max(min.Lon, -180), 360), math.MaxUint32, minY, maxY},
+		{0, geoQuant(math.Min(max.Lon, 180), 360), minY, maxY},
+	}
+}
+
+// geoCircle - прямоугольники, описанные вокруг круга радиуса r метров
+func geoCircle(c GeoPoint, r float64) []geoBox {
+	dist := r / geoRadius
+	dlat := dist * 180 / math.Pi
+
+	// Круг захватывает полюс или всю Землю - по долготе берем все
+	if dist >= math.Pi || c.Lat+dlat >= 90 || c.Lat-dlat <= -90 {
+		return geoBoxes(GeoPoint{Lat: c.Lat - dlat, Lon: -180}, GeoPoint{Lat: c.Lat + dlat, Lon: 180})
+	}
+
+	dlon := math.Asin(math.Min(1, math.Sin(dist)/math.Cos(c.Lat*math.Pi/180))) * 180 / math.Pi
+
+	if dlon >= 180 {
+		return geoBoxes(GeoPoint{Lat: c.Lat - dlat, Lon: -180}, GeoPoint{Lat: c.Lat + dlat, Lon: 180})
+	}
+
+	min := GeoPoint{Lat: c.Lat - dlat, Lon: geoWrap(c.Lon - dlon)}
+	max := GeoPoint{Lat: c.Lat + dlat, Lon: geoWrap(c.Lon + dlon)}
+	return geoBoxes(min, max)
+}
+
+func geoWrap(lon float64) float64 {
+	if lon < -180 {
+		return lon + 360
+	}
+
+	if lon > 180 {
+		return lon - 360
+	}
+
+	return lon
+}
+
+// geoRange - диапазон ключей геоиндекса, границы включаются
+type geoRange struct {
+	from, last uint64
+}
+
+/*
+	geoCover - диапазоны ключей ячеек, покрывающих прямоугольники, по возрастанию.
+
+	Для каждого прямоугольника выбирается самый мелкий уровень ячеек, на котором их не больше geoCells.
+	Ключи всех точек ячейки уровня L начинаются с одних и тех же 2L бит, поэтому ячейка - это один диапазон ключей.
+*/
+func geoCover(boxes []geoBox) []geoRange {
+	res := make([]geoRange, 0, geoCells*len(boxes))
+
+	for _, box := range boxes {
+		level := uint(32)
+
+		for ; level > 1; level-- {
+			nx := uint64(box.maxX>>(32-level)) - uint64(box.minX>>(32-level)) + 1
+			ny := uint64(box.maxY>>(32-level)) - uint64(box.minY>>(32-level)) + 1
+
+			if nx*ny <= geoCells {
+				break
+			}
+		}
+
+		tail := 64 - 2*level
+
+		for cx := box.minX >> (32 - level); cx <= box.maxX>>(32-level); cx++ {
+			for cy := box.minY >> (32 - level); cy <= box.maxY>>(32-level); cy++ {
+				from := geoCode(cx, cy) << tail
+				res = append(res, geoRange{from: from, last: from | (1<<tail - 1)})
+
+				// Ячейки на краю диапазона координат, дальше счетчик переполнится
+				if cy == math.MaxUint32>>(32-level) {
+					break
+				}
+			}
+
+			if cx == math.MaxUint32>>(32-level) {
+				break
+			}
+		}
+	}
+
+	return geoMerge(res)
+}
+
+// geoMerge - сортировка и объединение пересекающихся и соседних диапазонов
+func geoMerge(list []geoRange) []geoRange {
+	if len(list) == 0 {
+		return list
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].from < list[j].from })
+	res := list[:1]
+
+	for _, rng := range list[1:] {
+		cur := &res[len(res)-1]
+
+		if rng.from <= cur.last || rng.from == cur.last+1 {
+			if rng.last > cur.last {
+				cur.last = rng.last
+			}
+			continue
+		}
+
+		res = append(res, rng)
+	}
+
+	return res
+}
@@ -1,15 +1,25 @@
 package orm
 
 import (
+	"time"
+
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 )
 
 const (
-	nsData  byte = 0
-	nsBLOB  byte = 1
-	nsIndex byte = 2
-	nsQueue byte = 3
-	nsQuery byte = 5
+	nsData    byte = 0
+	nsBLOB    byte = 1
+	nsIndex   byte = 2
+	nsQueue   byte = 3
+	nsQuery   byte = 5
+	nsVacuum  byte = 6
+	nsRebuild byte = 7
+	nsMigrate byte = 8
+	nsCount   byte = 9
+	nsView    byte = 10
+	nsVector  byte = 11
+	nsProject byte = 12
+	nsState   byte = 13
 )
 
 const (
@@ -19,6 +29,61 @@ const (
 	qMeta byte = 3
 )
 
+const (
+	vMark  byte = 0
+	vLease byte = 1
+	vDone  byte = 2
+)
+
+const (
+	sTable byte = 1
+	sIndex byte = 2
+	sQueue byte = 3
+)
+
+const (
+	mLease byte = 0
+	mDone  byte = 1
+	mMark  byte = 2
+)
+
+// Служебные ключи пересчета материализованных представлений и индексов векторов
+const (
+	gLease byte = 0
+	gGen   byte = 1
+)
+
+const (
+	cTable byte = 0
+	cIndex byte = 1
+)
+
+// Признаки отпечатка определения индекса в реестре схемы
+const (
+	dIndex   uint32 = 1 << 0
+	dMulti   uint32 = 1 << 1
+	dBatch   uint32 = 1 << 2
+	dText    uint32 = 1 << 3
+	dUnique  uint32 = 1 << 4
+	dPartial uint32 = 1 << 5
+	dProject uint32 = 1 << 6
+)
+
+// Размер пачки удаления строк при логической очистке коллекции
+const truncateBatch = 1000
+
+// Размер пачки групп при выборке и перестроении материализованного представления
+const viewBatch = 1000
+
+// Интервал проверки завершения транзакций, начатых до аренды пересчета
+const rebuildWait = 100 * time.Millisecond
+
+// Размер пачки строк при перестроении индекса векторов
+const vectorBatch = 1000
+
+// Кол-во итераций k-means при разбиении векторов на списки
+const vectorIters = 10
+
 // Ограничение в 100Кб, но берем небольшой запас на накладные расходы
 var loLimit = 90000
 
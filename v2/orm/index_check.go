@@ -0,0 +1,539 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	CheckIndexes - проверка соответствия всех индексов коллекции ее строкам.
+
+	Сначала проходит все строки коллекции и ищет ожидаемые, но отсутствующие ключи индексов,
+	затем проходит все индексы, найденные в БД, и ищет висячие ключи: без строки коллекции
+	или такие, которые строка больше не порождает. Каждое расхождение передается в обработчик OnIndexIssue,
+	а в отчете считается по индексам.
+
+	С опцией RepairIndexes расхождения исправляются: недостающие ключи добавляются, висячие удаляются.
+	Занятые другой строкой ключи уникального индекса не исправляются, это нужно решать вручную.
+	Проверка не сохраняет прогресс, а на коллекции под нагрузкой может найти расхождения
+	от еще не завершенных транзакций, поэтому исправлять лучше без нагрузки или через RebuildIndex.
+
+	Поддерживает опции RebuildBatch, RepairIndexes и OnIndexIssue.
+*/
+func (t *v1Table) CheckIndexes(ctx context.Context, cn db.Connection, args ...Option) (rep CheckReport, err error) {
+	var ids []uint16
+
+	start := time.Now()
+	opts := getOpts(args)
+	rep.Indexes = make(map[uint16]IndexCheck, 8)
+
+	if opts.rbatch < 2 {
+		opts.rbatch = rebuildBatch
+	}
+
+	defer func() { rep.Duration = time.Since(start) }()
+
+	// У каждой строки коллекции должны быть все ее ключи индексов
+	if err = t.checkScan(ctx, cn, WrapTableKey(t.id, nil), opts, &rep, &rep.Rows, t.checkRows); err != nil {
+		return rep, ErrCheckIndex.WithReason(err)
+	}
+
+	if ids, err = t.indexIDs(cn, nsIndex); err != nil {
+		return rep, ErrCheckIndex.WithReason(err)
+	}
+
+	// Каждый ключ индекса должен порождаться своей строкой коллекции
+	for i := range ids {
+		idx := ids[i]
+		hdlr := func(tx mvcc.Tx, w db.Writer, list []fdb.KeyValue, repair bool) ([]IndexIssue, error) {
+			return t.checkEntries(tx, w, idx, list, repair)
+		}
+
+		if err = t.checkScan(ctx, cn, WrapIndexKey(t.id, idx, nil), opts, &rep, &rep.Entries, hdlr); err != nil {
+			return rep, ErrCheckIndex.WithReason(err).WithDebug(errx.Debug{"idx": idx})
+		}
+	}
+
+	if ids, err = t.indexIDs(cn, nsProject); err != nil {
+		return rep, ErrCheckIndex.WithReason(err)
+	}
+
+	// Каждой проекции покрывающего индекса должен соответствовать ключ индекса
+	for i := range ids {
+		idx := ids[i]
+		hdlr := func(tx mvcc.Tx, w db.Writer, list []fdb.KeyValue, repair bool) ([]IndexIssue, error) {
+			return t.checkProjects(tx, w, idx, list, repair)
+		}
+
+		if err = t.checkScan(ctx, cn, projectKey(WrapIndexKey(t.id, idx, nil)), opts, &rep, &rep.Entries, hdlr); err != nil {
+			return rep, ErrCheckIndex.WithReason(err).WithDebug(errx.Debug{"idx": idx})
+		}
+	}
+
+	return rep, nil
+}
+
+// checkScan - проверка всех строк по префиксу, каждая пачка в отдельной логической транзакции
+func (t *v1Table) checkScan(
+	ctx context.Context,
+	cn db.Connection,
+	prefix fdb.Key,
+	opts options,
+	rep *CheckReport,
+	rows *uint64,
+	batch func(mvcc.Tx, db.Writer, []fdb.KeyValue, bool) ([]IndexIssue, error),
+) (err error) {
+	var tx mvcc.Tx
+	var list []fdb.KeyValue
+	var issues []IndexIssue
+
+	from := prefix
+
+	for done := false; !done; {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		if opts.repair {
+			tx = mvcc.Begin(cn)
+		} else {
+			tx = mvcc.BeginReadOnly(cn)
+		}
+
+		if err = cn.Write(func(w db.Writer) (exp error) {
+			if list, done, exp = t.rebuildList(tx, w, prefix, from, opts.rbatch); exp != nil {
+				return
+			}
+
+			issues, exp = batch(tx, w, list, opts.repair)
+			return exp
+		}); err != nil {
+			tx.Cancel()
+			return
+		}
+
+		if opts.repair {
+			if err = tx.Commit(); err != nil {
+				return
+			}
+		} else {
+			tx.Cancel()
+		}
+
+		*rows += uint64(len(list))
+
+		if len(list) > 0 {
+			from = list[len(list)-1].Key
+		}
+
+		for i := range issues {
+			rep.add(issues[i], opts.repair)
+
+			if opts.onIssue != nil {
+				opts.onIssue(issues[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRows - поиск недостающих ключей индексов для пачки строк коллекции
+func (t *v1Table) checkRows(tx mvcc.Tx, w db.Writer, list []fdb.KeyValue, repair bool) (res []IndexIssue, err error) {
+	var miss []indexEntry
+
+	if _, miss, err = t.missingEntries(tx, w, list, nil); err != nil {
+		return
+	}
+
+	res = make([]IndexIssue, len(miss))
+	rows := make([]fdb.KeyValue, 0, len(miss))
+
+	for i := range miss {
+		res[i] = IndexIssue{
+			Index: miss[i].idx,
+			Kind:  miss[i].kind,
+			Key:   UnwrapIndexKey(miss[i].row.Key),
+			ID:    miss[i].id,
+		}
+
+		if miss[i].kind == IssueConflict {
+			continue
+		}
+
+		rows = append(rows, miss[i].row)
+	}
+
+	if !repair || len(rows) == 0 {
+		return res, nil
+	}
+
+	if err = tx.Upsert(rows, mvcc.Writer(w)); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// checkEntries - поиск висячих ключей индекса в пачке
+func (t *v1Table) checkEntries(tx mvcc.Tx, w db.Writer, idx uint16, list []fdb.KeyValue, repair bool) (res []IndexIssue, err error) {
+	var drop []fdb.KeyValue
+
+	if _, drop, err = t.danglingEntries(tx, w, idx, list); err != nil {
+		return
+	}
+
+	res = make([]IndexIssue, len(drop))
+	keys := make([]fdb.Key, len(drop))
+
+	for i := range drop {
+		keys[i] = drop[i].Key
+		res[i] = IndexIssue{
+			Index: idx,
+			Kind:  IssueDangling,
+			Key:   UnwrapIndexKey(drop[i].Key),
+			ID:    drop[i].Value,
+		}
+	}
+
+	if !repair || len(keys) == 0 {
+		return res, nil
+	}
+
+	if err = tx.Delete(keys, mvcc.Writer(w)); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// checkProjects - поиск висячих проекций покрывающего индекса в пачке
+func (t *v1Table) checkProjects(tx mvcc.Tx, w db.Writer, idx uint16, list []fdb.KeyValue, repair bool) (res []IndexIssue, err error) {
+	var drop []fdb.KeyValue
+
+	if _, drop, err = t.danglingProjects(tx, w, idx, list); err != nil {
+		return
+	}
+
+	res = make([]IndexIssue, len(drop))
+	keys := make([]fdb.Key, len(drop))
+
+	for i := range drop {
+		keys[i] = drop[i].Key
+		res[i] = IndexIssue{
+			Index: idx,
+			Kind:  IssueDangling,
+			Key:   UnwrapIndexKey(drop[i].Key),
+		}
+	}
+
+	if !repair || len(keys) == 0 {
+		return res, nil
+	}
+
+	if err = tx.Delete(keys, mvcc.Writer(w)); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// indexEntry - ожидаемая строка индекса или проекции, которой нет или которая отличается от сохраненной
+type indexEntry struct {
+	idx  uint16
+	kind byte
+	row  fdb.KeyValue
+	id   fdb.Key
+	proj bool
+}
+
+/*
+	missingEntries - ожидаемые строки индексов для пачки строк коллекции, которые отсутствуют или отличаются.
+
+	У покрывающего индекса вместе с каждой строкой индекса проверяется и ее проекция.
+	Если задан фильтр only, проверяются только подходящие под него индексы.
+	Возвращает ключ последней строки пачки, чтобы с него продолжить.
+*/
+func (t *v1Table) missingEntries(
+	tx mvcc.Tx,
+	w db.Writer,
+	list []fdb.KeyValue,
+	only func(uint16) bool,
+) (next fdb.Key, res []indexEntry, err error) {
+	var dict map[uint16][]fdb.Key
+	var have map[string]fdb.KeyValue
+
+	ents := make([]indexEntry, 0, len(list))
+	keys := make([]fdb.Key, 0, len(list))
+	seen := make(map[string]struct{}, len(list))
+
+	for i := range list {
+		var usr fdb.KeyValue
+
+		if usr, err = newUsrPair(tx, t.id, list[i]); err != nil {
+			return
+		}
+
+		if dict, err = t.rowIndexKeys(usr); err != nil {
+			return
+		}
+
+		for idx, ikeys := range dict {
+			if only != nil && !only(idx) {
+				continue
+			}
+
+			for j := range ikeys {
+				ent := indexEntry{idx: idx, kind: IssueMissing, id: usr.Key}
+				ent.row = fdb.KeyValue{Key: t.indexKey(idx, ikeys[j], usr.Key), Value: usr.Key}
+
+				if _, ok := seen[ent.row.Key.String()]; ok {
+					continue
+				}
+
+				seen[ent.row.Key.String()] = struct{}{}
+				keys = append(keys, ent.row.Key)
+				ents = append(ents, ent)
+
+				// Проекция идет сразу за своей строкой индекса
+				if _, ok := t.options.project[idx]; ok {
+					proj := indexEntry{idx: idx, kind: IssueStale, id: usr.Key, proj: true}
+
+					if proj.row, err = t.projectRow(idx, ent.row.Key, usr.Value); err != nil {
+						return
+					}
+
+					keys = append(keys, proj.row.Key)
+					ents = append(ents, proj)
+				}
+			}
+		}
+
+		next = usr.Key
+	}
+
+	if len(ents) == 0 {
+		return next, nil, nil
+	}
+
+	// Существующие ключи не трогаем, чтобы не плодить лишние версии
+	if have, err = tx.SelectMany(keys, mvcc.Writer(w)); err != nil {
+		return
+	}
+
+	for i := 0; i < len(ents); i++ {
+		row, ok := have[ents[i].row.Key.String()]
+
+		// Проекции нет или она устарела, например после изменения ее функции
+		if ents[i].proj {
+			if !ok || !bytes.Equal(row.Value, ents[i].row.Value) {
+				res = append(res, ents[i])
+			}
+			continue
+		}
+
+		if !ok {
+			res = append(res, ents[i])
+			continue
+		}
+
+		// Ключ уникального индекса уже занят другой строкой, его проекция тоже принадлежит ей
+		if !bytes.Equal(row.Value, ents[i].row.Value) {
+			ents[i].id = row.Value
+			ents[i].kind = IssueConflict
+			res = append(res, ents[i])
+
+			if i+1 < len(ents) && ents[i+1].proj {
+				i++
+			}
+		}
+	}
+
+	return next, res, nil
+}
+
+/*
+	danglingEntries - строки индекса из пачки, которые их строки коллекции больше не порождают.
+
+	Если строку изменят параллельно, ее транзакция сама обновит ключи индекса поверх удаленных по этому списку.
+	Возвращает ключ индекса последней строки пачки, чтобы с него продолжить.
+*/
+func (t *v1Table) danglingEntries(tx mvcc.Tx, w db.Writer, idx uint16, list []fdb.KeyValue) (next fdb.Key, res []fdb.KeyValue, err error) {
+	var dict map[uint16][]fdb.Key
+	var rows map[string]fdb.KeyValue
+
+	if len(list) == 0 {
+		return nil, nil, nil
+	}
+
+	keys := make([]fdb.Key, len(list))
+
+	for i := range list {
+		keys[i] = WrapTableKey(t.id, list[i].Value)
+	}
+
+	if rows, err = tx.SelectMany(keys, mvcc.Writer(w)); err != nil {
+		return
+	}
+
+	want := make(map[string]struct{}, len(list))
+
+	for i := range list {
+		next = UnwrapIndexKey(list[i].Key)
+		row, ok := rows[keys[i].String()]
+
+		if ok {
+			var usr fdb.KeyValue
+
+			if usr, err = newUsrPair(tx, t.id, row); err != nil {
+				return
+			}
+
+			if dict, err = t.rowIndexKeys(usr); err != nil {
+				return
+			}
+
+			for _, ikey := range dict[idx] {
+				want[t.indexKey(idx, ikey, usr.Key).String()] = struct{}{}
+			}
+		}
+
+		if _, ok = want[list[i].Key.String()]; !ok {
+			res = append(res, list[i])
+		}
+	}
+
+	return next, res, nil
+}
+
+/*
+	danglingProjects - строки проекций из пачки, у которых нет своей строки индекса, либо у индекса больше нет проекции.
+
+	Возвращает ключ проекции последней строки пачки, чтобы с него продолжить.
+*/
+func (t *v1Table) danglingProjects(tx mvcc.Tx, w db.Writer, idx uint16, list []fdb.KeyValue) (next fdb.Key, res []fdb.KeyValue, err error) {
+	var rows map[string]fdb.KeyValue
+
+	if len(list) == 0 {
+		return nil, nil, nil
+	}
+
+	next = UnwrapIndexKey(list[len(list)-1].Key)
+
+	if _, ok := t.options.project[idx]; !ok {
+		return next, list, nil
+	}
+
+	keys := make([]fdb.Key, len(list))
+
+	for i := range list {
+		keys[i] = indexKeyOf(list[i].Key)
+	}
+
+	if rows, err = tx.SelectMany(keys, mvcc.Writer(w)); err != nil {
+		return
+	}
+
+	for i := range list {
+		if _, ok := rows[keys[i].String()]; !ok {
+			res = append(res, list[i])
+		}
+	}
+
+	return next, res, nil
+}
+
+// rowIndexKeys - ключи всех индексов для строки коллекции, с учетом условий частичных индексов
+func (t *v1Table) rowIndexKeys(usr fdb.KeyValue) (res map[uint16][]fdb.Key, err error) {
+	var skip map[uint16]bool
+	var dict map[uint16][]fdb.Key
+
+	if skip, err = t.skipIndexes(usr); err != nil {
+		return
+	}
+
+	res = make(map[uint16][]fdb.Key, 8)
+
+	for k := range t.options.batchidx {
+		if dict, err = t.options.batchidx[k](usr.Value); err != nil {
+			return nil, ErrIdxUpsert.WithReason(err)
+		}
+
+		for idx, keys := range dict {
+			if skip[idx] {
+				continue
+			}
+
+			for i := range keys {
+				if len(keys[i]) > 0 {
+					res[idx] = append(res[idx], keys[i])
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// indexIDs - номера всех индексов коллекции, у которых есть хоть один ключ в БД, в пространстве индексов или проекций
+func (t *v1Table) indexIDs(cn db.Connection, ns byte) (res []uint16, err error) {
+	pref := mvcc.WrapKey(fdb.Key{byte(t.id >> 8), byte(t.id), ns})
+
+	if err = cn.Read(func(r db.Reader) error {
+		res = res[:0]
+		from := pref
+
+		for {
+			rows := r.List(from, pref, 1, false, false).GetSliceOrPanic()
+
+			// Пропускаем байт базы данных, он добавляется при выборке
+			if len(rows) == 0 || len(rows[0].Key) < len(pref)+3 {
+				return nil
+			}
+
+			idx := binary.BigEndian.Uint16(rows[0].Key[len(pref)+1:])
+			res = append(res, idx)
+
+			if idx == 0xFFFF {
+				return nil
+			}
+
+			from = fdbx.AppendRight(pref, byte((idx+1)>>8), byte(idx+1))
+		}
+	}); err != nil {
+		return nil, ErrCheckIndex.WithReason(err)
+	}
+
+	return res, nil
+}
+
+func (r *CheckReport) add(issue IndexIssue, repair bool) {
+	chk := r.Indexes[issue.Index]
+
+	switch issue.Kind {
+	case IssueMissing:
+		chk.Missing++
+	case IssueStale:
+		chk.Stale++
+	case IssueConflict:
+		chk.Conflict++
+	case IssueDangling:
+		chk.Dangling++
+	}
+
+	if repair && issue.Kind != IssueConflict {
+		chk.Repaired++
+		r.Repaired++
+	}
+
+	r.Indexes[issue.Index] = chk
+}
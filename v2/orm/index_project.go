@@ -0,0 +1,36 @@
+package orm
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2"
+)
+
+// IndexProjection - проекция покрывающего индекса, чтобы понять, можно ли отвечать из него. Для обычного индекса nil
+func (t *v1Table) IndexProjection(idx uint16) IndexProjection { return t.options.project[idx] }
+
+/*
+	projectRow - строка проекции для строки индекса.
+
+	Проекции хранятся отдельно от строк индекса, по тем же ключам, но в своем пространстве. Поэтому значение
+	строки индекса всегда остается ключом строки коллекции, и его не нужно отличать от проекции.
+*/
+func (t *v1Table) projectRow(idx uint16, ikey fdb.Key, val []byte) (row fdb.KeyValue, err error) {
+	row.Key = projectKey(ikey)
+
+	if row.Value, err = t.options.project[idx](val); err != nil {
+		return row, ErrValPack.WithReason(err)
+	}
+
+	return row, nil
+}
+
+// projectKey - ключ строки проекции по ключу строки индекса
+func projectKey(ikey fdb.Key) fdb.Key {
+	return fdbx.AppendLeft(fdbx.SkipLeft(ikey, 3), ikey[0], ikey[1], nsProject)
+}
+
+// indexKeyOf - ключ строки индекса по ключу строки проекции
+func indexKeyOf(pkey fdb.Key) fdb.Key {
+	return fdbx.AppendLeft(fdbx.SkipLeft(pkey, 3), pkey[0], pkey[1], nsIndex)
+}
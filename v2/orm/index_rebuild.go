@@ -0,0 +1,341 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// Этапы перестроения индекса, номер этапа сохраняется вместе с прогрессом
+const (
+	rFill    byte = 0
+	rClean   byte = 1
+	rProject byte = 2
+)
+
+// Размер пачки перестроения индекса по умолчанию
+const rebuildBatch = 500
+
+/*
+	RebuildIndex - перестроение индекса по уже существующим строкам коллекции.
+
+	Сначала проходит все строки коллекции и добавляет недостающие ключи индекса, затем проходит
+	все ключи индекса и удаляет те, которые строки коллекции больше не порождают. Если индекс
+	удален из опций коллекции, то на втором этапе будут удалены все его ключи.
+	У покрывающего индекса первый этап также записывает отсутствующие и устаревшие проекции, а третий этап
+	удаляет проекции без ключа индекса. Если проекцию убрали из опций, на третьем этапе удаляются все ее строки.
+
+	Каждая пачка обрабатывается в отдельной логической транзакции, прогресс сохраняется при ее коммите.
+	Если перестроение прервать (ошибкой, падением или отменой контекста), следующий запуск продолжит с того же места.
+	Чтение строк и запись ключей пачки идут в одной физической транзакции, поэтому параллельные изменения
+	этих строк приводят к повтору пачки. Ключи строк, удаленных еще не завершенными транзакциями во время
+	первого этапа, будут удалены на втором этапе.
+
+	Поддерживает опции RebuildBatch и OnRebuild.
+*/
+func (t *v1Table) RebuildIndex(ctx context.Context, cn db.Connection, idx uint16, args ...Option) (rep IndexReport, err error) {
+	var marks map[byte]fdb.Key
+
+	start := time.Now()
+	opts := getOpts(args)
+
+	if opts.rbatch < 2 {
+		opts.rbatch = rebuildBatch
+	}
+
+	defer func() { rep.Duration = time.Since(start) }()
+
+	if marks, err = t.rebuildMarks(cn, idx); err != nil {
+		return rep, ErrRebuildIndex.WithReason(err)
+	}
+
+	stages := []struct {
+		stage byte
+		batch func(mvcc.Tx, db.Writer, uint16, fdb.Key, int, *IndexReport) (fdb.Key, bool, error)
+	}{
+		{rFill, t.rebuildFill},
+		{rClean, t.rebuildClean},
+		{rProject, t.rebuildProject},
+	}
+
+	for i := range stages {
+		mark, ok := marks[stages[i].stage]
+
+		// Пустая отметка - этап уже пройден в одном из прошлых запусков
+		if ok && len(mark) == 0 {
+			continue
+		}
+
+		last := i == len(stages)-1
+
+		for done := false; !done; {
+			if err = ctx.Err(); err != nil {
+				return rep, ErrRebuildIndex.WithReason(err)
+			}
+
+			if mark, done, err = t.rebuildBatch(cn, idx, stages[i].stage, mark, last, opts, stages[i].batch, &rep); err != nil {
+				return rep, ErrRebuildIndex.WithReason(err).WithDebug(errx.Debug{"idx": idx, "stage": stages[i].stage})
+			}
+
+			if opts.onRebuild != nil {
+				rep.Duration = time.Since(start)
+				opts.onRebuild(rep)
+			}
+		}
+	}
+
+	return rep, nil
+}
+
+// rebuildBatch - обработка одной пачки этапа в отдельной логической транзакции
+func (t *v1Table) rebuildBatch(
+	cn db.Connection,
+	idx uint16,
+	stage byte,
+	mark fdb.Key,
+	last bool,
+	opts options,
+	batch func(mvcc.Tx, db.Writer, uint16, fdb.Key, int, *IndexReport) (fdb.Key, bool, error),
+	rep *IndexReport,
+) (next fdb.Key, done bool, err error) {
+	var part IndexReport
+
+	tx := mvcc.Begin(cn)
+	defer tx.Cancel()
+
+	if err = cn.Write(func(w db.Writer) (exp error) {
+		// Физическая транзакция может повториться, поэтому статистика пачки считается заново
+		part = IndexReport{}
+		next, done, exp = batch(tx, w, idx, mark, opts.rbatch, &part)
+		return exp
+	}); err != nil {
+		return nil, false, err
+	}
+
+	// Прогресс сохраняется вместе с коммитом, иначе при падении можно пропустить незакоммиченные ключи
+	tx.OnCommit(func(w db.Writer) error {
+		// Весь цикл перестроения завершен, прогресс больше не нужен
+		if last && done {
+			w.Erase(t.rebuildKey(idx, nil), t.rebuildKey(idx, nil))
+			return nil
+		}
+
+		if done {
+			next = nil
+		}
+
+		w.Upsert(fdb.KeyValue{Key: t.rebuildKey(idx, fdb.Key{stage}), Value: next})
+		return nil
+	})
+
+	if err = tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	rep.Rows += part.Rows
+	rep.Added += part.Added
+	rep.Removed += part.Removed
+	rep.Batches++
+	return next, done, nil
+}
+
+// rebuildFill - добавление недостающих ключей индекса для пачки строк коллекции
+func (t *v1Table) rebuildFill(
+	tx mvcc.Tx,
+	w db.Writer,
+	idx uint16,
+	mark fdb.Key,
+	size int,
+	rep *IndexReport,
+) (next fdb.Key, done bool, err error) {
+	var list []fdb.KeyValue
+	var miss []indexEntry
+
+	if list, done, err = t.rebuildList(tx, w, WrapTableKey(t.id, nil), WrapTableKey(t.id, mark), size); err != nil {
+		return
+	}
+
+	if next, miss, err = t.missingEntries(tx, w, list, func(id uint16) bool { return id == idx }); err != nil {
+		return
+	}
+
+	rep.Rows += uint64(len(list))
+	rows := make([]fdb.KeyValue, 0, len(miss))
+
+	for i := range miss {
+		// Ключ уникального индекса уже занят другой строкой
+		if miss[i].kind == IssueConflict {
+			return nil, false, ErrDuplicate.WithDebug(errx.Debug{
+				"index": idx,
+				"key":   UnwrapIndexKey(miss[i].row.Key),
+				"id":    miss[i].id,
+			})
+		}
+
+		rows = append(rows, miss[i].row)
+	}
+
+	if len(rows) == 0 {
+		return next, done, nil
+	}
+
+	if err = tx.Upsert(rows, mvcc.Writer(w)); err != nil {
+		return
+	}
+
+	rep.Added += uint64(len(rows))
+	return next, done, nil
+}
+
+// rebuildClean - удаление ключей индекса, которые строки коллекции больше не порождают
+func (t *v1Table) rebuildClean(
+	tx mvcc.Tx,
+	w db.Writer,
+	idx uint16,
+	mark fdb.Key,
+	size int,
+	rep *IndexReport,
+) (next fdb.Key, done bool, err error) {
+	var list []fdb.KeyValue
+	var drop []fdb.KeyValue
+
+	prefix := WrapIndexKey(t.id, idx, nil)
+
+	if list, done, err = t.rebuildList(tx, w, prefix, fdbx.AppendRight(prefix, mark...), size); err != nil {
+		return
+	}
+
+	if next, drop, err = t.danglingEntries(tx, w, idx, list); err != nil {
+		return
+	}
+
+	rep.Rows += uint64(len(list))
+
+	if len(drop) == 0 {
+		return next, done, nil
+	}
+
+	keys := make([]fdb.Key, len(drop))
+
+	for i := range drop {
+		keys[i] = drop[i].Key
+	}
+
+	if err = tx.Delete(keys, mvcc.Writer(w)); err != nil {
+		return
+	}
+
+	rep.Removed += uint64(len(keys))
+	return next, done, nil
+}
+
+// rebuildProject - удаление проекций покрывающего индекса, которым больше не соответствует ключ индекса
+func (t *v1Table) rebuildProject(
+	tx mvcc.Tx,
+	w db.Writer,
+	idx uint16,
+	mark fdb.Key,
+	size int,
+	rep *IndexReport,
+) (next fdb.Key, done bool, err error) {
+	var list []fdb.KeyValue
+	var drop []fdb.KeyValue
+
+	prefix := projectKey(WrapIndexKey(t.id, idx, nil))
+
+	if list, done, err = t.rebuildList(tx, w, prefix, fdbx.AppendRight(prefix, mark...), size); err != nil {
+		return
+	}
+
+	if next, drop, err = t.danglingProjects(tx, w, idx, list); err != nil {
+		return
+	}
+
+	rep.Rows += uint64(len(list))
+
+	if len(drop) == 0 {
+		return next, done, nil
+	}
+
+	keys := make([]fdb.Key, len(drop))
+
+	for i := range drop {
+		keys[i] = drop[i].Key
+	}
+
+	if err = tx.Delete(keys, mvcc.Writer(w)); err != nil {
+		return
+	}
+
+	rep.Removed += uint64(len(keys))
+	return next, done, nil
+}
+
+// rebuildList - выборка пачки строк по префиксу, строго после отметки прогресса
+func (t *v1Table) rebuildList(
+	tx mvcc.Tx,
+	w db.Writer,
+	prefix, from fdb.Key,
+	size int,
+) (_ []fdb.KeyValue, done bool, err error) {
+	var list []fdb.KeyValue
+
+	// Строка на отметке уже обработана в прошлой пачке, поэтому выбираем на одну больше
+	skip := !bytes.Equal(prefix, from)
+
+	if skip {
+		size++
+	}
+
+	if list, err = tx.ListAll(context.Background(),
+		mvcc.From(from),
+		mvcc.Last(prefix),
+		mvcc.Limit(size),
+		mvcc.Writer(w),
+	); err != nil {
+		return nil, false, err
+	}
+
+	done = len(list) < size
+
+	if skip && len(list) > 0 && bytes.Equal(list[0].Key, from) {
+		list = list[1:]
+	}
+
+	return list, done, nil
+}
+
+// rebuildKey - служебный ключ прогресса перестроения индекса, вне пространства версий строк
+func (t *v1Table) rebuildKey(idx uint16, key fdb.Key) fdb.Key {
+	return mvcc.WrapKey(fdbx.AppendLeft(key, byte(t.id>>8), byte(t.id), nsRebuild, byte(idx>>8), byte(idx)))
+}
+
+// rebuildMarks - загрузка прогресса прошлых запусков перестроения: последний обработанный ключ по номеру этапа
+func (t *v1Table) rebuildMarks(dbc db.Connection, idx uint16) (res map[byte]fdb.Key, err error) {
+	skey := t.rebuildKey(idx, nil)
+	res = make(map[byte]fdb.Key, 2)
+
+	if err = dbc.Read(func(r db.Reader) error {
+		rows := r.List(skey, skey, 0, false, false).GetSliceOrPanic()
+
+		for i := range rows {
+			// Пропускаем байт базы данных, он добавляется при выборке
+			if key := rows[i].Key[1:]; len(key) == len(skey)+1 {
+				res[key[len(skey)]] = rows[i].Value
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, ErrRebuildIndex.WithReason(err)
+	}
+
+	return res, nil
+}
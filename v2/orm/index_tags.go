@@ -0,0 +1,317 @@
+package orm
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/keys"
+)
+
+// Имя тега с описанием индексов поля
+const indexTag = "fdbx"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+/*
+	TagIndex - индексы коллекции, объявленные тегами fdbx в полях структуры значения.
+
+	Формат тега: `fdbx:"index=2,order=desc"`. Если поле входит в несколько индексов,
+	их описания разделяются точкой с запятой: `fdbx:"index=2;index=3,pos=1"`.
+
+	Поля с одинаковым номером индекса образуют составной ключ в порядке объявления полей,
+	порядок можно изменить параметром pos. Поле-срез дает по ключу на каждый элемент,
+	а если таких полей в составном индексе несколько - то на каждое их сочетание.
+	Нулевой указатель или пустой срез означают, что строка в индекс не попадает.
+
+	Поддерживаются строки, []byte, целые и дробные числа, bool и time.Time, а также указатели и срезы из них.
+	Значения кодируются пакетом keys с сохранением порядка, поэтому по индексу можно делать выборку диапазоном,
+	а ключи для выборки удобно строить функциями keys.Append.
+*/
+func TagIndex[V any](c Codec[V]) (_ Option, err error) {
+	var idx []tagIndex
+
+	if idx, err = parseTagIndexes(reflect.TypeOf((*V)(nil)).Elem()); err != nil {
+		return nil, ErrTagIndex.WithReason(err)
+	}
+
+	ids := make([]uint16, len(idx))
+
+	for i := range idx {
+		ids[i] = idx[i].id
+	}
+
+	return BatchIndex(func(buf []byte) (_ map[uint16][]fdb.Key, err error) {
+		var val V
+
+		if val, err = c.Decode(buf); err != nil {
+			return nil, ErrValUnpack.WithReason(err)
+		}
+
+		return tagIndexKeys(idx, reflect.ValueOf(val)), nil
+	}, ids...), nil
+}
+
+// tagIndex - описание индекса из тегов структуры
+type tagIndex struct {
+	id    uint16
+	parts []tagPart
+}
+
+// tagPart - поле структуры в составе индекса
+type tagPart struct {
+	pos   int
+	desc  bool
+	multi bool
+	field []int
+}
+
+func parseTagIndexes(typ reflect.Type) (res []tagIndex, err error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct {
+		return nil, ErrTagIndex.WithDetail("Value type %s is not a struct", typ)
+	}
+
+	dict := make(map[uint16]int, 8)
+
+	for i := 0; i < typ.NumField(); i++ {
+		fld := typ.Field(i)
+		tag, ok := fld.Tag.Lookup(indexTag)
+
+		if !ok || tag == "" || tag == "-" {
+			continue
+		}
+
+		if fld.PkgPath != "" {
+			return nil, ErrTagIndex.WithDetail("Field %s is not exported", fld.Name)
+		}
+
+		multi, exp := checkTagIndexType(fld.Type)
+
+		if exp != nil {
+			return nil, ErrTagIndex.WithReason(exp).WithDebug(errx.Debug{"field": fld.Name})
+		}
+
+		for _, desc := range strings.Split(tag, ";") {
+			var id uint16
+			var part tagPart
+
+			part.pos = i
+			part.multi = multi
+			part.field = fld.Index
+
+			if id, err = parseTagPart(desc, &part); err != nil {
+				return nil, ErrTagIndex.WithReason(err).WithDebug(errx.Debug{"field": fld.Name, "tag": tag})
+			}
+
+			n, ok := dict[id]
+
+			if !ok {
+				n = len(res)
+				dict[id] = n
+				res = append(res, tagIndex{id: id})
+			}
+
+			res[n].parts = append(res[n].parts, part)
+		}
+	}
+
+	for i := range res {
+		parts := res[i].parts
+		sort.SliceStable(parts, func(a, b int) bool { return parts[a].pos < parts[b].pos })
+	}
+
+	return res, nil
+}
+
+func parseTagPart(desc string, part *tagPart) (id uint16, err error) {
+	var num uint64
+
+	found := false
+
+	for _, item := range strings.Split(desc, ",") {
+		name, value := item, ""
+
+		if n := strings.IndexByte(item, '='); n >= 0 {
+			name, value = item[:n], item[n+1:]
+		}
+
+		switch strings.TrimSpace(name) {
+		case "index":
+			if num, err = strconv.ParseUint(strings.TrimSpace(value), 10, 16); err != nil {
+				return 0, ErrTagIndex.WithReason(err)
+			}
+			id = uint16(num)
+			found = true
+		case "pos":
+			if part.pos, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return 0, ErrTagIndex.WithReason(err)
+			}
+		case "order":
+			switch strings.TrimSpace(value) {
+			case "asc":
+				part.desc = false
+			case "desc":
+				part.desc = true
+			default:
+				return 0, ErrTagIndex.WithDetail("Unknown order %s", value)
+			}
+		default:
+			return 0, ErrTagIndex.WithDetail("Unknown option %s", name)
+		}
+	}
+
+	if !found {
+		return 0, ErrTagIndex.WithDetail("Index ID is required")
+	}
+
+	return id, nil
+}
+
+// checkTagIndexType - проверка, что значения поля можно положить в ключ индекса
+func checkTagIndexType(typ reflect.Type) (multi bool, err error) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	// Срез байт - это одно значение, а остальные срезы - несколько
+	if typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8 {
+		multi = true
+		typ = typ.Elem()
+
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+	}
+
+	if typ == timeType {
+		return multi, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return multi, nil
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return multi, nil
+		}
+	}
+
+	return false, ErrTagIndex.WithDetail("Unsupported type %s", typ)
+}
+
+// tagIndexKeys - ключи всех индексов для значения
+func tagIndexKeys(idx []tagIndex, val reflect.Value) map[uint16][]fdb.Key {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+
+	res := make(map[uint16][]fdb.Key, len(idx))
+
+	for i := range idx {
+		list := []fdb.Key{nil}
+
+		for _, part := range idx[i].parts {
+			vals := tagPartValues(val.FieldByIndex(part.field), part.multi, part.desc)
+
+			// Если хоть одна часть пустая, то и ключа нет
+			if len(vals) == 0 {
+				list = nil
+				break
+			}
+
+			next := make([]fdb.Key, 0, len(list)*len(vals))
+
+			for k := range list {
+				for v := range vals {
+					next = append(next, fdbx.AppendRight(list[k], vals[v]...))
+				}
+			}
+
+			list = next
+		}
+
+		if len(list) > 0 {
+			res[idx[i].id] = list
+		}
+	}
+
+	return res
+}
+
+func tagPartValues(fld reflect.Value, multi, desc bool) (res [][]byte) {
+	if fld = derefTagValue(fld); !fld.IsValid() {
+		return nil
+	}
+
+	if !multi {
+		return [][]byte{encodeTagValue(fld, desc)}
+	}
+
+	res = make([][]byte, 0, fld.Len())
+
+	for i := 0; i < fld.Len(); i++ {
+		if item := derefTagValue(fld.Index(i)); item.IsValid() {
+			res = append(res, encodeTagValue(item, desc))
+		}
+	}
+
+	return res
+}
+
+func derefTagValue(val reflect.Value) reflect.Value {
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return reflect.Value{}
+		}
+		val = val.Elem()
+	}
+
+	return val
+}
+
+/*
+	encodeTagValue - кодирование значения поля с сохранением порядка сортировки, см. пакет keys.
+
+	Каждая часть несет код типа, а строки и срезы байт завершаются нулевым байтом,
+	поэтому части составного ключа не смешиваются. Для обратного порядка все байты значения инвертируются.
+*/
+func encodeTagValue(val reflect.Value, desc bool) (res []byte) {
+	switch {
+	case val.Type() == timeType:
+		res = keys.AppendTime(nil, val.Interface().(time.Time))
+	case val.Kind() == reflect.String:
+		res = keys.AppendString(nil, val.String())
+	case val.Kind() == reflect.Slice:
+		res = keys.AppendBytes(nil, val.Bytes())
+	case val.Kind() == reflect.Bool:
+		res = keys.AppendBool(nil, val.Bool())
+	case val.Kind() >= reflect.Int && val.Kind() <= reflect.Int64:
+		res = keys.AppendInt(nil, val.Int())
+	case val.Kind() >= reflect.Uint && val.Kind() <= reflect.Uint64:
+		res = keys.AppendUint(nil, val.Uint())
+	case val.Kind() == reflect.Float32 || val.Kind() == reflect.Float64:
+		res = keys.AppendFloat(nil, val.Float())
+	}
+
+	if desc {
+		return keys.AppendDesc(nil, res)
+	}
+
+	return res
+}
@@ -19,6 +19,28 @@ const (
 	StatusConfirmed   byte = 3
 )
 
+// Виды расхождений индекса со строками коллекции
+const (
+	IssueMissing  byte = 1 // У строки коллекции нет ожидаемого ключа индекса
+	IssueStale    byte = 2 // Проекция покрывающего индекса не совпадает со строкой
+	IssueConflict byte = 3 // Ключ уникального индекса занят другой строкой
+	IssueDangling byte = 4 // Ключ индекса не порождается ни одной строкой коллекции
+)
+
+// Действия со ссылающимися строками при удалении строки, на которую они ссылаются
+const (
+	RefRestrict byte = 0 // Удаление запрещено, пока есть ссылки
+	RefCascade  byte = 1 // Ссылающиеся строки удаляются вместе с ней
+	RefSetNull  byte = 2 // Ссылка убирается из значения ссылающихся строк
+)
+
+// Виды изменения строки коллекции для триггеров
+const (
+	ChangeInsert byte = 1
+	ChangeUpdate byte = 2
+	ChangeDelete byte = 3
+)
+
 // Table - универсальный интерфейс коллекции, чтобы работать с запросами
 type Table interface {
 	ID() uint16
@@ -28,9 +50,184 @@ type Table interface {
 	Delete(mvcc.Tx, ...fdb.Key) error
 	Upsert(mvcc.Tx, ...fdb.KeyValue) error
 	Insert(mvcc.Tx, ...fdb.KeyValue) error
+	Update(mvcc.Tx, fdb.Key, UpdateHandler) error
+	Truncate(mvcc.Tx) error
+	Drop(db.Connection) error
+
+	Count(mvcc.Tx) (uint64, error)
+	IndexCount(mvcc.Tx, uint16, fdb.Key, fdb.Key) (uint64, error)
 
-	Vacuum(db.Connection) error
+	Vacuum(db.Connection, ...Option) (VacuumReport, error)
 	Autovacuum(context.Context, db.Connection, ...Option)
+
+	RebuildIndex(context.Context, db.Connection, uint16, ...Option) (IndexReport, error)
+	CheckIndexes(context.Context, db.Connection, ...Option) (CheckReport, error)
+	IndexFilter(uint16) Filter
+	IndexProjection(uint16) IndexProjection
+	IndexTerms(uint16, string) []string
+}
+
+// VacuumReport - статистика очистки коллекции
+type VacuumReport struct {
+	// Кол-во просмотренных версий строк коллекции, индексов, очередей и курсоров
+	Rows uint64
+
+	// Кол-во удаленных устаревших версий строк коллекции
+	Versions uint64
+
+	// Кол-во удаленных BLOB
+	BLOBs uint64
+
+	// Кол-во удаленных строк индексов
+	Indexes uint64
+
+	// Кол-во удаленных элементов очередей
+	Queues uint64
+
+	// Кол-во удаленных курсоров
+	Queries uint64
+
+	// Кол-во использованных физических транзакций
+	Physical uint64
+
+	// Общее время очистки
+	Duration time.Duration
+}
+
+// IndexReport - статистика перестроения индекса
+type IndexReport struct {
+	// Кол-во просмотренных строк коллекции и ключей индекса
+	Rows uint64
+
+	// Кол-во добавленных ключей индекса
+	Added uint64
+
+	// Кол-во удаленных ключей индекса
+	Removed uint64
+
+	// Кол-во обработанных пачек, каждая в своей логической транзакции
+	Batches uint64
+
+	// Общее время перестроения
+	Duration time.Duration
+}
+
+// CheckReport - статистика проверки индексов коллекции
+type CheckReport struct {
+	// Кол-во просмотренных строк коллекции
+	Rows uint64
+
+	// Кол-во просмотренных ключей индексов
+	Entries uint64
+
+	// Кол-во исправленных расхождений
+	Repaired uint64
+
+	// Расхождения по номерам индексов
+	Indexes map[uint16]IndexCheck
+
+	// Общее время проверки
+	Duration time.Duration
+}
+
+// IndexCheck - кол-во расхождений индекса со строками коллекции по видам
+type IndexCheck struct {
+	Missing  uint64
+	Stale    uint64
+	Conflict uint64
+	Dangling uint64
+	Repaired uint64
+}
+
+// IndexIssue - расхождение индекса со строками коллекции
+type IndexIssue struct {
+	// Номер индекса
+	Index uint16
+
+	// Вид расхождения, одна из констант Issue
+	Kind byte
+
+	// Ключ строки индекса, без префикса коллекции и индекса
+	Key fdb.Key
+
+	// Ключ строки коллекции, на которую указывает или должен указывать индекс
+	ID fdb.Key
+}
+
+// IssueHandler - обработчик найденного при проверке расхождения индекса
+type IssueHandler func(IndexIssue)
+
+// RebuildHandler - обработчик прогресса перестроения индекса, получает статистику с начала запуска
+type RebuildHandler func(IndexReport)
+
+// Registry - реестр схемы: соответствие имен коллекций, индексов и очередей их номерам, хранится в БД
+type Registry interface {
+	Register(TableSchema) (TableSchema, error)
+	Table(TableSchema, ...Option) (Table, error)
+	Tables() ([]TableSchema, error)
+}
+
+// TableSchema - описание коллекции в реестре схемы
+type TableSchema struct {
+	// Уникальное имя коллекции
+	Name string
+
+	// Номер коллекции, если не указан - берется сохраненный или выделяется новый
+	ID uint16
+
+	// Индексы коллекции, имена уникальны в пределах коллекции
+	Indexes []SchemaEntry
+
+	// Очереди коллекции, имена уникальны в пределах коллекции
+	Queues []SchemaEntry
+}
+
+// SchemaEntry - описание индекса или очереди в реестре схемы
+type SchemaEntry struct {
+	// Имя индекса или очереди
+	Name string
+
+	// Номер индекса или очереди, если не указан - берется сохраненный или выделяется новый
+	ID uint16
+
+	// Версия определения, увеличивается при изменении функции индекса или формата задач
+	Version uint32
+}
+
+// Migration - пронумерованный шаг миграции схемы или данных
+type Migration struct {
+	// Номер миграции, выполняются по возрастанию номеров
+	Version uint32
+
+	// Краткое описание для журнала
+	Name string
+
+	// Выполнение миграции
+	Apply MigrationHandler
+}
+
+// MigrationHandler - выполнение миграции, прогресс прошлой попытки доступен через MigrationProgress
+type MigrationHandler func(context.Context, db.Connection, MigrationProgress) error
+
+// MigrationProgress - отметка прогресса миграции, чтобы после сбоя продолжить с того же места
+type MigrationProgress interface {
+	// Отметка, сохраненная прошлой попыткой, или nil
+	Mark() []byte
+
+	// Сохранение отметки вместе с коммитом транзакции
+	Save(mvcc.Tx, []byte)
+}
+
+// MigrateReport - статистика выполнения миграций
+type MigrateReport struct {
+	// Номера миграций, выполненных в этом запуске
+	Applied []uint32
+
+	// Кол-во миграций, выполненных ранее
+	Skipped uint64
+
+	// Общее время, включая ожидание аренды
+	Duration time.Duration
 }
 
 // Queue - универсальный интерфейс очередей, для работы с задачами
@@ -69,6 +266,126 @@ type Task interface {
 // Aggregator - описание функции-агрегатора для запросов
 type Aggregator func(fdb.KeyValue) error
 
+// UpdateHandler - получает текущее значение строки и возвращает новое, для изменения под блокировкой
+type UpdateHandler func([]byte) ([]byte, error)
+
+/*
+	Trigger - обработчик изменения строки коллекции, получает транзакцию записи.
+
+	Триггер может писать в другие коллекции и очереди в той же транзакции. Триггеры до записи вызываются
+	внутри физической транзакции записи и могут быть вызваны повторно, поэтому побочных эффектов вне БД в них быть не должно.
+	Логическая очистка Truncate и физическое удаление Drop триггеры не вызывают.
+*/
+type Trigger func(mvcc.Tx, RowChange) error
+
+// RowChange - изменение строки коллекции для триггеров
+type RowChange struct {
+	// Вид изменения, одна из констант Change
+	Kind byte
+
+	// Ключ строки
+	Key fdb.Key
+
+	// Значение до изменения, при вставке nil
+	Old []byte
+
+	// Значение после изменения, при удалении nil
+	New []byte
+}
+
+/*
+	View - материализованное представление коллекции: кол-во строк и суммы их показателей по группам.
+
+	Выборка возвращает пары, где ключ - ключ группы, а значение разбирается через ParseViewRow.
+	Доступны условия Where, ограничения и страницы, но не выборки по ключам и индексам.
+*/
+type View interface {
+	ID() uint16
+
+	Select(mvcc.Tx) Query
+	Get(mvcc.Tx, fdb.Key) (ViewRow, error)
+
+	Rebuild(context.Context, db.Connection) (ViewReport, error)
+	Drop(db.Connection) error
+}
+
+// ViewGroup - для получения ключа группы строки коллекции. Строки с пустым ключом в представление не попадают
+type ViewGroup func([]byte) (fdb.Key, error)
+
+// ViewMeasure - для получения суммируемого показателя строки коллекции
+type ViewMeasure func([]byte) (int64, error)
+
+// ViewRow - строка материализованного представления
+type ViewRow struct {
+	// Ключ группы
+	Group fdb.Key
+
+	// Кол-во строк коллекции в группе
+	Count int64
+
+	// Суммы показателей строк группы, в порядке опции ViewSum
+	Sums []int64
+}
+
+// ViewReport - статистика перестроения материализованного представления
+type ViewReport struct {
+	// Кол-во просмотренных строк коллекции
+	Rows uint64
+
+	// Кол-во записанных групп
+	Groups uint64
+
+	// Общее время перестроения
+	Duration time.Duration
+}
+
+/*
+	VectorIndex - индекс векторов строк коллекции для поиска ближайших соседей по расстоянию L2 или косинусному.
+
+	Выборка Nearest возвращает строки коллекции по возрастанию расстояния их векторов до вектора запроса,
+	поэтому для k ближайших строк достаточно ограничения Limit(k), а условия Where отсеивают строки до ограничения.
+*/
+type VectorIndex interface {
+	ID() uint16
+
+	Nearest(tx mvcc.Tx, vec []float32, args ...Option) Query
+
+	Rebuild(context.Context, db.Connection) (VectorReport, error)
+	Drop(db.Connection) error
+
+	Vacuum(db.Connection, ...Option) (VacuumReport, error)
+	Autovacuum(context.Context, db.Connection, ...Option)
+}
+
+// IndexVector - для получения вектора строки в индексе векторов. Строки с пустым вектором в индекс не попадают
+type IndexVector func([]byte) ([]float32, error)
+
+// VectorMetric - способ вычисления расстояния между векторами
+type VectorMetric byte
+
+const (
+	// VectorL2 - евклидово расстояние
+	VectorL2 VectorMetric = 1
+
+	// VectorCosine - косинусное расстояние, единица минус косинус угла между векторами
+	VectorCosine VectorMetric = 2
+)
+
+// VectorReport - статистика перестроения индекса векторов
+type VectorReport struct {
+	// Кол-во просмотренных строк коллекции
+	Rows uint64
+
+	// Кол-во проиндексированных векторов
+	Vectors uint64
+
+	// Кол-во списков, на которые разбиты векторы. Ноль - списков нет, поиск точный
+	Lists uint64
+
+	// Общее время перестроения
+	Duration time.Duration
+}
+
 // Filter - управляющий метод для фильтрации выборок
 // Должен возвращать true, если объект нужно оставить и false в другом случае
 type Filter func(fdb.KeyValue) (ok bool, err error)
@@ -80,6 +397,9 @@ type Query interface {
 	PossibleByID(ids ...fdb.Key) Query
 	ByIndex(idx uint16, query fdb.Key) Query
 	ByIndexRange(idx uint16, from, last fdb.Key) Query
+	ByText(idx uint16, query TextQuery) Query
+	ByGeoBox(idx uint16, min, max GeoPoint) Query
+	ByGeoRadius(idx uint16, center GeoPoint, radius float64) Query
 	BySelector(Selector) Query
 
 	// Модификаторы селекторов
@@ -88,14 +408,17 @@ type Query interface {
 	Page(int) Query
 	Limit(int) Query
 	Where(Filter) Query
+	Covered() Query
 
 	// Обработка результатов
 	Agg(...Aggregator) error
+	Count() (uint64, error)
 	All() ([]fdb.KeyValue, error)
 	Next() ([]fdb.KeyValue, error)
 	First() (fdb.KeyValue, error)
 	Sequence(context.Context, ...Option) (<-chan fdb.KeyValue, <-chan error)
 	Delete() error
+	Update(UpdateHandler) error
 	Empty() bool
 
 	// Сохранение запроса (курсор)
@@ -108,15 +431,33 @@ type Selector interface {
 	Select(context.Context, Table, ...Option) (<-chan Selected, <-chan error)
 }
 
-// IndexKey - для получения ключей при индексации коллекций
+// IndexKey - для получения ключей при индексации коллекций, составные ключи удобно строить пакетом keys
 type IndexKey func([]byte) (fdb.Key, error)
 
+// IndexProjection - для получения проекции значения, которая хранится в покрывающем индексе
+type IndexProjection func([]byte) ([]byte, error)
+
 // IndexMultiKey - для получения ключей при индексации коллекций
 type IndexMultiKey func([]byte) ([]fdb.Key, error)
 
 // IndexBatchKey - для получения ключей при индексации коллекций
 type IndexBatchKey func([]byte) (map[uint16][]fdb.Key, error)
 
+// IndexText - для получения текста строки в полнотекстовом индексе, несколько полей можно объединить через пробел
+type IndexText func([]byte) (string, error)
+
+// IndexGeo - для получения точки строки в геоиндексе, false - у строки нет координат
+type IndexGeo func([]byte) (GeoPoint, bool, error)
+
+// GeoPoint - точка на поверхности Земли, в градусах
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+// Analyzer - обработка слов текста полнотекстового индекса и запросов к нему: регистр, стемминг, стоп-слова
+type Analyzer func([]string) []string
+
 // Option - доп.аргумент для инициализации коллекций
 type Option func(*options)
 
@@ -187,30 +528,46 @@ func UnwrapQueryKey(key fdb.Key) fdb.Key {
 
 // Ошибки модуля
 var (
-	ErrSub       = errx.New("Ошибка получения задач из очереди")
-	ErrPub       = errx.New("Ошибка публикации задачи в очередь")
-	ErrAck       = errx.New("Ошибка подтверждения задач в очереди")
-	ErrUndo      = errx.New("Ошибка отмены опубликованной задачи")
-	ErrLost      = errx.New("Ошибка получения неподтвержденных задач")
-	ErrStat      = errx.New("Ошибка получения статистики задач")
-	ErrTask      = errx.New("Ошибка получения метаданных задачи")
-	ErrAgg       = errx.New("Ошибка агрегации объектов коллекции")
-	ErrSelect    = errx.New("Ошибка загрузки объектов коллекции")
-	ErrDelete    = errx.New("Ошибка удаления объектов коллекции")
-	ErrUpsert    = errx.New("Ошибка обновления объектов коллекции")
-	ErrFilter    = errx.New("Ошибка фильтрации объектов коллекции")
-	ErrNotFound  = errx.New("Ошибка загрузки объекта")
-	ErrIdxDelete = errx.New("Ошибка очистки индекса")
-	ErrIdxUpsert = errx.New("Ошибка обновления индекса")
-	ErrValPack   = errx.New("Ошибка упаковки значения")
-	ErrValUnpack = errx.New("Ошибка распаковки значения")
-	ErrVacuum    = errx.New("Ошибка автоочистки значений")
-	ErrAll       = errx.New("Ошибка загрузки всех значений")
-	ErrNext      = errx.New("Ошибка загрузки страницы значений")
-	ErrFirst     = errx.New("Ошибка загрузки первого значения")
-	ErrSequence  = errx.New("Ошибка загрузки коллекции")
-	ErrLoadQuery = errx.New("Ошибка загрузки курсора запроса")
-	ErrDropQuery = errx.New("Ошибка удаления курсора запроса")
-	ErrSaveQuery = errx.New("Ошибка сохранения курсора запроса")
-	ErrDuplicate = errx.New("Нарушение уникальности коллекции")
+	ErrSub          = errx.New("Ошибка получения задач из очереди")
+	ErrPub          = errx.New("Ошибка публикации задачи в очередь")
+	ErrAck          = errx.New("Ошибка подтверждения задач в очереди")
+	ErrUndo         = errx.New("Ошибка отмены опубликованной задачи")
+	ErrLost         = errx.New("Ошибка получения неподтвержденных задач")
+	ErrStat         = errx.New("Ошибка получения статистики задач")
+	ErrTask         = errx.New("Ошибка получения метаданных задачи")
+	ErrAgg          = errx.New("Ошибка агрегации объектов коллекции")
+	ErrSelect       = errx.New("Ошибка загрузки объектов коллекции")
+	ErrDelete       = errx.New("Ошибка удаления объектов коллекции")
+	ErrUpsert       = errx.New("Ошибка обновления объектов коллекции")
+	ErrFilter       = errx.New("Ошибка фильтрации объектов коллекции")
+	ErrNotFound     = errx.New("Ошибка загрузки объекта")
+	ErrIdxDelete    = errx.New("Ошибка очистки индекса")
+	ErrIdxUpsert    = errx.New("Ошибка обновления индекса")
+	ErrValPack      = errx.New("Ошибка упаковки значения")
+	ErrValUnpack    = errx.New("Ошибка распаковки значения")
+	ErrVacuum       = errx.New("Ошибка автоочистки значений")
+	ErrAll          = errx.New("Ошибка загрузки всех значений")
+	ErrNext         = errx.New("Ошибка загрузки страницы значений")
+	ErrFirst        = errx.New("Ошибка загрузки первого значения")
+	ErrSequence     = errx.New("Ошибка загрузки коллекции")
+	ErrLoadQuery    = errx.New("Ошибка загрузки курсора запроса")
+	ErrDropQuery    = errx.New("Ошибка удаления курсора запроса")
+	ErrSaveQuery    = errx.New("Ошибка сохранения курсора запроса")
+	ErrDuplicate    = errx.New("Нарушение уникальности коллекции")
+	ErrTagIndex     = errx.New("Ошибка описания индекса в тегах структуры")
+	ErrRebuildIndex = errx.New("Ошибка перестроения индекса")
+	ErrCheckIndex   = errx.New("Ошибка проверки индексов")
+	ErrRegister     = errx.New("Ошибка регистрации схемы коллекции")
+	ErrSchema       = errx.New("Ошибка загрузки реестра схемы")
+	ErrConflict     = errx.New("Определение не совпадает с сохраненной схемой")
+	ErrMigrate      = errx.New("Ошибка выполнения миграций")
+	ErrTruncate     = errx.New("Ошибка очистки коллекции")
+	ErrDrop         = errx.New("Ошибка удаления коллекции")
+	ErrUpdate       = errx.New("Ошибка изменения объектов коллекции")
+	ErrCount        = errx.New("Ошибка подсчета объектов коллекции")
+	ErrNoCounter    = errx.New("Счетчик не ведется")
+	ErrForeignKey   = errx.New("Нарушение внешнего ключа коллекции")
+	ErrTrigger      = errx.New("Ошибка выполнения триггера коллекции")
+	ErrView         = errx.New("Ошибка материализованного представления")
+	ErrVector       = errx.New("Ошибка индекса векторов")
 )
@@ -1,9 +1,13 @@
 package orm_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -15,8 +19,11 @@ import (
 	"github.com/shestakovda/typex"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/keys"
+	"github.com/shestakovda/fdbx/v2/models"
 	"github.com/shestakovda/fdbx/v2/mvcc"
 	"github.com/shestakovda/fdbx/v2/orm"
 )
@@ -75,70 +82,1632 @@ func (s *ORMSuite) TearDownTest() {
 	s.tx.Cancel()
 }
 
-func (s *ORMSuite) checkVacuum(ignore map[string]bool) {
-	s.Require().NoError(s.tbl.Vacuum(s.cn))
+func (s *ORMSuite) checkVacuum(ignore map[string]bool) orm.VacuumReport {
+	rep, err := s.tbl.Vacuum(s.cn)
+	s.Require().NoError(err)
+
+	// В базе ничего не должно оставаться
+	s.Require().NoError(s.cn.Read(func(r db.Reader) error {
+		fail := false
+		nkey := fdb.Key{0x00}
+		list := r.List(nkey, nkey, 1000, false, false).GetSliceOrPanic()
+
+		for i := range list {
+			if pkey := list[i].Key[1:].String(); !ignore[pkey] {
+				glog.Errorf(">> %s", pkey)
+				fail = true
+			}
+		}
+
+		s.False(fail)
+		return nil
+	}))
+	return rep
+}
+
+func (s *ORMSuite) TestWorkflow() {
+	// Обычное значение
+	baseMsg := []byte("msg")
+
+	// Чтобы потестить сжатие в gzip
+	longMsg := make([]byte, 20<<10)
+	_, err := rand.Read(longMsg)
+	s.Require().NoError(err)
+
+	// Чтобы потестить BLOB
+	hugeMsg := make([]byte, 20<<20)
+	_, err = rand.Read(hugeMsg)
+	s.Require().NoError(err)
+
+	s.Require().NoError(s.tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("id1"), Value: baseMsg},
+		fdb.KeyValue{Key: fdb.Key("id2"), Value: longMsg},
+		fdb.KeyValue{Key: fdb.Key("id3"), Value: hugeMsg},
+	))
+
+	if list, err := s.tbl.Select(s.tx).All(); s.NoError(err) {
+		s.Len(list, 3)
+
+		s.Equal("id1", list[0].Key.String())
+		s.Equal(baseMsg, list[0].Value)
+
+		s.Equal("id2", list[1].Key.String())
+		s.Equal(longMsg, list[1].Value)
+
+		s.Equal("id3", list[2].Key.String())
+		s.Equal(hugeMsg, list[2].Value)
+	}
+
+	s.Require().NoError(s.tbl.Select(s.tx).Delete())
+
+	if list, err := s.tbl.Select(s.tx).All(); s.NoError(err) {
+		s.Empty(list)
+	}
+
+	// Удаляем строки, чтобы автовакуум их собрал
+	s.Require().NoError(s.tx.Commit())
+
+	rep := s.checkVacuum(nil)
+	s.Equal(uint64(3), rep.Versions)
+	s.Equal(uint64(1), rep.BLOBs)
+	s.True(rep.Indexes > 0)
+	s.True(rep.Physical > 0)
+	s.True(rep.Rows >= rep.Versions+rep.Indexes)
+}
+
+func (s *ORMSuite) TestVacuumResume() {
+	s.Require().NoError(s.tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("msg1")},
+		fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("msg2")},
+		fdb.KeyValue{Key: fdb.Key("id3"), Value: []byte("msg3")},
+	))
+	s.Require().NoError(s.tbl.Select(s.tx).Delete())
+	s.Require().NoError(s.tx.Commit())
+
+	// Отмененный контекст - очистка даже не начинается
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rep, err := s.tbl.Vacuum(s.cn, orm.VacuumContext(ctx))
+	s.Require().Error(err)
+	s.True(errx.Is(err, orm.ErrVacuum))
+	s.True(errx.Is(err, context.Canceled))
+	s.Equal(uint64(0), rep.Physical)
+
+	// По одной строке за физ.транзакцию, прерываем во время паузы после первой
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	rep, err = s.tbl.Vacuum(s.cn, orm.VacuumBytes(1), orm.VacuumContext(ctx))
+	s.Require().Error(err)
+	s.True(errx.Is(err, context.DeadlineExceeded))
+	s.Equal(uint64(1), rep.Physical)
+	s.Equal(uint64(1), rep.Versions)
+
+	// Следующий запуск продолжает с места остановки и убирает за собой прогресс
+	rep = s.checkVacuum(nil)
+	s.Equal(uint64(2), rep.Versions)
+	s.True(rep.Indexes > 0)
+}
+
+func (s *ORMSuite) TestVacuumParallel() {
+	const count = 100
+
+	pairs := make([]fdb.KeyValue, count)
+	for i := range pairs {
+		pairs[i] = fdb.KeyValue{Key: fdb.Key(typex.NewUUID()), Value: []byte("message")}
+	}
+
+	s.Require().NoError(s.tbl.Upsert(s.tx, pairs...))
+	s.Require().NoError(s.tbl.Select(s.tx).Delete())
+	s.Require().NoError(s.tx.Commit())
+
+	rep, err := s.tbl.Vacuum(s.cn, orm.VacuumWorkers(4), orm.VacuumBytes(512))
+	s.Require().NoError(err)
+	s.Equal(uint64(count), rep.Versions)
+	s.True(rep.Indexes > 0)
+
+	// Повторная очистка ничего не находит, прогресс не остается
+	rep = s.checkVacuum(nil)
+	s.Equal(uint64(0), rep.Versions)
+	s.Equal(uint64(0), rep.Indexes)
+}
+
+func (s *ORMSuite) TestAutovacuum() {
+	s.Require().NoError(s.tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("msg1")},
+		fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("msg2")},
+	))
+	s.Require().NoError(s.tbl.Select(s.tx).Delete())
+	s.Require().NoError(s.tx.Commit())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	// Несколько экземпляров очищают коллекцию по очереди, через аренду
+	for i := 0; i < 3; i++ {
+		go s.tbl.Autovacuum(ctx, s.cn, orm.VacuumWait(100*time.Millisecond), orm.VacuumLease(time.Second))
+	}
+
+	<-ctx.Done()
+
+	// Все уже очищено автоматически
+	rep, err := s.tbl.Vacuum(s.cn)
+	s.Require().NoError(err)
+	s.Equal(uint64(0), rep.Versions)
+	s.Equal(uint64(0), rep.Indexes)
+}
+
+func (s *ORMSuite) TestRebuildIndex() {
+	plain := orm.NewTable(TestTable)
+	index := orm.NewTable(TestTable, orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:4], nil }))
+
+	// Строки записаны еще до появления индекса
+	s.Require().NoError(plain.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("msg1")},
+		fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("msg2")},
+		fdb.KeyValue{Key: fdb.Key("id3"), Value: []byte("msg3")},
+		fdb.KeyValue{Key: fdb.Key("id4"), Value: []byte("msg1")},
+		fdb.KeyValue{Key: fdb.Key("id5"), Value: []byte("msg2")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	count := func(tb orm.Table, prefix string) int {
+		tx := mvcc.Begin(s.cn)
+		defer tx.Cancel()
+		list, err := tb.Select(tx).ByIndex(TestIndex, fdb.Key(prefix)).All()
+		s.Require().NoError(err)
+		return len(list)
+	}
+
+	s.Equal(0, count(index, "msg"))
+
+	// Прерываем после первой пачки, прогресс сохраняется
+	ctx, cancel := context.WithCancel(context.Background())
+	rep, err := index.RebuildIndex(ctx, s.cn, TestIndex, orm.RebuildBatch(2), orm.OnRebuild(func(orm.IndexReport) { cancel() }))
+	s.Require().Error(err)
+	s.True(errx.Is(err, orm.ErrRebuildIndex))
+	s.True(errx.Is(err, context.Canceled))
+	s.Equal(uint64(1), rep.Batches)
+	s.Equal(uint64(2), rep.Added)
+
+	// Следующий запуск продолжает с места остановки
+	calls := 0
+	rep, err = index.RebuildIndex(context.Background(), s.cn, TestIndex, orm.RebuildBatch(2), orm.OnRebuild(func(orm.IndexReport) { calls++ }))
+	s.Require().NoError(err)
+	s.Equal(uint64(3), rep.Added)
+	s.Equal(uint64(0), rep.Removed)
+	s.Equal(int(rep.Batches), calls)
+	s.Equal(5, count(index, "msg"))
+	s.Equal(2, count(index, "msg1"))
+
+	// Повторный запуск ничего не меняет
+	rep, err = index.RebuildIndex(context.Background(), s.cn, TestIndex)
+	s.Require().NoError(err)
+	s.Equal(uint64(0), rep.Added)
+	s.Equal(uint64(0), rep.Removed)
+
+	// Индекс убрали из коллекции - его ключи удаляются
+	rep, err = plain.RebuildIndex(context.Background(), s.cn, TestIndex)
+	s.Require().NoError(err)
+	s.Equal(uint64(0), rep.Added)
+	s.Equal(uint64(5), rep.Removed)
+	s.Equal(0, count(index, "msg"))
+}
+
+func (s *ORMSuite) TestUniqueIndex() {
+	users := orm.NewTable(TestTable, orm.UniqueIndex(TestIndex, func(v []byte) (fdb.Key, error) { return v, nil }))
+
+	s.Require().NoError(users.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("a@mail")}))
+
+	// Значение уже занято другой строкой
+	err := users.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("a@mail")})
+	s.Require().Error(err)
+	s.True(errx.Is(err, orm.ErrDuplicate))
+
+	// Но та же строка может его сохранить или освободить
+	s.Require().NoError(users.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("a@mail")}))
+	s.Require().NoError(users.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("b@mail")}))
+	s.Require().NoError(users.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("a@mail")}))
+
+	// Значение занято еще не завершенной транзакцией
+	tx := mvcc.Begin(s.cn)
+	defer tx.Cancel()
+	err = users.Upsert(tx, fdb.KeyValue{Key: fdb.Key("id3"), Value: []byte("b@mail")})
+	s.Require().Error(err)
+	s.True(errx.Is(err, orm.ErrDuplicate))
+
+	if list, err := users.Select(s.tx).ByIndex(TestIndex, fdb.Key("b@mail")).All(); s.NoError(err) && s.Len(list, 1) {
+		s.Equal("id1", list[0].Key.String())
+	}
+}
+
+func (s *ORMSuite) TestPartialIndex() {
+	open := func(p fdb.KeyValue) (bool, error) { return strings.HasPrefix(string(p.Value), "open"), nil }
+	orders := orm.NewTable(TestTable,
+		orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v, nil }),
+		orm.IndexWhere(TestIndex, open),
+	)
+
+	ids := func(q orm.Query) []string {
+		list, err := q.All()
+		s.Require().NoError(err)
+		res := make([]string, len(list))
+		for i := range list {
+			res[i] = list[i].Key.String()
+		}
+		return res
+	}
+
+	s.Require().NoError(orders.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("o1"), Value: []byte("open:1")},
+		fdb.KeyValue{Key: fdb.Key("o2"), Value: []byte("done:2")},
+	))
+	s.Equal([]string{"o1"}, ids(orders.Select(s.tx).ByIndex(TestIndex, nil)))
+
+	// Строки переходят в индекс и обратно при обновлении
+	s.Require().NoError(orders.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("o1"), Value: []byte("done:1")},
+		fdb.KeyValue{Key: fdb.Key("o2"), Value: []byte("open:2")},
+	))
+	s.Equal([]string{"o2"}, ids(orders.Select(s.tx).ByIndex(TestIndex, nil)))
+
+	// То же условие доступно запросу
+	s.Nil(orders.IndexFilter(TestIndex2))
+	s.Equal([]string{"o2"}, ids(orders.Select(s.tx).Where(orders.IndexFilter(TestIndex))))
+
+	// Удаление строки вне индекса ничего в нем не трогает
+	s.Require().NoError(orders.Delete(s.tx, fdb.Key("o1")))
+	s.Equal([]string{"o2"}, ids(orders.Select(s.tx).ByIndex(TestIndex, nil)))
+
+	// После смены условия старые ключи не попадают в выборку, пока индекс не перестроен
+	closed := orm.NewTable(TestTable,
+		orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v, nil }),
+		orm.IndexWhere(TestIndex, func(p fdb.KeyValue) (bool, error) { return !strings.HasPrefix(string(p.Value), "open"), nil }),
+	)
+	s.Empty(ids(closed.Select(s.tx).ByIndex(TestIndex, nil)))
+	s.Empty(ids(closed.Select(s.tx).ByIndexRange(TestIndex, fdb.Key("a"), fdb.Key("z"))))
+}
+
+func (s *ORMSuite) TestCoveredIndex() {
+	docs := orm.NewTable(TestTable,
+		orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:3], nil }),
+		orm.IndexProject(TestIndex, func(v []byte) ([]byte, error) { return v[4:8], nil }),
+	)
+
+	s.Require().NoError(docs.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("doc:one:long body")},
+		fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("doc:two:long body")},
+	))
+
+	// Ответ из индекса: ключи строк и проекции
+	if list, err := docs.Select(s.tx).ByIndex(TestIndex, fdb.Key("doc")).Covered().All(); s.NoError(err) && s.Len(list, 2) {
+		s.Equal("id1", list[0].Key.String())
+		s.Equal([]byte("one:"), list[0].Value)
+		s.Equal("id2", list[1].Key.String())
+		s.Equal([]byte("two:"), list[1].Value)
+	}
+
+	// Обычный запрос по тому же индексу возвращает строки целиком
+	if list, err := docs.Select(s.tx).ByIndex(TestIndex, fdb.Key("doc")).All(); s.NoError(err) && s.Len(list, 2) {
+		s.Equal([]byte("doc:one:long body"), list[0].Value)
+	}
+
+	// Курсор помнит, что отвечает из индекса
+	q := docs.Select(s.tx).ByIndex(TestIndex, fdb.Key("doc")).Covered().Page(1)
+	if list, err := q.Next(); s.NoError(err) && s.Len(list, 1) {
+		s.Equal([]byte("one:"), list[0].Value)
+	}
+
+	cid, err := q.Save()
+	s.Require().NoError(err)
+
+	if q, err = docs.Cursor(s.tx, cid); s.NoError(err) {
+		if list, err := q.Next(); s.NoError(err) && s.Len(list, 1) {
+			s.Equal([]byte("two:"), list[0].Value)
+		}
+	}
+
+	// Проекции есть только у покрывающего индекса
+	_, err = docs.Select(s.tx).Covered().All()
+	s.Error(err)
+	_, err = s.tbl.Select(s.tx).ByIndex(TestIndex, nil).Covered().All()
+	s.Error(err)
+}
+
+func (s *ORMSuite) TestCoveredIndexRebuild() {
+	plain := orm.NewTable(TestTable, orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:3], nil }))
+	docs := orm.NewTable(TestTable,
+		orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:3], nil }),
+		orm.IndexProject(TestIndex, func(v []byte) ([]byte, error) { return v[4:8], nil }),
+	)
+
+	// Индекс заполнен еще до появления проекции, один из ключей строк начинается с 0xFF
+	s.Require().NoError(plain.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("doc:one:long body")},
+		fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("doc:two:long body")},
+		fdb.KeyValue{Key: fdb.Key("\xFFid3"), Value: []byte("doc:thr:long body")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	tx := mvcc.Begin(s.cn)
+	defer tx.Cancel()
+
+	// Старые строки индекса по-прежнему ведут к строкам коллекции, но ответить из индекса нельзя
+	if list, err := docs.Select(tx).ByIndex(TestIndex, fdb.Key("doc")).All(); s.NoError(err) && s.Len(list, 3) {
+		s.Equal("id1", list[0].Key.String())
+		s.Equal(fdb.Key("\xFFid3"), list[2].Key)
+		s.Equal([]byte("doc:thr:long body"), list[2].Value)
+	}
+
+	_, err := docs.Select(tx).ByIndex(TestIndex, fdb.Key("doc")).Covered().All()
+	s.Error(err)
+
+	// Новая строка записывается сразу с проекцией, строка индекса при этом остается прежней
+	s.Require().NoError(docs.Upsert(tx, fdb.KeyValue{Key: fdb.Key("\xFFid4"), Value: []byte("doc:fou:long body")}))
+
+	if list, err := plain.Select(tx).ByIndex(TestIndex, fdb.Key("doc")).All(); s.NoError(err) && s.Len(list, 4) {
+		s.Equal(fdb.Key("\xFFid4"), list[3].Key)
+	}
+
+	s.Require().NoError(tx.Commit())
+
+	rep, err := docs.CheckIndexes(context.Background(), s.cn)
+	s.Require().NoError(err)
+	s.Equal(orm.IndexCheck{Stale: 3}, rep.Indexes[TestIndex])
+
+	// Перестроение записывает недостающие проекции
+	irep, err := docs.RebuildIndex(context.Background(), s.cn, TestIndex)
+	s.Require().NoError(err)
+	s.Equal(uint64(3), irep.Added)
+	s.Equal(uint64(0), irep.Removed)
+
+	tx = mvcc.Begin(s.cn)
+	defer tx.Cancel()
+
+	if list, err := docs.Select(tx).ByIndex(TestIndex, fdb.Key("doc")).Covered().All(); s.NoError(err) && s.Len(list, 4) {
+		s.Equal("id1", list[0].Key.String())
+		s.Equal([]byte("one:"), list[0].Value)
+		s.Equal([]byte("two:"), list[1].Value)
+		s.Equal(fdb.Key("\xFFid3"), list[2].Key)
+		s.Equal([]byte("thr:"), list[2].Value)
+		s.Equal(fdb.Key("\xFFid4"), list[3].Key)
+		s.Equal([]byte("fou:"), list[3].Value)
+	}
+
+	tx.Cancel()
+
+	rep, err = docs.CheckIndexes(context.Background(), s.cn)
+	s.Require().NoError(err)
+	s.Empty(rep.Indexes)
+
+	// Без проекции в опциях ее строки считаются висячими, а перестроение их удаляет
+	rep, err = plain.CheckIndexes(context.Background(), s.cn)
+	s.Require().NoError(err)
+	s.Equal(orm.IndexCheck{Dangling: 4}, rep.Indexes[TestIndex])
+
+	irep, err = plain.RebuildIndex(context.Background(), s.cn, TestIndex)
+	s.Require().NoError(err)
+	s.Equal(uint64(4), irep.Removed)
+
+	rep, err = plain.CheckIndexes(context.Background(), s.cn)
+	s.Require().NoError(err)
+	s.Empty(rep.Indexes)
+}
+
+func (s *ORMSuite) TestCheckIndexes() {
+	good := orm.NewTable(TestTable, orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:4], nil }))
+	bad := orm.NewTable(TestTable, orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[1:], nil }))
+
+	// Строки с правильным индексом, без индекса и с ошибочным ключом индекса
+	s.Require().NoError(good.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id1"), Value: []byte("msg1")}))
+	s.Require().NoError(orm.NewTable(TestTable).Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id2"), Value: []byte("msg2")}))
+	s.Require().NoError(bad.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("id3"), Value: []byte("msg3")}))
+	s.Require().NoError(s.tx.Commit())
+
+	issues := make([]orm.IndexIssue, 0, 4)
+	rep, err := good.CheckIndexes(context.Background(), s.cn, orm.RebuildBatch(2), orm.OnIndexIssue(func(i orm.IndexIssue) {
+		issues = append(issues, i)
+	}))
+	s.Require().NoError(err)
+	s.Equal(uint64(3), rep.Rows)
+	s.Equal(uint64(2), rep.Entries)
+	s.Equal(uint64(0), rep.Repaired)
+	s.Equal(orm.IndexCheck{Missing: 2, Dangling: 1}, rep.Indexes[TestIndex])
+
+	if s.Len(issues, 3) {
+		s.Equal(orm.IssueMissing, issues[0].Kind)
+		s.Equal("id2", issues[0].ID.String())
+		s.Equal(orm.IssueDangling, issues[2].Kind)
+		s.Equal("id3", issues[2].ID.String())
+	}
+
+	// Исправление
+	rep, err = good.CheckIndexes(context.Background(), s.cn, orm.RepairIndexes())
+	s.Require().NoError(err)
+	s.Equal(uint64(3), rep.Repaired)
+
+	rep, err = good.CheckIndexes(context.Background(), s.cn)
+	s.Require().NoError(err)
+	s.Empty(rep.Indexes)
+	s.Equal(uint64(3), rep.Entries)
+
+	tx := mvcc.Begin(s.cn)
+	defer tx.Cancel()
+	list, err := good.Select(tx).ByIndex(TestIndex, fdb.Key("msg")).All()
+	s.Require().NoError(err)
+	s.Len(list, 3)
+}
+
+func (s *ORMSuite) TestRegistry() {
+	reg := orm.NewRegistry(s.cn)
+
+	// Новые имена получают номера по порядку, уже занятые вручную - закрепляются
+	users, err := reg.Register(orm.TableSchema{
+		Name:    "users",
+		Indexes: []orm.SchemaEntry{{Name: "email", Version: 1}, {Name: "phone", ID: 7, Version: 1}},
+		Queues:  []orm.SchemaEntry{{Name: "welcome", Version: 1}},
+	})
+	s.Require().NoError(err)
+	s.Equal(uint16(1), users.ID)
+	s.Equal(uint16(8), users.IndexID("email"))
+	s.Equal(uint16(7), users.IndexID("phone"))
+	s.Equal(uint16(1), users.QueueID("welcome"))
+
+	orders, err := reg.Table(orm.TableSchema{Name: "orders"})
+	s.Require().NoError(err)
+	s.Equal(uint16(2), orders.ID())
+
+	// Номера индексов в опциях сверяются со схемой
+	key := func(v []byte) (fdb.Key, error) { return v, nil }
+	_, err = reg.Table(users, orm.Index(8, key), orm.Counters(7))
+	s.NoError(err)
+	_, err = reg.Table(users, orm.Index(9, key))
+	s.True(errx.Is(err, orm.ErrConflict))
+	_, err = reg.Table(orm.TableSchema{Name: "orders"}, orm.Index(8, key))
+	s.True(errx.Is(err, orm.ErrConflict))
+
+	// Номера пакетных индексов сверяются, если они перечислены
+	batch := func([]byte) (map[uint16][]fdb.Key, error) { return nil, nil }
+	_, err = reg.Table(users, orm.BatchIndex(batch, 8))
+	s.True(errx.Is(err, orm.ErrConflict))
+	_, err = reg.Table(users, orm.BatchIndex(batch, 9))
+	s.True(errx.Is(err, orm.ErrConflict))
+
+	// Определение индекса без новой версии менять нельзя
+	_, err = reg.Table(users, orm.UniqueIndex(8, key))
+	s.True(errx.Is(err, orm.ErrConflict))
+	_, err = reg.Table(users, orm.Index(8, key), orm.IndexProject(8, func(v []byte) ([]byte, error) { return v, nil }))
+	s.True(errx.Is(err, orm.ErrConflict))
+	_, err = reg.Table(users, orm.Index(8, key), orm.Index(7, key))
+	s.NoError(err)
+
+	// Повторная регистрация возвращает те же номера, а новая версия сохраняется
+	again, err := reg.Register(orm.TableSchema{
+		Name:    "users",
+		Indexes: []orm.SchemaEntry{{Name: "phone", Version: 2}, {Name: "email", Version: 1}},
+	})
+	s.Require().NoError(err)
+	s.Equal(users.ID, again.ID)
+	s.Equal(uint16(7), again.IndexID("phone"))
+	s.Equal(uint16(8), again.IndexID("email"))
+
+	// С новой версией сохраняется новое определение
+	multi := func(v []byte) ([]fdb.Key, error) { return []fdb.Key{v}, nil }
+	_, err = reg.Table(again, orm.MultiIndex(7, multi))
+	s.NoError(err)
+	_, err = reg.Table(again, orm.Index(7, key))
+	s.True(errx.Is(err, orm.ErrConflict))
+
+	// Расхождения с сохраненной схемой
+	conflicts := []orm.TableSchema{
+		{Name: "users", ID: 5},
+		{Name: "goods", ID: 2},
+		{Name: "users", Indexes: []orm.SchemaEntry{{Name: "phone", Version: 1}}},
+		{Name: "users", Indexes: []orm.SchemaEntry{{Name: "login", ID: 8}}},
+	}
+
+	for i := range conflicts {
+		_, err = reg.Register(conflicts[i])
+		s.True(errx.Is(err, orm.ErrConflict), conflicts[i].Name)
+	}
+
+	// Ошибки описания
+	_, err = reg.Register(orm.TableSchema{Name: "bad", Queues: []orm.SchemaEntry{{Name: "q"}, {Name: "q"}}})
+	s.True(errx.Is(err, orm.ErrRegister))
+	s.False(errx.Is(err, orm.ErrConflict))
+
+	tables, err := reg.Tables()
+	s.Require().NoError(err)
+	s.Require().Len(tables, 2)
+	s.Equal("users", tables[0].Name)
+	s.Equal([]orm.SchemaEntry{{Name: "phone", ID: 7, Version: 2}, {Name: "email", ID: 8, Version: 1}}, tables[0].Indexes)
+	s.Equal([]orm.SchemaEntry{{Name: "welcome", ID: 1, Version: 1}}, tables[0].Queues)
+	s.Equal(orm.TableSchema{Name: "orders", ID: 2}, tables[1])
+}
+
+func (s *ORMSuite) TestMigrate() {
+	ctx := context.Background()
+	tbl := orm.NewTable(TestTable)
+	fail := errors.New("fail")
+	marks := make([]string, 0, 4)
+
+	fill := func(ctx context.Context, cn db.Connection, p orm.MigrationProgress) error {
+		return mvcc.WithTx(cn, func(tx mvcc.Tx) error {
+			p.Save(tx, []byte("k1"))
+			return tbl.Upsert(tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("v1")})
+		})
+	}
+
+	// Вторая миграция падает после сохранения прогресса
+	move := func(ctx context.Context, cn db.Connection, p orm.MigrationProgress) error {
+		marks = append(marks, string(p.Mark()))
+
+		if err := mvcc.WithTx(cn, func(tx mvcc.Tx) error {
+			p.Save(tx, []byte("half"))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if len(marks) == 1 {
+			return fail
+		}
+
+		return nil
+	}
+
+	list := []orm.Migration{
+		{Version: 2, Name: "move", Apply: move},
+		{Version: 1, Name: "fill", Apply: fill},
+	}
+
+	rep, err := orm.Migrate(ctx, s.cn, list)
+	s.True(errx.Is(err, fail))
+	s.Equal([]uint32{1}, rep.Applied)
+
+	// Повторный запуск продолжает с сохраненной отметки
+	rep, err = orm.Migrate(ctx, s.cn, list, orm.MigrateLease(time.Second))
+	s.Require().NoError(err)
+	s.Equal([]uint32{2}, rep.Applied)
+	s.Equal(uint64(1), rep.Skipped)
+	s.Equal([]string{"", "half"}, marks)
+
+	// Выполненные миграции больше не запускаются
+	rep, err = orm.Migrate(ctx, s.cn, list)
+	s.Require().NoError(err)
+	s.Empty(rep.Applied)
+	s.Equal(uint64(2), rep.Skipped)
+
+	list = append(list, orm.Migration{Version: 1, Name: "dup", Apply: fill})
+	_, err = orm.Migrate(ctx, s.cn, list)
+	s.True(errx.Is(err, orm.ErrMigrate))
+
+	// Пропущенная старая миграция не может выполниться после более новой
+	_, err = orm.Migrate(ctx, s.cn, []orm.Migration{{Version: 3, Apply: fill}, {Version: 5, Apply: fill}})
+	s.Require().NoError(err)
+	_, err = orm.Migrate(ctx, s.cn, []orm.Migration{{Version: 4, Apply: fill}})
+	s.True(errx.Is(err, orm.ErrMigrate))
+
+	// Пока аренда занята другим экземпляром, миграции ждут
+	wctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	_, err = orm.Migrate(ctx, s.cn, []orm.Migration{{Version: 6, Apply: func(context.Context, db.Connection, orm.MigrationProgress) error {
+		_, exp := orm.Migrate(wctx, s.cn, []orm.Migration{{Version: 7, Apply: fill}})
+		s.True(errx.Is(exp, context.DeadlineExceeded))
+		return nil
+	}}})
+	s.Require().NoError(err)
+}
+
+func (s *ORMSuite) TestTruncateDrop() {
+	tbl := orm.NewTable(TestTable, orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:1], nil }))
+
+	empty := func(q orm.Query) bool {
+		list, err := q.All()
+		s.Require().NoError(err)
+		return len(list) == 0
+	}
+
+	s.Require().NoError(tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("a1")},
+		fdb.KeyValue{Key: fdb.Key("k2"), Value: []byte("b2")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	// До коммита очистка видна только своей транзакции
+	tx := mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Truncate(tx))
+	s.True(empty(tbl.Select(tx)))
+	s.True(empty(tbl.Select(tx).ByIndex(TestIndex, fdb.Key("a"))))
+
+	s.tx = mvcc.Begin(s.cn)
+	list, err := tbl.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Len(list, 2)
+
+	s.Require().NoError(tx.Commit())
+	s.True(empty(tbl.Select(s.tx)))
+	s.True(empty(tbl.Select(s.tx).ByIndex(TestIndex, nil)))
+
+	// Физическое удаление не оставляет в БД ничего от коллекции
+	s.Require().NoError(tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("k3"), Value: []byte("c3")},
+		fdb.KeyValue{Key: fdb.Key("k4"), Value: []byte("d4")},
+		fdb.KeyValue{Key: fdb.Key("k5"), Value: []byte("e5")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	// Служебные отметки: завершенная очистка и прерванное перестроение индекса
+	_, err = tbl.Vacuum(s.cn)
+	s.Require().NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = tbl.RebuildIndex(ctx, s.cn, TestIndex, orm.RebuildBatch(2), orm.OnRebuild(func(orm.IndexReport) { cancel() }))
+	s.True(errx.Is(err, orm.ErrRebuildIndex))
+
+	s.Require().NoError(tbl.Drop(s.cn))
+
+	// Кроме статусов транзакций, ничего не остается: ни ключей коллекции, ни блокировок, ни реестра выполняемых транзакций
+	s.tx = mvcc.Begin(s.cn)
+	s.Require().NoError(s.cn.Read(func(r db.Reader) error {
+		for _, ns := range []byte{0, 2, 3, 4, 5} {
+			s.Empty(r.List(fdb.Key{ns}, fdb.Key{ns}, 0, false, false).GetSliceOrPanic(), "namespace %d", ns)
+		}
+		return nil
+	}))
+}
+
+func (s *ORMSuite) TestUpdate() {
+	tbl := orm.NewTable(TestTable, orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:1], nil }))
+
+	empty := func(q orm.Query) bool {
+		list, err := q.All()
+		s.Require().NoError(err)
+		return len(list) == 0
+	}
+
+	s.Require().NoError(tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("a0")},
+		fdb.KeyValue{Key: fdb.Key("k2"), Value: []byte("a0")},
+		fdb.KeyValue{Key: fdb.Key("k3"), Value: []byte("b0")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	inc := func(v []byte) ([]byte, error) { return []byte{v[0], v[1] + 1}, nil }
+
+	// Строку уже изменяет незавершенная транзакция - конфликт вместо потери ее изменений
+	tx1 := mvcc.Begin(s.cn)
+	tx2 := mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Update(tx1, fdb.Key("k1"), inc))
+	s.True(errx.Is(tbl.Update(tx2, fdb.Key("k1"), inc), mvcc.ErrConflict))
+	tx2.Cancel()
+	s.Require().NoError(tx1.Commit())
+
+	// Брошенная без Commit и Cancel транзакция перестает мешать, когда истекает AliveTimeout
+	lost := mvcc.Begin(s.cn)
+	tx3 := mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Update(lost, fdb.Key("k2"), inc))
+	s.True(errx.Is(tbl.Update(tx3, fdb.Key("k2"), inc), mvcc.ErrConflict))
+
+	alive := mvcc.AliveTimeout
+	mvcc.AliveTimeout = 10 * time.Millisecond
+	time.Sleep(50 * time.Millisecond)
+	s.NoError(tbl.Update(tx3, fdb.Key("k2"), inc))
+	mvcc.AliveTimeout = alive
+	s.Require().NoError(tx3.Commit())
+
+	tx4 := mvcc.Begin(s.cn)
+	defer tx4.Cancel()
+
+	if pair, err := tbl.Select(tx4).ByID(fdb.Key("k2")).First(); s.NoError(err) {
+		s.Equal([]byte("a1"), pair.Value)
+	}
+
+	// Параллельные изменения одной строки не теряются, конфликтующие повторяются
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				err := mvcc.WithTx(s.cn, func(tx mvcc.Tx) error { return tbl.Update(tx, fdb.Key("k1"), inc) })
+
+				if !errx.Is(err, mvcc.ErrConflict) {
+					s.NoError(err)
+					return
+				}
+
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	s.tx = mvcc.Begin(s.cn)
+	pair, err := tbl.Select(s.tx).ByID(fdb.Key("k1")).First()
+	s.Require().NoError(err)
+	s.Equal([]byte{'a', '0' + 11}, pair.Value)
+
+	// Изменение всех строк запроса, вместе с индексом
+	s.Require().NoError(tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("a")).Update(func(v []byte) ([]byte, error) {
+		return append([]byte("c"), v[1:]...), nil
+	}))
+
+	list, err := tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("c")).All()
+	s.Require().NoError(err)
+	s.Len(list, 2)
+	s.True(empty(tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("a"))))
+
+	// Ошибки обработчика и отсутствие строки
+	fail := errors.New("fail")
+	s.True(errx.Is(tbl.Update(s.tx, fdb.Key("k3"), func([]byte) ([]byte, error) { return nil, fail }), fail))
+	s.True(errx.Is(tbl.Update(s.tx, fdb.Key("k4"), inc), orm.ErrNotFound))
+}
+
+func (s *ORMSuite) TestCounters() {
+	tbl := orm.NewTable(TestTable,
+		orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:1], nil }),
+		orm.Index(TestIndex2, func(v []byte) (fdb.Key, error) { return v[1:], nil }),
+		orm.Counters(TestIndex),
+	)
+
+	count := func(q orm.Query) uint64 {
+		cnt, err := q.Count()
+		s.Require().NoError(err)
+		return cnt
+	}
+
+	s.Require().NoError(tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("a1")},
+		fdb.KeyValue{Key: fdb.Key("k2"), Value: []byte("a2")},
+		fdb.KeyValue{Key: fdb.Key("k3"), Value: []byte("b3")},
+	))
+
+	// До коммита счетчики не изменились
+	cnt, err := tbl.Count(s.tx)
+	s.Require().NoError(err)
+	s.Equal(uint64(0), cnt)
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal(uint64(3), count(tbl.Select(s.tx)))
+	s.Equal(uint64(2), count(tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("a"))))
+	s.Equal(uint64(3), count(tbl.Select(s.tx).ByIndexRange(TestIndex, fdb.Key("a"), fdb.Key("b"))))
+
+	// Без счетчика индекса и с условиями строки обходятся
+	s.Equal(uint64(1), count(tbl.Select(s.tx).ByIndex(TestIndex2, fdb.Key("3"))))
+	s.Equal(uint64(1), count(tbl.Select(s.tx).Where(func(p fdb.KeyValue) (bool, error) { return p.Value[0] == 'b', nil })))
+
+	_, err = tbl.IndexCount(s.tx, TestIndex2, nil, nil)
+	s.True(errx.Is(err, orm.ErrNoCounter))
+
+	// Обновление переносит строку между значениями, удаление и очистка уменьшают счетчики
+	s.Require().NoError(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("b1")}))
+	s.Require().NoError(tbl.Delete(s.tx, fdb.Key("k2")))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal(uint64(2), count(tbl.Select(s.tx)))
+	s.Equal(uint64(0), count(tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("a"))))
+	s.Equal(uint64(2), count(tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("b"))))
+
+	s.Require().NoError(tbl.Truncate(s.tx))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal(uint64(0), count(tbl.Select(s.tx)))
+	s.Equal(uint64(0), count(tbl.Select(s.tx).ByIndex(TestIndex, nil)))
+
+	// Незакоммиченную строку другой транзакции заменить нельзя: если та отменится, счетчик разойдется
+	tx := mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Insert(tx, fdb.KeyValue{Key: fdb.Key("k4"), Value: []byte("a4")}))
+	s.True(errx.Is(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k4"), Value: []byte("b4")}), mvcc.ErrConflict))
+	s.True(errx.Is(tbl.Delete(s.tx, fdb.Key("k4")), mvcc.ErrConflict))
+	tx.Cancel()
+
+	s.Require().NoError(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k4"), Value: []byte("b4")}))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal(uint64(1), count(tbl.Select(s.tx)))
+	s.Equal(uint64(1), count(tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("b"))))
+}
+
+func (s *ORMSuite) TestForeignKey() {
+	// Значение строки - префикс и ключ пользователя, без ключа ссылки нет
+	byUser := func(v []byte) (fdb.Key, error) { return v[2:], nil }
+	reset := func(v []byte) ([]byte, error) { return v[:2], nil }
+
+	users := orm.NewTable(TestTable)
+	orders := orm.NewTable(TestTable+1, orm.Index(TestIndex, byUser), orm.ForeignKey(TestIndex, users, orm.RefCascade, nil))
+	notes := orm.NewTable(TestTable+2, orm.Index(TestIndex, byUser), orm.ForeignKey(TestIndex, users, orm.RefSetNull, reset))
+	locks := orm.NewTable(TestTable+3, orm.Index(TestIndex, byUser), orm.ForeignKey(TestIndex, users, orm.RefRestrict, nil))
+
+	err := orders.Insert(s.tx, fdb.KeyValue{Key: fdb.Key("o1"), Value: []byte("o:u1")})
+	s.True(errx.Is(err, orm.ErrForeignKey))
+
+	s.Require().NoError(users.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("u1"), Value: []byte("user1")},
+		fdb.KeyValue{Key: fdb.Key("u10"), Value: []byte("user10")},
+		fdb.KeyValue{Key: fdb.Key("u2"), Value: []byte("user2")},
+	))
+	s.Require().NoError(orders.Insert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("o1"), Value: []byte("o:u1")},
+		fdb.KeyValue{Key: fdb.Key("o2"), Value: []byte("o:u10")},
+	))
+	s.Require().NoError(notes.Insert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("n1"), Value: []byte("n:u1")},
+		fdb.KeyValue{Key: fdb.Key("n2"), Value: []byte("n:")},
+	))
+	s.Require().NoError(locks.Insert(s.tx, fdb.KeyValue{Key: fdb.Key("l1"), Value: []byte("l:u2")}))
+
+	// Пока есть ссылка, удалить нельзя
+	s.True(errx.Is(users.Delete(s.tx, fdb.Key("u2")), orm.ErrForeignKey))
+
+	// Каскадное удаление и сброс ссылок затрагивают только точные совпадения ключа
+	s.Require().NoError(users.Delete(s.tx, fdb.Key("u1")))
+
+	list, err := orders.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Require().Len(list, 1)
+	s.Equal("o2", list[0].Key.String())
+
+	pair, err := notes.Select(s.tx).ByID(fdb.Key("n1")).First()
+	s.Require().NoError(err)
+	s.Equal([]byte("n:"), pair.Value)
+
+	// Изменение родительской строки ссылки не трогает
+	s.Require().NoError(users.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("u10"), Value: []byte("user10 new")}))
+	_, err = orders.Select(s.tx).ByID(fdb.Key("o2")).First()
+	s.Require().NoError(err)
+
+	s.Require().NoError(locks.Delete(s.tx, fdb.Key("l1")))
+	s.Require().NoError(users.Delete(s.tx, fdb.Key("u2")))
+}
+
+func (s *ORMSuite) TestForeignKeyConcurrent() {
+	byUser := func(v []byte) (fdb.Key, error) { return v[2:], nil }
+	users := orm.NewTable(TestTable)
+	orders := orm.NewTable(TestTable+1, orm.Index(TestIndex, byUser), orm.ForeignKey(TestIndex, users, orm.RefRestrict, nil))
+
+	s.Require().NoError(users.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("u1"), Value: []byte("user1")},
+		fdb.KeyValue{Key: fdb.Key("u2"), Value: []byte("user2")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	tx1 := mvcc.Begin(s.cn)
+	tx2 := mvcc.Begin(s.cn)
+	defer tx1.Cancel()
+	defer tx2.Cancel()
+
+	// Ссылка на строку, которую удаляет незавершенная транзакция
+	s.Require().NoError(users.Delete(tx1, fdb.Key("u1")))
+	err := orders.Insert(tx2, fdb.KeyValue{Key: fdb.Key("o1"), Value: []byte("o:u1")})
+	s.True(errx.Is(err, orm.ErrForeignKey, mvcc.ErrConflict))
+
+	// Удаление строки, на которую ссылается незавершенная транзакция
+	s.Require().NoError(orders.Insert(tx2, fdb.KeyValue{Key: fdb.Key("o2"), Value: []byte("o:u2")}))
+	err = users.Delete(tx1, fdb.Key("u2"))
+	s.True(errx.Is(err, orm.ErrForeignKey, mvcc.ErrConflict))
+
+	s.Require().NoError(tx1.Commit())
+	s.Require().NoError(tx2.Commit())
+
+	// Висячих ссылок не осталось
+	s.tx = mvcc.Begin(s.cn)
+
+	list, err := users.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Require().Len(list, 1)
+	s.Equal("u2", list[0].Key.String())
+
+	list, err = orders.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Require().Len(list, 1)
+	s.Equal("o2", list[0].Key.String())
+
+	err = orders.Insert(s.tx, fdb.KeyValue{Key: fdb.Key("o1"), Value: []byte("o:u1")})
+	s.True(errx.Is(err, orm.ErrForeignKey))
+	s.False(errx.Is(err, mvcc.ErrConflict))
+
+	// Ссылка из брошенной без Commit и Cancel транзакции мешает только до истечения AliveTimeout
+	lost := mvcc.Begin(s.cn)
+	s.Require().NoError(orders.Insert(lost, fdb.KeyValue{Key: fdb.Key("o3"), Value: []byte("o:u2")}))
+	s.Require().NoError(orders.Delete(s.tx, fdb.Key("o2")))
+
+	err = users.Delete(s.tx, fdb.Key("u2"))
+	s.True(errx.Is(err, orm.ErrForeignKey, mvcc.ErrConflict))
+
+	alive := mvcc.AliveTimeout
+	mvcc.AliveTimeout = 10 * time.Millisecond
+	time.Sleep(50 * time.Millisecond)
+	s.NoError(users.Delete(s.tx, fdb.Key("u2")))
+	mvcc.AliveTimeout = alive
+}
+
+func (s *ORMSuite) TestTriggers() {
+	fail := errors.New("forbidden")
+	audit := orm.NewTable(TestTable + 1)
+	kinds := make([]string, 0, 8)
+
+	veto := func(_ mvcc.Tx, c orm.RowChange) error {
+		if c.Kind != orm.ChangeDelete && strings.HasPrefix(string(c.New), "x") {
+			return fail
+		}
+		return nil
+	}
+
+	// Журнал изменений пишется в другую коллекцию в той же транзакции
+	trail := func(tx mvcc.Tx, c orm.RowChange) error {
+		kinds = append(kinds, fmt.Sprintf("%d:%s:%s:%s", c.Kind, c.Key, c.Old, c.New))
+		return audit.Upsert(tx, fdb.KeyValue{Key: fdb.Key(fmt.Sprintf("%s-%d", c.Key, len(kinds))), Value: []byte{c.Kind}})
+	}
+
+	tbl := orm.NewTable(TestTable,
+		orm.Index(TestIndex, func(v []byte) (fdb.Key, error) { return v[:1], nil }),
+		orm.BeforeTrigger(veto),
+		orm.AfterTrigger(trail),
+	)
+
+	s.Require().NoError(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("a1")}))
+	s.Require().NoError(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("b1")}))
+	s.Require().NoError(tbl.Update(s.tx, fdb.Key("k1"), func(v []byte) ([]byte, error) { return []byte("c1"), nil }))
+
+	// Запрещенная запись не попадает ни в коллекцию, ни в индекс
+	s.True(errx.Is(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k2"), Value: []byte("x2")}), fail))
+	s.True(errx.Is(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("x1")}), fail))
+
+	list, err := tbl.Select(s.tx).ByIndex(TestIndex, fdb.Key("x")).All()
+	s.Require().NoError(err)
+	s.Empty(list)
+
+	s.Require().NoError(tbl.Delete(s.tx, fdb.Key("k1")))
+	s.Require().NoError(s.tx.Commit())
+
+	s.Equal([]string{"1:k1::a1", "2:k1:a1:b1", "2:k1:b1:c1", "3:k1:c1:"}, kinds)
+
+	s.tx = mvcc.Begin(s.cn)
+	list, err = audit.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Len(list, 4)
+}
+
+func (s *ORMSuite) TestTriggerRetry() {
+	var tbl orm.Table
+
+	kinds := make([]byte, 0, 4)
+	retry := true
+
+	// При первой попытке строку удаляет другая транзакция, поэтому физическая транзакция записи повторяется
+	tbl = orm.NewTable(TestTable, orm.Counters(), orm.BeforeTrigger(func(_ mvcc.Tx, c orm.RowChange) error {
+		kinds = append(kinds, c.Kind)
+
+		if retry {
+			retry = false
+			tx := mvcc.Begin(s.cn)
+			s.Require().NoError(tbl.Delete(tx, c.Key))
+			s.Require().NoError(tx.Commit())
+		}
+
+		return nil
+	}))
+
+	s.Require().NoError(orm.NewTable(TestTable, orm.Counters()).Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("a1")}))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("b1")}))
+	s.Require().NoError(s.tx.Commit())
+
+	// Вторая попытка уже не видит удаленную строку, и старое значение первой попытки не учитывается
+	s.Equal([]byte{orm.ChangeUpdate, orm.ChangeDelete, orm.ChangeInsert}, kinds)
+
+	s.tx = mvcc.Begin(s.cn)
+
+	if cnt, err := tbl.Count(s.tx); s.NoError(err) {
+		s.Equal(uint64(1), cnt)
+	}
+}
+
+func (s *ORMSuite) TestView() {
+	// Значение строки - покупатель и сумма через двоеточие
+	byCustomer := func(v []byte) (fdb.Key, error) { return v[:bytes.IndexByte(v, ':')], nil }
+	amount := func(v []byte) (int64, error) { return strconv.ParseInt(string(v[bytes.IndexByte(v, ':')+1:]), 10, 64) }
+
+	tbl := orm.NewTable(TestTable)
+	view := orm.NewView(TestTable+1, tbl, byCustomer, orm.ViewSum(amount))
+
+	get := func(v orm.View, group string) orm.ViewRow {
+		row, err := v.Get(s.tx, fdb.Key(group))
+		s.Require().NoError(err)
+		return row
+	}
+
+	s.Require().NoError(tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("c1:10")},
+		fdb.KeyValue{Key: fdb.Key("k2"), Value: []byte("c1:5")},
+		fdb.KeyValue{Key: fdb.Key("k3"), Value: []byte("c2:7")},
+	))
+
+	// До коммита представление не изменилось
+	_, err := view.Get(s.tx, fdb.Key("c1"))
+	s.True(errx.Is(err, orm.ErrNotFound))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal(orm.ViewRow{Group: fdb.Key("c1"), Count: 2, Sums: []int64{15}}, get(view, "c1"))
+
+	list, err := view.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Require().Len(list, 2)
+
+	if row, err := orm.ParseViewRow(list[1]); s.NoError(err) {
+		s.Equal(orm.ViewRow{Group: fdb.Key("c2"), Count: 1, Sums: []int64{7}}, row)
+	}
+
+	if pair, err := view.Select(s.tx).Reverse().First(); s.NoError(err) {
+		s.Equal(fdb.Key("c2"), pair.Key)
+	}
+
+	// Изменение переносит строку в другую группу, опустевшая группа пропадает
+	s.Require().NoError(tbl.Update(s.tx, fdb.Key("k1"), func(v []byte) ([]byte, error) { return []byte("c2:20"), nil }))
+	s.Require().NoError(tbl.Delete(s.tx, fdb.Key("k2")))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	_, err = view.Get(s.tx, fdb.Key("c1"))
+	s.True(errx.Is(err, orm.ErrNotFound))
+	s.Equal(orm.ViewRow{Group: fdb.Key("c2"), Count: 2, Sums: []int64{27}}, get(view, "c2"))
+
+	// Представление по уже заполненной коллекции надо пересчитать
+	total := orm.NewView(TestTable+2, tbl, byCustomer)
+	_, err = total.Get(s.tx, fdb.Key("c2"))
+	s.True(errx.Is(err, orm.ErrNotFound))
+
+	if rep, err := total.Rebuild(context.Background(), s.cn); s.NoError(err) {
+		s.Equal(uint64(2), rep.Rows)
+		s.Equal(uint64(1), rep.Groups)
+	}
+
+	s.Equal(orm.ViewRow{Group: fdb.Key("c2"), Count: 2, Sums: []int64{}}, get(total, "c2"))
+
+	s.Require().NoError(tbl.Truncate(s.tx))
+	s.Require().NoError(s.tx.Commit())
 
-	// В базе ничего не должно оставаться
-	s.Require().NoError(s.cn.Read(func(r db.Reader) error {
-		fail := false
-		nkey := fdb.Key{0x00}
-		list := r.List(nkey, nkey, 1000, false, false).GetSliceOrPanic()
+	s.tx = mvcc.Begin(s.cn)
+	list, err = view.Select(s.tx).All()
+	s.Require().NoError(err)
+	s.Empty(list)
+}
+
+func (s *ORMSuite) TestViewRebuild() {
+	byCustomer := func(v []byte) (fdb.Key, error) { return v[:bytes.IndexByte(v, ':')], nil }
+
+	tbl := orm.NewTable(TestTable)
+	s.Require().NoError(tbl.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("k1"), Value: []byte("c1:10")},
+		fdb.KeyValue{Key: fdb.Key("k2"), Value: []byte("c2:5")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	view := orm.NewView(TestTable+1, tbl, byCustomer)
+
+	// Транзакция начата до пересчета и успела изменить коллекцию
+	tx := mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Upsert(tx, fdb.KeyValue{Key: fdb.Key("k3"), Value: []byte("c1:7")}))
+
+	type result struct {
+		rep orm.ViewReport
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		rep, err := view.Rebuild(context.Background(), s.cn)
+		done <- result{rep, err}
+	}()
+
+	// Пересчет взял аренду и ждет ее завершения, а закоммитить ее уже нельзя
+	time.Sleep(100 * time.Millisecond)
+	s.True(errx.Is(tx.Commit(), orm.ErrView))
+	tx.Cancel()
+
+	res := <-done
+	s.Require().NoError(res.err)
+	s.Equal(uint64(2), res.rep.Rows)
+	s.Equal(uint64(2), res.rep.Groups)
+
+	// После пересчета изменения снова учитываются, ровно один раз
+	s.tx = mvcc.Begin(s.cn)
+	s.Require().NoError(tbl.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("k3"), Value: []byte("c1:7")}))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+
+	if row, err := view.Get(s.tx, fdb.Key("c1")); s.NoError(err) {
+		s.Equal(int64(2), row.Count)
+	}
+
+	// Повторный пересчет переключает поколение и удаляет прежнее
+	if _, err := view.Rebuild(context.Background(), s.cn); s.NoError(err) {
+		list, err := view.Select(s.tx).All()
+		s.Require().NoError(err)
+		s.Len(list, 2)
+	}
+
+	if row, err := view.Get(s.tx, fdb.Key("c1")); s.NoError(err) {
+		s.Equal(int64(2), row.Count)
+	}
+}
+
+func (s *ORMSuite) TestTextSearch() {
+	docs := orm.NewTable(TestTable,
+		orm.TextIndex(TestIndex, func(v []byte) (string, error) { return string(v), nil },
+			orm.LowerCase(),
+			orm.StopWords("the", "a", "of"),
+			orm.Stemming(orm.SuffixStemmer(3, "s", "es", "ing")),
+		),
+	)
+
+	keys := func(q orm.Query) []string {
+		list, err := q.All()
+		s.Require().NoError(err)
 
+		res := make([]string, len(list))
 		for i := range list {
-			if pkey := list[i].Key[1:].String(); !ignore[pkey] {
-				glog.Errorf(">> %s", pkey)
-				fail = true
-			}
+			res[i] = list[i].Key.String()
 		}
+		return res
+	}
 
-		s.False(fail)
-		return nil
+	s.Require().NoError(docs.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("d1"), Value: []byte("The quick brown fox")},
+		fdb.KeyValue{Key: fdb.Key("d2"), Value: []byte("Quick foxes, quick dogs")},
+		fdb.KeyValue{Key: fdb.Key("d3"), Value: []byte("A lazy dog sleeping")},
+		fdb.KeyValue{Key: fdb.Key("d4"), Value: []byte("Brown bears of the north")},
+	))
+
+	// Больше вхождений - выше релевантность, при равной релевантности порядок по ключам
+	s.Equal([]string{"d2", "d1"}, keys(docs.Select(s.tx).ByText(TestIndex, orm.TextMatch("QUICK"))))
+	s.Equal([]string{"d1", "d2"}, keys(docs.Select(s.tx).ByText(TestIndex, orm.TextMatch("fox"))))
+	s.Equal([]string{"d1"}, keys(docs.Select(s.tx).ByText(TestIndex, orm.TextMatch("quick brown"))))
+	s.Equal([]string{"d3"}, keys(docs.Select(s.tx).ByText(TestIndex, orm.TextPrefix("lazy sle"))))
+	s.Empty(keys(docs.Select(s.tx).ByText(TestIndex, orm.TextMatch("the"))))
+
+	// Редкое слово весит больше
+	anyOf := orm.TextOr(orm.TextMatch("dog"), orm.TextMatch("bears"))
+	s.Equal([]string{"d4", "d2", "d3"}, keys(docs.Select(s.tx).ByText(TestIndex, anyOf)))
+	s.Equal([]string{"d3", "d2", "d4"}, keys(docs.Select(s.tx).ByText(TestIndex, anyOf).Reverse()))
+	s.Equal([]string{"d2"}, keys(docs.Select(s.tx).ByText(TestIndex, orm.TextAnd(anyOf, orm.TextPrefix("qui")))))
+
+	// Постраничная выборка продолжается в порядке релевантности
+	query := docs.Select(s.tx).ByText(TestIndex, anyOf).Page(2)
+
+	if list, err := query.Next(); s.NoError(err) && s.Len(list, 2) {
+		s.Equal(fdb.Key("d4"), list[0].Key)
+		s.Equal(fdb.Key("d2"), list[1].Key)
+	}
+
+	if list, err := query.Next(); s.NoError(err) && s.Len(list, 1) {
+		s.Equal(fdb.Key("d3"), list[0].Key)
+	}
+
+	s.Require().NoError(docs.Delete(s.tx, fdb.Key("d4")))
+	s.Equal([]string{"d2", "d3"}, keys(docs.Select(s.tx).ByText(TestIndex, anyOf).Where(func(p fdb.KeyValue) (bool, error) {
+		return !strings.Contains(string(p.Value), "north"), nil
+	})))
+
+	_, err := docs.Select(s.tx).ByText(TestIndex2, orm.TextMatch("fox")).All()
+	s.Error(err)
+}
+
+func (s *ORMSuite) TestGeo() {
+	places := orm.NewTable(TestTable, orm.GeoIndex(TestIndex, func(v []byte) (orm.GeoPoint, bool, error) {
+		parts := strings.Split(string(v), ",")
+
+		if len(parts) != 2 {
+			return orm.GeoPoint{}, false, nil
+		}
+
+		lat, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return orm.GeoPoint{}, false, err
+		}
+
+		lon, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return orm.GeoPoint{}, false, err
+		}
+
+		return orm.GeoPoint{Lat: lat, Lon: lon}, true, nil
 	}))
+
+	keys := func(q orm.Query) []string {
+		list, err := q.All()
+		s.Require().NoError(err)
+
+		res := make([]string, len(list))
+		for i := range list {
+			res[i] = list[i].Key.String()
+		}
+		return res
+	}
+
+	s.Require().NoError(places.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("kremlin"), Value: []byte("55.7520,37.6175")},
+		fdb.KeyValue{Key: fdb.Key("theatre"), Value: []byte("55.7601,37.6186")},
+		fdb.KeyValue{Key: fdb.Key("airport"), Value: []byte("55.9726,37.4146")},
+		fdb.KeyValue{Key: fdb.Key("spb"), Value: []byte("59.9343,30.3351")},
+		fdb.KeyValue{Key: fdb.Key("suva"), Value: []byte("-18.1416,178.4419")},
+		fdb.KeyValue{Key: fdb.Key("taveuni"), Value: []byte("-16.9900,-179.9000")},
+		fdb.KeyValue{Key: fdb.Key("nowhere"), Value: []byte("")},
+	))
+
+	center := orm.GeoPoint{Lat: 55.7520, Lon: 37.6175}
+	s.InDelta(901, orm.GeoDistance(center, orm.GeoPoint{Lat: 55.7601, Lon: 37.6186}), 5)
+
+	// Прямоугольник и круг
+	moscow := keys(places.Select(s.tx).ByGeoBox(TestIndex, orm.GeoPoint{Lat: 55.5, Lon: 37.3}, orm.GeoPoint{Lat: 56.1, Lon: 37.9}))
+	s.ElementsMatch([]string{"kremlin", "theatre", "airport"}, moscow)
+	s.ElementsMatch([]string{"kremlin", "theatre"}, keys(places.Select(s.tx).ByGeoRadius(TestIndex, center, 1000)))
+	s.ElementsMatch([]string{"kremlin"}, keys(places.Select(s.tx).ByGeoRadius(TestIndex, center, 800)))
+	s.ElementsMatch([]string{"kremlin", "theatre", "airport"}, keys(places.Select(s.tx).ByGeoRadius(TestIndex, center, 30000)))
+	s.ElementsMatch([]string{"kremlin", "theatre", "airport", "spb"}, keys(places.Select(s.tx).ByGeoRadius(TestIndex, center, 700000)))
+
+	// Через 180-й меридиан
+	s.ElementsMatch([]string{"suva", "taveuni"}, keys(places.Select(s.tx).ByGeoBox(TestIndex, orm.GeoPoint{Lat: -19, Lon: 178}, orm.GeoPoint{Lat: -16, Lon: -179})))
+	s.ElementsMatch([]string{"suva", "taveuni"}, keys(places.Select(s.tx).ByGeoRadius(TestIndex, orm.GeoPoint{Lat: -17.5, Lon: 179.9}, 200000)))
+
+	// Обратный порядок и постраничная выборка
+	back := keys(places.Select(s.tx).ByGeoBox(TestIndex, orm.GeoPoint{Lat: 55.5, Lon: 37.3}, orm.GeoPoint{Lat: 56.1, Lon: 37.9}).Reverse())
+	s.Equal([]string{moscow[2], moscow[1], moscow[0]}, back)
+
+	query := places.Select(s.tx).ByGeoBox(TestIndex, orm.GeoPoint{Lat: 55.5, Lon: 37.3}, orm.GeoPoint{Lat: 56.1, Lon: 37.9}).Page(2)
+
+	if list, err := query.Next(); s.NoError(err) && s.Len(list, 2) {
+		s.Equal(moscow[0], list[0].Key.String())
+		s.Equal(moscow[1], list[1].Key.String())
+	}
+
+	if list, err := query.Next(); s.NoError(err) && s.Len(list, 1) {
+		s.Equal(moscow[2], list[0].Key.String())
+	}
+
+	s.Require().NoError(places.Delete(s.tx, fdb.Key("theatre")))
+	s.Equal([]string{"kremlin"}, keys(places.Select(s.tx).ByGeoRadius(TestIndex, center, 1000)))
+
+	_, err := orm.GeoKey(orm.GeoPoint{Lat: 91, Lon: 0})
+	s.Error(err)
 }
 
-func (s *ORMSuite) TestWorkflow() {
-	// Обычное значение
-	baseMsg := []byte("msg")
+func (s *ORMSuite) TestVector() {
+	// Значение строки - координаты вектора через запятую, прочерк - вектора нет
+	parse := func(v []byte) ([]float32, error) {
+		if string(v) == "-" {
+			return nil, nil
+		}
 
-	// Чтобы потестить сжатие в gzip
-	longMsg := make([]byte, 20<<10)
-	_, err := rand.Read(longMsg)
-	s.Require().NoError(err)
+		parts := strings.Split(string(v), ",")
+		vec := make([]float32, len(parts))
 
-	// Чтобы потестить BLOB
-	hugeMsg := make([]byte, 20<<20)
-	_, err = rand.Read(hugeMsg)
-	s.Require().NoError(err)
+		for i := range parts {
+			num, err := strconv.ParseFloat(parts[i], 32)
+			if err != nil {
+				return nil, err
+			}
+			vec[i] = float32(num)
+		}
 
-	s.Require().NoError(s.tbl.Upsert(s.tx,
-		fdb.KeyValue{Key: fdb.Key("id1"), Value: baseMsg},
-		fdb.KeyValue{Key: fdb.Key("id2"), Value: longMsg},
-		fdb.KeyValue{Key: fdb.Key("id3"), Value: hugeMsg},
+		return vec, nil
+	}
+
+	keys := func(q orm.Query) []string {
+		list, err := q.All()
+		s.Require().NoError(err)
+
+		res := make([]string, len(list))
+		for i := range list {
+			res[i] = list[i].Key.String()
+		}
+		return res
+	}
+
+	docs := orm.NewTable(TestTable)
+	exact := orm.NewVectorIndex(TestTable+1, docs, 2, orm.VectorL2, parse)
+	angle := orm.NewVectorIndex(TestTable+2, docs, 2, orm.VectorCosine, parse, orm.VectorLists(2))
+
+	s.Require().NoError(docs.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("a"), Value: []byte("1,0")},
+		fdb.KeyValue{Key: fdb.Key("b"), Value: []byte("0,1")},
+		fdb.KeyValue{Key: fdb.Key("c"), Value: []byte("2,2")},
+		fdb.KeyValue{Key: fdb.Key("d"), Value: []byte("-1,0")},
+		fdb.KeyValue{Key: fdb.Key("e"), Value: []byte("-")},
+		fdb.KeyValue{Key: fdb.Key("f"), Value: []byte("10,0")},
 	))
 
-	if list, err := s.tbl.Select(s.tx).All(); s.NoError(err) {
-		s.Len(list, 3)
+	// Поиск видит изменения своей транзакции, пока списков нет - он точный
+	query := []float32{1, 0.1}
+	s.Equal([]string{"a", "b", "d", "c", "f"}, keys(exact.Nearest(s.tx, query)))
+	s.Equal([]string{"f", "c", "d", "b", "a"}, keys(exact.Nearest(s.tx, query).Reverse()))
+	s.Equal([]string{"a", "b"}, keys(exact.Nearest(s.tx, query).Limit(2)))
+	s.Equal([]string{"a", "d"}, keys(exact.Nearest(s.tx, query).Where(func(p fdb.KeyValue) (bool, error) {
+		return string(p.Value) != "0,1", nil
+	}).Limit(2)))
 
-		s.Equal("id1", list[0].Key.String())
-		s.Equal(baseMsg, list[0].Value)
+	// При равном расстоянии - порядок ключей
+	s.Equal([]string{"a", "f", "c", "b", "d"}, keys(angle.Nearest(s.tx, []float32{1, 0})))
+	s.InDelta(1-math.Sqrt2/2, orm.VectorDistance(orm.VectorCosine, []float32{1, 0}, []float32{2, 2}), 1e-9)
 
-		s.Equal("id2", list[1].Key.String())
-		s.Equal(longMsg, list[1].Value)
+	page := exact.Nearest(s.tx, query).Page(2)
 
-		s.Equal("id3", list[2].Key.String())
-		s.Equal(hugeMsg, list[2].Value)
+	if list, err := page.Next(); s.NoError(err) && s.Len(list, 2) {
+		s.Equal(fdb.Key("a"), list[0].Key)
+		s.Equal(fdb.Key("b"), list[1].Key)
 	}
 
-	s.Require().NoError(s.tbl.Select(s.tx).Delete())
+	if list, err := page.Next(); s.NoError(err) && s.Len(list, 2) {
+		s.Equal(fdb.Key("d"), list[0].Key)
+		s.Equal(fdb.Key("c"), list[1].Key)
+	}
 
-	if list, err := s.tbl.Select(s.tx).All(); s.NoError(err) {
-		s.Empty(list)
+	if list, err := page.Next(); s.NoError(err) && s.Len(list, 1) {
+		s.Equal(fdb.Key("f"), list[0].Key)
 	}
 
-	// Удаляем строки, чтобы автовакуум их собрал
+	s.Require().NoError(docs.Update(s.tx, fdb.Key("c"), func(v []byte) ([]byte, error) { return []byte("-2,-2"), nil }))
+	s.Require().NoError(docs.Delete(s.tx, fdb.Key("a")))
+	s.Equal([]string{"b", "d", "c", "f"}, keys(exact.Nearest(s.tx, query)))
 	s.Require().NoError(s.tx.Commit())
 
-	s.checkVacuum(nil)
+	// Разбиение на списки: поиск только по ближайшему списку, или по нескольким
+	if rep, err := angle.Rebuild(context.Background(), s.cn); s.NoError(err) {
+		s.Equal(uint64(5), rep.Rows)
+		s.Equal(uint64(4), rep.Vectors)
+		s.Equal(uint64(2), rep.Lists)
+	}
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal([]string{"f", "b"}, keys(angle.Nearest(s.tx, query)))
+	s.Equal([]string{"f", "b", "c", "d"}, keys(angle.Nearest(s.tx, query, orm.VectorProbes(2))))
+
+	// Новые векторы попадают в список ближайшего центра
+	s.Require().NoError(docs.Insert(s.tx, fdb.KeyValue{Key: fdb.Key("g"), Value: []byte("0,-1")}))
+	s.Equal([]string{"g", "c", "d"}, keys(angle.Nearest(s.tx, []float32{0, -1})))
+
+	// Размерность проверяется и у строк, и у запросов
+	s.Error(docs.Upsert(s.tx, fdb.KeyValue{Key: fdb.Key("h"), Value: []byte("1,2,3")}))
+	_, err := exact.Nearest(s.tx, []float32{1}).All()
+	s.Error(err)
+
+	s.Require().NoError(docs.Truncate(s.tx))
+	s.Empty(keys(exact.Nearest(s.tx, query)))
+	s.Empty(keys(angle.Nearest(s.tx, query, orm.VectorProbes(2))))
+	s.Require().NoError(s.tx.Commit())
+
+	// Удаленные векторы остаются устаревшими версиями до очистки
+	if rep, err := exact.Vacuum(s.cn); s.NoError(err) {
+		s.NotZero(rep.Versions)
+	}
+
+	if rep, err := exact.Vacuum(s.cn); s.NoError(err) {
+		s.Zero(rep.Versions)
+	}
+
+	s.Require().NoError(angle.Drop(s.cn))
+	s.tx = mvcc.Begin(s.cn)
+}
+
+func (s *ORMSuite) TestVectorRebuild() {
+	parse := func(v []byte) ([]float32, error) {
+		parts := strings.Split(string(v), ",")
+		vec := make([]float32, len(parts))
+
+		for i := range parts {
+			num, err := strconv.ParseFloat(parts[i], 32)
+			if err != nil {
+				return nil, err
+			}
+			vec[i] = float32(num)
+		}
+
+		return vec, nil
+	}
+
+	keys := func(q orm.Query) []string {
+		list, err := q.All()
+		s.Require().NoError(err)
+
+		res := make([]string, len(list))
+		for i := range list {
+			res[i] = list[i].Key.String()
+		}
+		return res
+	}
+
+	docs := orm.NewTable(TestTable)
+	angle := orm.NewVectorIndex(TestTable+1, docs, 2, orm.VectorCosine, parse, orm.VectorLists(2))
+
+	s.Require().NoError(docs.Upsert(s.tx,
+		fdb.KeyValue{Key: fdb.Key("a"), Value: []byte("1,0")},
+		fdb.KeyValue{Key: fdb.Key("b"), Value: []byte("0,1")},
+		fdb.KeyValue{Key: fdb.Key("c"), Value: []byte("-1,0")},
+	))
+	s.Require().NoError(s.tx.Commit())
+
+	// Вставка начата до пересчета и записала вектор в прежнее поколение
+	tx := mvcc.Begin(s.cn)
+	s.Require().NoError(docs.Insert(tx, fdb.KeyValue{Key: fdb.Key("d"), Value: []byte("0,-1")}))
+
+	type result struct {
+		rep orm.VectorReport
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		rep, err := angle.Rebuild(context.Background(), s.cn)
+		done <- result{rep, err}
+	}()
+
+	// Пересчет взял аренду и ждет ее завершения, а закоммитить ее уже нельзя
+	time.Sleep(100 * time.Millisecond)
+	s.True(errx.Is(tx.Commit(), orm.ErrVector))
+	tx.Cancel()
+
+	res := <-done
+	s.Require().NoError(res.err)
+	s.Equal(uint64(3), res.rep.Rows)
+	s.Equal(uint64(3), res.rep.Vectors)
+	s.Equal(uint64(2), res.rep.Lists)
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal([]string{"a", "b", "c"}, keys(angle.Nearest(s.tx, []float32{1, 0}, orm.VectorProbes(2))))
+
+	// После пересчета вставка попадает в новое поколение, к центрам нового разбиения
+	s.Require().NoError(docs.Insert(s.tx, fdb.KeyValue{Key: fdb.Key("d"), Value: []byte("0,-1")}))
+	s.Require().NoError(s.tx.Commit())
+
+	s.tx = mvcc.Begin(s.cn)
+	s.Equal([]string{"a", "b", "d", "c"}, keys(angle.Nearest(s.tx, []float32{1, 0}, orm.VectorProbes(2))))
+}
+
+type typedUser struct {
+	Name string   `json:"name"`
+	City string   `json:"city"`
+	Tags []string `json:"tags"`
+}
+
+func (s *ORMSuite) TestTyped() {
+	const byCity uint16 = 1
+	const byTag uint16 = 2
+
+	codec := orm.NewJSONCodec[typedUser]()
+	users := orm.NewTypedTable[string](TestTable, codec,
+		orm.IndexOf(codec, byCity, func(u typedUser) (fdb.Key, error) {
+			return fdb.Key(u.City), nil
+		}),
+		orm.MultiIndexOf(codec, byTag, func(u typedUser) ([]fdb.Key, error) {
+			keys := make([]fdb.Key, len(u.Tags))
+			for i := range u.Tags {
+				keys[i] = fdb.Key(u.Tags[i])
+			}
+			return keys, nil
+		}),
+	)
+
+	s.Require().NoError(users.Put(s.tx, "id1", typedUser{Name: "Ann", City: "Moscow", Tags: []string{"a", "b"}}))
+	s.Require().NoError(users.Put(s.tx, "id2", typedUser{Name: "Bob", City: "Kazan", Tags: []string{"b"}}))
+	s.Require().NoError(users.Put(s.tx, "id3", typedUser{Name: "Eve", City: "Moscow"}))
+
+	if user, err := users.Get(s.tx, "id2"); s.NoError(err) {
+		s.Equal("Bob", user.Name)
+		s.Equal([]string{"b"}, user.Tags)
+	}
+
+	if _, err := users.Get(s.tx, "id4"); s.Error(err) {
+		s.True(errx.Is(err, orm.ErrNotFound))
+	}
+
+	if err := users.Insert(s.tx, "id1", typedUser{Name: "Dup"}); s.Error(err) {
+		s.True(errx.Is(err, orm.ErrDuplicate))
+	}
+
+	if list, err := users.Select(s.tx).ByIndex(byCity, fdb.Key("Moscow")).All(); s.NoError(err) {
+		s.Len(list, 2)
+		s.Equal("id1", list[0].Key)
+		s.Equal("Ann", list[0].Value.Name)
+		s.Equal("id3", list[1].Key)
+		s.Equal("Eve", list[1].Value.Name)
+	}
+
+	if list, err := users.Select(s.tx).ByIndex(byTag, fdb.Key("b")).Where(func(k string, u typedUser) (bool, error) {
+		return u.City == "Kazan", nil
+	}).All(); s.NoError(err) {
+		s.Len(list, 1)
+		s.Equal("id2", list[0].Key)
+	}
+
+	s.Require().NoError(users.Delete(s.tx, "id1", "id3"))
+
+	if item, err := users.Select(s.tx).First(); s.NoError(err) {
+		s.Equal("id2", item.Key)
+		s.Equal("Kazan", item.Value.City)
+	}
+
+	// Остальные кодеки
+	proto := orm.NewProtoCodec[wrapperspb.StringValue]()
+	if buf, err := proto.Encode(wrapperspb.String("proto")); s.NoError(err) {
+		if val, err := proto.Decode(buf); s.NoError(err) {
+			s.Equal("proto", val.GetValue())
+		}
+	}
+
+	flat := orm.NewFlatCodec(func(buf []byte) *models.ValueT { return models.GetRootAsValue(buf, 0).UnPack() })
+	if buf, err := flat.Encode(&models.ValueT{Size: 5, Data: []byte("flat!")}); s.NoError(err) {
+		if val, err := flat.Decode(buf); s.NoError(err) {
+			s.Equal(uint32(5), val.Size)
+			s.Equal([]byte("flat!"), val.Data)
+		}
+	}
+}
+
+type taggedOrder struct {
+	Client  string    `json:"client" fdbx:"index=1;index=3"`
+	Amount  int64     `json:"amount" fdbx:"index=2,order=desc;index=3,pos=100"`
+	Labels  []string  `json:"labels" fdbx:"index=4"`
+	Created time.Time `json:"created" fdbx:"index=5"`
+}
+
+func (s *ORMSuite) TestTagIndex() {
+	codec := orm.NewJSONCodec[taggedOrder]()
+	index, err := orm.TagIndex(codec)
+	s.Require().NoError(err)
+
+	_, err = orm.TagIndex(orm.NewJSONCodec[struct {
+		Bad map[string]string `fdbx:"index=1"`
+	}]())
+	s.True(errx.Is(err, orm.ErrTagIndex))
+
+	now := time.Now()
+	orders := orm.NewTypedTable[string](TestTable, codec, index)
+
+	s.Require().NoError(orders.Put(s.tx, "o1", taggedOrder{Client: "a", Amount: -5, Labels: []string{"x", "y"}, Created: now}))
+	s.Require().NoError(orders.Put(s.tx, "o2", taggedOrder{Client: "b", Amount: 10, Labels: []string{"y"}, Created: now.Add(time.Hour)}))
+	s.Require().NoError(orders.Put(s.tx, "o3", taggedOrder{Client: "a", Amount: 7, Created: now.Add(2 * time.Hour)}))
+
+	ids := func(list []orm.TypedPair[string, taggedOrder], err error) []string {
+		s.Require().NoError(err)
+		res := make([]string, len(list))
+		for i := range list {
+			res[i] = list[i].Key
+		}
+		return res
+	}
+
+	// Простой индекс по строке
+	s.Equal([]string{"o1", "o3"}, ids(orders.Select(s.tx).ByIndex(1, keys.AppendString(nil, "a")).All()))
+
+	// Обратный порядок по числу, включая отрицательные
+	s.Equal([]string{"o2", "o3", "o1"}, ids(orders.Select(s.tx).ByIndexRange(2, nil, fdb.Key{0xFF}).All()))
+
+	// Составной индекс: клиент, затем сумма
+	s.Equal([]string{"o1", "o3"}, ids(orders.Select(s.tx).ByIndex(3, keys.AppendString(nil, "a")).All()))
+
+	// Индекс по срезу
+	s.Equal([]string{"o1", "o2"}, ids(orders.Select(s.tx).ByIndex(4, keys.AppendString(nil, "y")).All()))
+	s.Equal([]string{"o1"}, ids(orders.Select(s.tx).ByIndex(4, keys.AppendString(nil, "x")).All()))
+
+	// Индекс по времени
+	from := keys.AppendTime(nil, now.Add(30*time.Minute))
+	s.Equal([]string{"o2", "o3"}, ids(orders.Select(s.tx).ByIndexRange(5, from, fdb.Key{0xFF}).All()))
 }
 
 func (s *ORMSuite) TestCount() {
@@ -755,3 +2324,43 @@ func BenchmarkCount(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkCounters(b *testing.B) {
+	const count = 400000
+	batchSize := 10000
+
+	cn, err := db.Connect(TestDB)
+
+	require.NoError(b, err)
+	require.NoError(b, cn.Clear())
+
+	tx := mvcc.Begin(cn)
+
+	tbl := orm.NewTable(TestTable, orm.Counters())
+
+	for k := 0; k < count/batchSize; k++ {
+		batch := make([]fdb.KeyValue, batchSize)
+		for i := 0; i < batchSize; i++ {
+			uid := []byte(typex.NewUUID())
+			batch[i] = fdb.KeyValue{Key: uid, Value: uid}
+		}
+		require.NoError(b, tbl.Upsert(tx, batch...))
+	}
+
+	require.NoError(b, tx.Commit())
+
+	b.Run("Count", func(br *testing.B) {
+		tx := mvcc.Begin(cn)
+		defer tx.Cancel()
+
+		for i := 0; i < br.N; i++ {
+			cnt, err := tbl.Select(tx).Count()
+			if err != nil {
+				b.Fatalf("err = %+v", err)
+			}
+			if int(cnt) != count {
+				b.Fatalf("act %d != exp %d", cnt, count)
+			}
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/golang/glog"
+	"github.com/shestakovda/errx"
+	"github.com/shestakovda/typex"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	Migrate - выполнение миграций, которые еще не были выполнены в этой БД, по возрастанию номеров.
+
+	Миграции выполняются под общей для всего кластера арендой: пока один экземпляр их выполняет,
+	остальные ждут и после освобождения аренды видят их уже выполненными. Номера выполненных миграций
+	сохраняются в БД, поэтому каждая миграция выполняется ровно один раз. Из списка можно убирать
+	старые выполненные миграции, но новая миграция не может быть меньше последней выполненной.
+
+	Миграция может сохранять прогресс через MigrationProgress.Save в своих транзакциях. Если миграцию
+	прервать, следующий запуск получит последнюю сохраненную отметку, а работа после нее будет повторена.
+
+	Поддерживает опцию MigrateLease.
+*/
+func Migrate(ctx context.Context, cn db.Connection, list []Migration, args ...Option) (rep MigrateReport, err error) {
+	var done map[uint32]struct{}
+	var last uint32
+
+	start := time.Now()
+	opts := getOpts(args)
+	holder := []byte(typex.NewUUID())
+
+	defer func() { rep.Duration = time.Since(start) }()
+
+	if list, err = sortMigrations(list); err != nil {
+		return rep, ErrMigrate.WithReason(err)
+	}
+
+	if err = waitLease(ctx, cn, migrateKey(mLease, nil), holder, opts.mlease); err != nil {
+		return rep, ErrMigrate.WithReason(err)
+	}
+
+	lost := make(chan struct{})
+	stop := make(chan struct{})
+	mctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Если аренду продлить не удалось, миграции прерываем - их продолжит тот, кто аренду забрал
+	go func() {
+		defer close(stop)
+		renewLease(mctx, cancel, lost, cn, migrateKey(mLease, nil), holder, opts.mlease)
+	}()
+
+	defer func() {
+		// Дожидаемся остановки продления, чтобы оно не вернуло аренду после освобождения
+		cancel()
+		<-stop
+
+		if exp := dropLease(cn, migrateKey(mLease, nil), holder); exp != nil && err == nil {
+			err = ErrMigrate.WithReason(exp)
+		}
+	}()
+
+	if done, last, err = loadMigrations(cn); err != nil {
+		return rep, ErrMigrate.WithReason(err)
+	}
+
+	for i := range list {
+		if _, ok := done[list[i].Version]; ok {
+			rep.Skipped++
+			continue
+		}
+
+		if list[i].Version < last {
+			return rep, ErrMigrate.WithDetail("Migration %d is older than applied %d", list[i].Version, last)
+		}
+
+		if err = applyMigration(mctx, cn, holder, list[i]); err != nil {
+			dbg := errx.Debug{"version": list[i].Version, "name": list[i].Name}
+
+			select {
+			case <-lost:
+				return rep, ErrMigrate.WithReason(err).WithDetail("Migration lease lost").WithDebug(dbg)
+			default:
+				return rep, ErrMigrate.WithReason(err).WithDebug(dbg)
+			}
+		}
+
+		rep.Applied = append(rep.Applied, list[i].Version)
+		glog.Errorf("Applied migration %d %s", list[i].Version, list[i].Name)
+	}
+
+	return rep, nil
+}
+
+// sortMigrations - проверка списка миграций и сортировка копии по номерам
+func sortMigrations(list []Migration) ([]Migration, error) {
+	res := make([]Migration, len(list))
+	copy(res, list)
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+
+	for i := range res {
+		if res[i].Version == 0 {
+			return nil, ErrMigrate.WithDetail("Migration version is required")
+		}
+
+		if res[i].Apply == nil {
+			return nil, ErrMigrate.WithDetail("Migration %d has no handler", res[i].Version)
+		}
+
+		if i > 0 && res[i].Version == res[i-1].Version {
+			return nil, ErrMigrate.WithDetail("Duplicate migration version %d", res[i].Version)
+		}
+	}
+
+	return res, nil
+}
+
+// applyMigration - выполнение миграции и сохранение ее номера, если аренда все еще наша
+func applyMigration(ctx context.Context, cn db.Connection, holder []byte, m Migration) (err error) {
+	var mark []byte
+
+	ver := migrateVersion(m.Version)
+
+	if err = cn.Read(func(r db.Reader) error {
+		mark = r.Data(migrateKey(mMark, ver))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err = m.Apply(ctx, cn, &migrationProgress{key: migrateKey(mMark, ver), mark: mark}); err != nil {
+		return err
+	}
+
+	return cn.Write(func(w db.Writer) error {
+		if val := w.Data(migrateKey(mLease, nil)); len(val) <= 8 || !bytes.Equal(val[8:], holder) {
+			return ErrMigrate.WithDetail("Migration lease lost")
+		}
+
+		w.Delete(migrateKey(mMark, ver))
+		w.Upsert(fdb.KeyValue{Key: migrateKey(mDone, ver), Value: fdbx.Time2Byte(time.Now())})
+		return nil
+	})
+}
+
+// loadMigrations - номера выполненных миграций и наибольший из них
+func loadMigrations(cn db.Connection) (res map[uint32]struct{}, last uint32, err error) {
+	skey := migrateKey(mDone, nil)
+	res = make(map[uint32]struct{}, 64)
+
+	if err = cn.Read(func(r db.Reader) error {
+		rows := r.List(skey, skey, 0, false, false).GetSliceOrPanic()
+
+		for i := range rows {
+			// Пропускаем байт базы данных, он добавляется при выборке
+			if key := rows[i].Key[1:]; len(key) == len(skey)+4 {
+				ver := binary.BigEndian.Uint32(key[len(skey):])
+				res[ver] = struct{}{}
+
+				if ver > last {
+					last = ver
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	return res, last, nil
+}
+
+// migrationProgress - отметка прогресса миграции в служебном ключе
+type migrationProgress struct {
+	key  fdb.Key
+	mark []byte
+}
+
+func (p *migrationProgress) Mark() []byte { return p.mark }
+
+func (p *migrationProgress) Save(tx mvcc.Tx, mark []byte) {
+	val := append([]byte(nil), mark...)
+
+	tx.OnCommit(func(w db.Writer) error {
+		w.Upsert(fdb.KeyValue{Key: p.key, Value: val})
+		return nil
+	})
+}
+
+// migrateKey - служебный ключ миграций, вне пространства версий строк служебной коллекции
+func migrateKey(kind byte, key fdb.Key) fdb.Key {
+	tbid := regTable
+	return mvcc.WrapKey(fdbx.AppendLeft(key, byte(tbid>>8), byte(tbid), nsMigrate, kind))
+}
+
+func migrateVersion(ver uint32) fdb.Key {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], ver)
+	return buf[:]
+}
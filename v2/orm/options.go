@@ -1,6 +1,8 @@
 package orm
 
 import (
+	"context"
+	"math"
 	"sync"
 	"time"
 
@@ -11,6 +13,9 @@ import (
 
 func getOpts(args []Option) (o options) {
 	o.refresh = time.Minute
+	o.vlease = time.Minute
+	o.mlease = time.Minute
+	o.rlease = time.Minute
 
 	for i := range args {
 		args[i](&o)
@@ -28,19 +33,45 @@ func getOpts(args []Option) (o options) {
 }
 
 type options struct {
-	prefix   []byte
-	reverse  bool
-	creator  string
-	lastkey  fdb.Key
-	vwait    time.Duration
-	delay    time.Duration
-	refresh  time.Duration
-	task     *models.TaskT
-	headers  map[string]string
-	indexes  map[uint16]IndexKey
-	multidx  map[uint16]IndexMultiKey
-	batchidx []IndexBatchKey
-	wait     *sync.WaitGroup
+	prefix    []byte
+	reverse   bool
+	creator   string
+	lastkey   fdb.Key
+	vwait     time.Duration
+	vrate     int
+	vsize     int
+	vworkers  int
+	vlease    time.Duration
+	vwins     []vacuumWindow
+	vctx      context.Context
+	rbatch    int
+	onRebuild RebuildHandler
+	repair    bool
+	onIssue   IssueHandler
+	mlease    time.Duration
+	rlease    time.Duration
+	counters  bool
+	counted   map[uint16]struct{}
+	foreign   map[uint16]foreignKey
+	before    []Trigger
+	after     []Trigger
+	measures  []ViewMeasure
+	lists     int
+	probes    int
+	delay     time.Duration
+	refresh   time.Duration
+	task      *models.TaskT
+	headers   map[string]string
+	indexes   map[uint16]IndexKey
+	multidx   map[uint16]IndexMultiKey
+	analyzers map[uint16][]Analyzer
+	unique    map[uint16]struct{}
+	partial   map[uint16]Filter
+	project   map[uint16]IndexProjection
+	covered   bool
+	batchidx  []IndexBatchKey
+	batchids  map[uint16]struct{}
+	wait      *sync.WaitGroup
 }
 
 func Index(id uint16, f IndexKey) Option {
@@ -54,6 +85,73 @@ func Index(id uint16, f IndexKey) Option {
 	}
 }
 
+// UniqueIndex - индекс, значение которого может быть только у одной строки коллекции
+// При попытке вставить или обновить строку с уже занятым значением возвращается ErrDuplicate
+func UniqueIndex(id uint16, f IndexKey) Option {
+	return func(o *options) {
+		if f == nil {
+			return
+		}
+
+		if o.unique == nil {
+			o.unique = make(map[uint16]struct{}, 8)
+		}
+
+		o.unique[id] = struct{}{}
+		Index(id, f)(o)
+	}
+}
+
+/*
+	IndexWhere - условие частичного индекса: ключи индекса получают только строки, для которых оно выполнено.
+
+	Подходит для индекса любого вида. При обновлении строки ее ключи удаляются или добавляются
+	в зависимости от нового значения. Условие получает пользовательский ключ и значение строки,
+	а через Table.IndexFilter его можно применить к запросу.
+
+	Запросы ByIndex, ByIndexRange и геозапросы проверяют условие на уже загруженных для ответа строках,
+	поэтому не вернут строки, ключи которых остались в индексе после смены условия и до RebuildIndex.
+	Запрос Covered строки коллекции не читает и отвечает по содержимому индекса как есть.
+*/
+func IndexWhere(id uint16, f Filter) Option {
+	return func(o *options) {
+		if f == nil {
+			return
+		}
+
+		if o.partial == nil {
+			o.partial = make(map[uint16]Filter, 8)
+		}
+
+		o.partial[id] = f
+	}
+}
+
+/*
+	IndexProject - проекция значения строки, которая хранится рядом со строками индекса (покрывающий индекс).
+
+	Подходит для индекса любого вида. Запрос по такому индексу с модификатором Covered
+	не загружает строки коллекции, а возвращает их ключи с проекциями вместо значений.
+	Проекции лежат в своем пространстве по тем же ключам, что и строки индекса, поэтому сами строки индекса
+	не меняются. Проекция пересчитывается при каждом обновлении строки, а для уже записанных строк - через RebuildIndex.
+	Если проекцию добавили к уже заполненному индексу, обычные запросы по нему работают и до перестроения,
+	а запрос Covered вернет ошибку, пока RebuildIndex не запишет недостающие проекции.
+	Если проекцию убрали, ее строки удалит RebuildIndex этого индекса.
+*/
+func IndexProject(id uint16, f IndexProjection) Option {
+	return func(o *options) {
+		if f == nil {
+			return
+		}
+
+		if o.project == nil {
+			o.project = make(map[uint16]IndexProjection, 8)
+		}
+
+		o.project[id] = f
+	}
+}
+
 func MultiIndex(id uint16, f IndexMultiKey) Option {
 	return func(o *options) {
 		if o.multidx == nil {
@@ -65,11 +163,80 @@ func MultiIndex(id uint16, f IndexMultiKey) Option {
 	}
 }
 
+/*
+	TextIndex - полнотекстовый индекс по тексту строки. Текст разбивается на слова, которые обрабатываются
+	анализаторами по порядку и сохраняются как ключи индекса вместе с числом вхождений, для ранжирования.
+
+	Индекс строится как MultiIndex, поэтому перестраивается и проверяется как обычный.
+	Поиск по нему - через Query.ByText, слова запроса обрабатываются теми же анализаторами.
+*/
+func TextIndex(id uint16, f IndexText, args ...Analyzer) Option {
+	return func(o *options) {
+		if f == nil {
+			return
+		}
+
+		if o.analyzers == nil {
+			o.analyzers = make(map[uint16][]Analyzer, 1)
+		}
+
+		o.analyzers[id] = args
+
+		MultiIndex(id, func(v []byte) ([]fdb.Key, error) {
+			text, err := f(v)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return textKeys(Tokenize(text, args...)), nil
+		})(o)
+	}
+}
+
+/*
+	GeoIndex - геоиндекс по точке строки, ключ индекса строится через GeoKey.
+
+	Индекс строится как обычный Index, поэтому перестраивается и проверяется так же.
+	Выборки по нему - через Query.ByGeoBox и Query.ByGeoRadius.
+*/
+func GeoIndex(id uint16, f IndexGeo) Option {
+	if f == nil {
+		return Index(id, nil)
+	}
+
+	return Index(id, func(v []byte) (fdb.Key, error) {
+		p, ok, err := f(v)
+
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return GeoKey(p)
+	})
+}
+
+/*
+	BatchIndex - ключи сразу нескольких индексов по значению строки.
+
+	Номера индексов из функции заранее не известны, поэтому их можно перечислить в ids,
+	чтобы Registry.Table проверил их по реестру схемы вместе с остальными.
+*/
 //goland:noinspection GoUnusedExportedFunction
-func BatchIndex(f IndexBatchKey) Option {
+func BatchIndex(f IndexBatchKey, ids ...uint16) Option {
 	return func(o *options) {
-		if f != nil {
-			o.batchidx = append(o.batchidx, f)
+		if f == nil {
+			return
+		}
+
+		o.batchidx = append(o.batchidx, f)
+
+		if len(ids) > 0 && o.batchids == nil {
+			o.batchids = make(map[uint16]struct{}, len(ids))
+		}
+
+		for i := range ids {
+			o.batchids[ids[i]] = struct{}{}
 		}
 	}
 }
@@ -91,6 +258,200 @@ func VacuumWait(d time.Duration) Option {
 	}
 }
 
+// VacuumWindow - окно времени автоочистки, смещения от начала суток по местному времени
+// Окно может переходить через полночь, например с 22:00 до 04:00. Можно указать несколько окон.
+func VacuumWindow(from, to time.Duration) Option {
+	return func(o *options) {
+		if from >= 0 && to >= 0 && from < 24*time.Hour && to < 24*time.Hour && from != to {
+			o.vwins = append(o.vwins, vacuumWindow{from: from, to: to})
+		}
+	}
+}
+
+// VacuumLease - срок аренды автоочистки. Если экземпляр не продлил аренду, очистку продолжит другой
+func VacuumLease(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.vlease = d
+		}
+	}
+}
+
+// VacuumRate - ограничение скорости очистки, строк в секунду
+func VacuumRate(rows int) Option {
+	return func(o *options) {
+		if rows > 0 {
+			o.vrate = rows
+		}
+	}
+}
+
+// VacuumBytes - ограничение объема выборки очистки в одной физической транзакции, в байтах
+func VacuumBytes(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.vsize = size
+		}
+	}
+}
+
+// VacuumWorkers - кол-во потоков очистки, префиксы коллекции делятся между ними по границам шардов FDB
+func VacuumWorkers(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.vworkers = n
+		}
+	}
+}
+
+// VacuumContext - контекст очистки, при его отмене очистка прерывается с сохранением прогресса
+func VacuumContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.vctx = ctx
+	}
+}
+
+// RebuildBatch - кол-во строк, обрабатываемых за одну транзакцию перестроения или проверки индексов
+func RebuildBatch(n int) Option {
+	return func(o *options) {
+		if n > 1 {
+			o.rbatch = n
+		}
+	}
+}
+
+// OnRebuild - обработчик прогресса перестроения индекса, вызывается после каждой пачки
+func OnRebuild(hdl RebuildHandler) Option {
+	return func(o *options) {
+		o.onRebuild = hdl
+	}
+}
+
+// RepairIndexes - исправление найденных при проверке расхождений индексов
+func RepairIndexes() Option {
+	return func(o *options) {
+		o.repair = true
+	}
+}
+
+// OnIndexIssue - обработчик расхождений, найденных при проверке индексов
+func OnIndexIssue(hdl IssueHandler) Option {
+	return func(o *options) {
+		o.onIssue = hdl
+	}
+}
+
+/*
+	Counters - счетчики строк коллекции и строк по значениям указанных индексов.
+
+	Счетчики изменяются атомарно при коммите транзакций, поэтому Table.Count и Query.Count без условий
+	отвечают за постоянное время, без обхода строк. Атомарные прибавления не конфликтуют между собой,
+	поэтому параллельные вставки в коллекцию не мешают друг другу.
+
+	Счетчики учитывают только переходы между версиями завершенных транзакций: замена или удаление строки,
+	которую изменяет еще не завершенная транзакция, возвращает ErrConflict, как Update. Так же ведут себя
+	коллекции с представлениями и индексами векторов.
+*/
+func Counters(ids ...uint16) Option {
+	return func(o *options) {
+		o.counters = true
+
+		if o.counted == nil {
+			o.counted = make(map[uint16]struct{}, len(ids))
+		}
+
+		for i := range ids {
+			o.counted[ids[i]] = struct{}{}
+		}
+	}
+}
+
+/*
+	ForeignKey - ключи индекса id ссылаются на ключи строк коллекции parent, сам индекс объявляется отдельно.
+
+	Вставка строки с ключом индекса, которого нет среди строк parent, вернет ошибку ErrForeignKey.
+	При удалении строки parent ссылающиеся на нее строки обрабатываются по правилу policy в той же транзакции:
+	RefRestrict запрещает удаление, RefCascade удаляет их, а RefSetNull изменяет функцией reset, которая
+	должна убрать ссылку из значения. Для остальных правил reset не нужен.
+	Коллекция parent должна быть создана через NewTable раньше ссылающейся коллекции.
+*/
+func ForeignKey(id uint16, parent Table, policy byte, reset UpdateHandler) Option {
+	return func(o *options) {
+		if o.foreign == nil {
+			o.foreign = make(map[uint16]foreignKey, 1)
+		}
+
+		o.foreign[id] = foreignKey{parent: parent, policy: policy, reset: reset}
+	}
+}
+
+// BeforeTrigger - триггер до записи строки коллекции, в той же физической транзакции. Ошибка отменяет запись
+func BeforeTrigger(hdl Trigger) Option {
+	return func(o *options) {
+		o.before = append(o.before, hdl)
+	}
+}
+
+// AfterTrigger - триггер после записи строки коллекции. Ошибка возвращается из операции, а транзакцию надо отменить
+func AfterTrigger(hdl Trigger) Option {
+	return func(o *options) {
+		o.after = append(o.after, hdl)
+	}
+}
+
+// ViewSum - суммы показателей строк в материализованном представлении, в порядке аргументов
+func ViewSum(hdl ...ViewMeasure) Option {
+	return func(o *options) {
+		o.measures = append(o.measures, hdl...)
+	}
+}
+
+/*
+	VectorLists - кол-во списков приближенного поиска в индексе векторов (IVF).
+
+	При Rebuild векторы разбиваются на списки по ближайшему центру, а поиск просматривает только
+	списки с ближайшими к запросу центрами, см. VectorProbes. Без опции индекс не делится на списки и поиск точный.
+*/
+func VectorLists(n int) Option {
+	return func(o *options) {
+		if n > 0 && n <= math.MaxUint16 {
+			o.lists = n
+		}
+	}
+}
+
+// VectorProbes - кол-во просматриваемых списков при поиске в индексе векторов. Чем больше, тем точнее и медленнее
+func VectorProbes(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.probes = n
+		}
+	}
+}
+
+// MigrateLease - срок аренды выполнения миграций. Если экземпляр не продлил аренду, миграции продолжит другой
+func MigrateLease(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.mlease = d
+		}
+	}
+}
+
+/*
+	RebuildLease - срок аренды пересчета материализованного представления или индекса векторов.
+
+	Пока аренда действует, транзакции, изменившие исходную коллекцию, не могут закоммититься.
+	Если экземпляр упал и не продлил аренду, по ее истечении коллекцию снова можно изменять.
+*/
+func RebuildLease(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.rlease = d
+		}
+	}
+}
+
 func Prefix(p []byte) Option {
 	return func(o *options) {
 		o.prefix = p
@@ -145,6 +506,12 @@ func Waiter(w *sync.WaitGroup) Option {
 	}
 }
 
+func covered(c bool) Option {
+	return func(o *options) {
+		o.covered = c
+	}
+}
+
 func metatask(t *models.TaskT) Option {
 	return func(o *options) {
 		o.task = t
@@ -198,3 +565,57 @@ func (o options) multi2batch() IndexBatchKey {
 		return res, nil
 	}
 }
+
+/*
+	indexDefs - номера всех индексов, упомянутых в опциях, с отпечатком их определения.
+
+	Отпечаток - набор признаков вида индекса (простой, множественный, пакетный, текстовый)
+	и его свойств (уникальный, частичный, покрывающий). Функции ключей в него не входят,
+	их изменение отмечается версией в реестре схемы. У индексов, которые только упомянуты
+	счетчиками или внешними ключами, отпечаток нулевой.
+*/
+func (o options) indexDefs() map[uint16]uint32 {
+	res := make(map[uint16]uint32, len(o.indexes)+len(o.multidx)+len(o.batchids))
+
+	for idx := range o.indexes {
+		res[idx] |= dIndex
+	}
+
+	for idx := range o.multidx {
+		res[idx] |= dMulti
+	}
+
+	for idx := range o.batchids {
+		res[idx] |= dBatch
+	}
+
+	for idx := range o.analyzers {
+		res[idx] |= dText
+	}
+
+	for idx := range o.unique {
+		res[idx] |= dUnique
+	}
+
+	for idx := range o.partial {
+		res[idx] |= dPartial
+	}
+
+	for idx := range o.project {
+		res[idx] |= dProject
+	}
+
+	for idx := range o.counted {
+		if _, ok := res[idx]; !ok {
+			res[idx] = 0
+		}
+	}
+
+	for idx := range o.foreign {
+		if _, ok := res[idx]; !ok {
+			res[idx] = 0
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,139 @@
+package orm
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+)
+
+type v1TypedQuery[K TypedKey, V any] struct {
+	q     Query
+	codec Codec[V]
+}
+
+func (q *v1TypedQuery[K, V]) Query() Query { return q.q }
+
+func (q *v1TypedQuery[K, V]) Empty() bool { return q.q.Empty() }
+
+func (q *v1TypedQuery[K, V]) ByID(ids ...K) TypedQuery[K, V] {
+	q.q.ByID(typedKeys(ids)...)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) PossibleByID(ids ...K) TypedQuery[K, V] {
+	q.q.PossibleByID(typedKeys(ids)...)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) ByIndex(idx uint16, prefix fdb.Key) TypedQuery[K, V] {
+	q.q.ByIndex(idx, prefix)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) ByIndexRange(idx uint16, from, last fdb.Key) TypedQuery[K, V] {
+	q.q.ByIndexRange(idx, from, last)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) BySelector(sel Selector) TypedQuery[K, V] {
+	q.q.BySelector(sel)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) Forward() TypedQuery[K, V] {
+	q.q.Forward()
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) Reverse() TypedQuery[K, V] {
+	q.q.Reverse()
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) Page(size int) TypedQuery[K, V] {
+	q.q.Page(size)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) Limit(lim int) TypedQuery[K, V] {
+	q.q.Limit(lim)
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) Where(hdl TypedFilter[K, V]) TypedQuery[K, V] {
+	if hdl == nil {
+		return q
+	}
+
+	q.q.Where(func(pair fdb.KeyValue) (_ bool, err error) {
+		var item TypedPair[K, V]
+
+		if item, err = q.decode(pair); err != nil {
+			return false, ErrFilter.WithReason(err)
+		}
+
+		return hdl(item.Key, item.Value)
+	})
+	return q
+}
+
+func (q *v1TypedQuery[K, V]) All() (_ []TypedPair[K, V], err error) {
+	var list []fdb.KeyValue
+
+	if list, err = q.q.All(); err != nil {
+		return nil, err
+	}
+
+	return q.decodeList(list, ErrAll)
+}
+
+func (q *v1TypedQuery[K, V]) Next() (_ []TypedPair[K, V], err error) {
+	var list []fdb.KeyValue
+
+	if list, err = q.q.Next(); err != nil {
+		return nil, err
+	}
+
+	return q.decodeList(list, ErrNext)
+}
+
+func (q *v1TypedQuery[K, V]) First() (_ TypedPair[K, V], err error) {
+	var pair fdb.KeyValue
+	var item TypedPair[K, V]
+
+	if pair, err = q.q.First(); err != nil {
+		return item, err
+	}
+
+	if item, err = q.decode(pair); err != nil {
+		return item, ErrFirst.WithReason(err)
+	}
+
+	return item, nil
+}
+
+func (q *v1TypedQuery[K, V]) Delete() error { return q.q.Delete() }
+
+func (q *v1TypedQuery[K, V]) Save() (string, error) { return q.q.Save() }
+
+func (q *v1TypedQuery[K, V]) Drop() error { return q.q.Drop() }
+
+func (q *v1TypedQuery[K, V]) decode(pair fdb.KeyValue) (item TypedPair[K, V], err error) {
+	if item.Value, err = q.codec.Decode(pair.Value); err != nil {
+		return item, ErrValUnpack.WithReason(err)
+	}
+
+	item.Key = K(pair.Key)
+	return item, nil
+}
+
+func (q *v1TypedQuery[K, V]) decodeList(list []fdb.KeyValue, kind errx.Error) (_ []TypedPair[K, V], err error) {
+	res := make([]TypedPair[K, V], len(list))
+
+	for i := range list {
+		if res[i], err = q.decode(list[i]); err != nil {
+			return nil, kind.WithReason(err)
+		}
+	}
+
+	return res, nil
+}
@@ -6,6 +6,7 @@ import (
 	"sync/atomic"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
 	"github.com/shestakovda/typex"
 
 	"github.com/shestakovda/fdbx/v2"
@@ -56,6 +57,7 @@ func loadQuery(tb Table, tx mvcc.Tx, id string) (_ Query, err error) {
 	q.idxtype = cur.IdxType
 	q.idxfrom = cur.IdxFrom
 	q.idxlast = cur.IdxLast
+	q.covered = cur.Covered
 	q.setLastKey(cur.LastKey)
 
 	if q.idxtype > 0 {
@@ -79,6 +81,7 @@ type v1Query struct {
 	limit   uint32
 	empty   bool
 	reverse bool
+	covered bool
 	idxtype uint16
 	idxfrom fdb.Key
 	idxlast fdb.Key
@@ -102,6 +105,12 @@ func (q *v1Query) Reverse() Query {
 	return q
 }
 
+// Covered - ответ только из покрывающего индекса: ключи строк с проекциями вместо значений
+func (q *v1Query) Covered() Query {
+	q.covered = true
+	return q
+}
+
 func (q *v1Query) Limit(lim int) Query {
 	if lim > 0 {
 		q.limit = uint32(lim)
@@ -182,6 +191,39 @@ func (q *v1Query) First() (fdb.KeyValue, error) {
 	return fdb.KeyValue{}, ErrNotFound.WithStack()
 }
 
+/*
+	Count - кол-во строк запроса.
+
+	Запрос без условий Where, ограничений и курсора отвечает по счетчикам коллекции, если они ведутся
+	(см. опцию Counters), иначе строки запроса обходятся целиком. Счетчики не учитывают изменения текущей транзакции.
+*/
+func (q *v1Query) Count() (res uint64, err error) {
+	if len(q.filters) == 0 && q.limit == 0 && atomic.LoadUint32(&q.size) == 0 && len(q.getLastKey()) == 0 {
+		switch sel := q.selector.(type) {
+		case nil, *fullSelector:
+			res, err = q.tb.Count(q.tx)
+		case *indexSelector:
+			res, err = q.tb.IndexCount(q.tx, sel.idx, sel.from, sel.last)
+		default:
+			err = ErrNoCounter.WithStack()
+		}
+
+		if err == nil {
+			return res, nil
+		}
+
+		if !errx.Is(err, ErrNoCounter) {
+			return 0, ErrCount.WithReason(err)
+		}
+	}
+
+	if err = q.Agg(Count(&res)); err != nil {
+		return 0, ErrCount.WithReason(err)
+	}
+
+	return res, nil
+}
+
 func (q *v1Query) Agg(funcs ...Aggregator) (err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -225,6 +267,31 @@ func (q *v1Query) Delete() (err error) {
 	return nil
 }
 
+/*
+	Update - изменение значений всех выбранных строк, каждая строка изменяется через Table.Update.
+
+	Строки, удаленные между выборкой и изменением, пропускаются. Условия Where при изменении повторно не проверяются.
+*/
+func (q *v1Query) Update(hdl UpdateHandler) (err error) {
+	var list []fdb.KeyValue
+
+	if list, err = q.All(); err != nil {
+		return ErrUpdate.WithReason(err)
+	}
+
+	for i := range list {
+		if err = q.tb.Update(q.tx, list[i].Key, hdl); err != nil {
+			if errx.Is(err, ErrNotFound) {
+				continue
+			}
+
+			return ErrUpdate.WithReason(err)
+		}
+	}
+
+	return nil
+}
+
 func (q *v1Query) BySelector(sel Selector) Query {
 	q.selector = sel
 	return q
@@ -252,6 +319,21 @@ func (q *v1Query) ByIndexRange(idx uint16, from, last fdb.Key) Query {
 	return q.BySelector(NewIndexRangeSelector(q.tx, idx, from, last))
 }
 
+// ByText - полнотекстовый поиск по индексу idx, строки идут по убыванию релевантности
+func (q *v1Query) ByText(idx uint16, query TextQuery) Query {
+	return q.BySelector(NewTextSelector(q.tx, idx, query))
+}
+
+// ByGeoBox - строки с точками геоиндекса idx в прямоугольнике от min до max
+func (q *v1Query) ByGeoBox(idx uint16, min, max GeoPoint) Query {
+	return q.BySelector(NewGeoBoxSelector(q.tx, idx, min, max))
+}
+
+// ByGeoRadius - строки с точками геоиндекса idx не дальше radius метров от center
+func (q *v1Query) ByGeoRadius(idx uint16, center GeoPoint, radius float64) Query {
+	return q.BySelector(NewGeoRadiusSelector(q.tx, idx, center, radius))
+}
+
 func (q *v1Query) Where(hdl Filter) Query {
 	if hdl != nil {
 		q.filters = append(q.filters, hdl)
@@ -292,16 +374,43 @@ func (q *v1Query) Sequence(ctx context.Context, args ...Option) (<-chan fdb.KeyV
 			return
 		}
 
+		// Проекции есть только в строках индекса
+		if _, ok := q.selector.(*indexSelector); q.covered && !ok {
+			errs <- ErrSequence.WithDetail("Covered query requires index selector")
+			return
+		}
+
+		// Покрывающий запрос строки коллекции не читает, поэтому условие частичного индекса к нему не применить
+		where := q.indexWhere()
+
+		if q.covered {
+			where = nil
+		}
+
 		wctx, exit := context.WithCancel(ctx)
-		pairs, errc := q.selector.Select(wctx, q.tb, LastKey(q.getLastKey()), Reverse(q.reverse))
+		pairs, errc := q.selector.Select(wctx, q.tb, LastKey(q.getLastKey()), Reverse(q.reverse), covered(q.covered))
 		defer exit()
 
 		for orig := range pairs {
-			if pair, err = newUsrPair(q.tx, q.tb.ID(), orig.Pair); err != nil {
+			if q.covered {
+				pair = fdb.KeyValue{Key: UnwrapTableKey(orig.Pair.Key), Value: orig.Pair.Value}
+			} else if pair, err = newUsrPair(q.tx, q.tb.ID(), orig.Pair); err != nil {
 				errs <- ErrSequence.WithReason(err)
 				return
 			}
 
+			// Ключ частичного индекса мог остаться после смены условия, пока индекс не перестроен
+			if where != nil {
+				if need, err = where(pair); err != nil {
+					errs <- ErrSequence.WithReason(ErrFilter.WithReason(err))
+					return
+				}
+
+				if !need {
+					continue
+				}
+			}
+
 			if len(q.filters) > 0 {
 				if need, err = q.applyFilters(pair); err != nil {
 					errs <- ErrSequence.WithReason(err)
@@ -338,6 +447,18 @@ func (q *v1Query) Sequence(ctx context.Context, args ...Option) (<-chan fdb.KeyV
 	return list, errs
 }
 
+// indexWhere - условие частичного индекса, по которому выбирает селектор запроса, или nil
+func (q *v1Query) indexWhere() Filter {
+	switch s := q.selector.(type) {
+	case *indexSelector:
+		return q.tb.IndexFilter(s.idx)
+	case *geoSelector:
+		return q.tb.IndexFilter(s.idx)
+	}
+
+	return nil
+}
+
 func (q *v1Query) Save() (cid string, err error) {
 	if q.queryid == nil {
 		q.queryid = typex.NewUUID()
@@ -352,6 +473,7 @@ func (q *v1Query) Save() (cid string, err error) {
 		IdxFrom: q.idxfrom,
 		IdxLast: q.idxlast,
 		QueryID: q.queryid,
+		Covered: q.covered,
 		LastKey: q.getLastKey(),
 	}
 
@@ -0,0 +1,139 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/typex"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	rebuildLease - аренда пересчета материализованного представления или индекса векторов.
+
+	Пока аренда действует, коммит транзакций, изменивших исходную коллекцию, завершается ошибкой (см. rebuildBusy),
+	поэтому строки коллекции во время пересчета не меняются. Хуки коммита и статус транзакции записываются
+	разными физическими транзакциями, поэтому после взятия аренды дожидаемся завершения всех транзакций,
+	которые выполнялись в этот момент: они могли успеть изменить структуру, но еще не закоммититься.
+*/
+type rebuildLease struct {
+	ctx    context.Context
+	key    fdb.Key
+	holder []byte
+	lost   chan struct{}
+	stop   chan struct{}
+	cancel context.CancelFunc
+}
+
+// takeRebuild - взятие аренды пересчета и ожидание транзакций, начатых до нее
+func takeRebuild(ctx context.Context, cn db.Connection, key fdb.Key, ttl time.Duration) (l *rebuildLease, err error) {
+	l = &rebuildLease{
+		key:    key,
+		holder: []byte(typex.NewUUID()),
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+
+	if err = waitLease(ctx, cn, key, l.holder, ttl); err != nil {
+		return nil, err
+	}
+
+	l.ctx, l.cancel = context.WithCancel(ctx)
+
+	// Если аренду продлить не удалось, пересчет прерываем - коллекцию уже снова могут изменять
+	go func() {
+		defer close(l.stop)
+		renewLease(l.ctx, l.cancel, l.lost, cn, key, l.holder, ttl)
+	}()
+
+	if err = waitWriters(l.ctx, cn); err != nil {
+		if exp := l.release(cn); exp != nil {
+			return nil, exp
+		}
+
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// owned - проверка в транзакции записи, что аренда все еще наша
+func (l *rebuildLease) owned(w db.Writer) bool {
+	val := w.Data(l.key)
+	return len(val) > 8 && bytes.Equal(val[8:], l.holder)
+}
+
+// release - остановка продления и освобождение аренды
+func (l *rebuildLease) release(cn db.Connection) error {
+	// Дожидаемся остановки продления, чтобы оно не вернуло аренду после освобождения
+	l.cancel()
+	<-l.stop
+
+	return dropLease(cn, l.key, l.holder)
+}
+
+// rebuildBusy - идет ли пересчет, то есть действует ли чья-то аренда по ключу key
+func rebuildBusy(r db.Reader, key fdb.Key) (bool, error) {
+	val := r.Data(key)
+
+	if len(val) <= 8 {
+		return false, nil
+	}
+
+	till, err := fdbx.Byte2Time(val)
+
+	if err != nil {
+		return false, err
+	}
+
+	return till.After(time.Now()), nil
+}
+
+// waitWriters - ожидание завершения транзакций, выполнявшихся в момент вызова. Принудительно отмененные не ждем
+func waitWriters(ctx context.Context, cn db.Connection) error {
+	list, err := mvcc.ListTx(cn)
+
+	if err != nil {
+		return err
+	}
+
+	wait := make(map[string]struct{}, len(list))
+
+	for i := range list {
+		if !list[i].Cancelled {
+			wait[list[i].ID] = struct{}{}
+		}
+	}
+
+	for len(wait) > 0 {
+		timer := time.NewTimer(rebuildWait)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		if list, err = mvcc.ListTx(cn); err != nil {
+			return err
+		}
+
+		alive := make(map[string]struct{}, len(wait))
+
+		for i := range list {
+			if _, ok := wait[list[i].ID]; ok && !list[i].Cancelled {
+				alive[list[i].ID] = struct{}{}
+			}
+		}
+
+		wait = alive
+	}
+
+	return nil
+}
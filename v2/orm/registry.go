@@ -0,0 +1,408 @@
+package orm
+
+import (
+	"sort"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/models"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// Служебная коллекция реестра схемы, этот номер нельзя использовать для своих коллекций
+const (
+	regTable uint16 = 0xFFFF
+	regIndex uint16 = 1
+)
+
+// Кол-во повторов регистрации, если параллельно кто-то занял тот же номер
+const regAttempts = 5
+
+/*
+	NewRegistry - реестр схемы, который хранит в БД соответствие имен коллекций, индексов и очередей их номерам.
+
+	Номера выделяются по порядку, начиная с 1, и не могут повториться даже при параллельной регистрации
+	из разных сервисов. Уже используемые номера можно закрепить явно, указав их в описании.
+*/
+func NewRegistry(cn db.Connection) Registry {
+	return &v1Registry{
+		cn: cn,
+		tb: NewTable(regTable, UniqueIndex(regIndex, func(buf []byte) (fdb.Key, error) {
+			item := models.GetRootAsSchemaItem(buf, 0).UnPack()
+			return schemaIDKey(item.Kind, item.Scope, item.Id), nil
+		})),
+	}
+}
+
+type v1Registry struct {
+	cn db.Connection
+	tb Table
+}
+
+/*
+	Register - регистрация коллекции вместе с ее индексами и очередями, возвращает описание с номерами.
+
+	Имена, которых еще нет в реестре, сохраняются с указанным или новым выделенным номером.
+	Если у имени уже есть другой номер, номер занят другим именем или версия ниже сохраненной,
+	то возвращается ошибка ErrConflict. Более высокая версия сохраняется вместо прежней.
+*/
+func (r *v1Registry) Register(s TableSchema) (res TableSchema, err error) {
+	return r.save(s, nil)
+}
+
+// save - регистрация коллекции, с проверкой отпечатков определений индексов по номерам, если они заданы
+func (r *v1Registry) save(s TableSchema, defs map[uint16]uint32) (res TableSchema, err error) {
+	if err = s.validate(); err != nil {
+		return TableSchema{}, ErrRegister.WithReason(err)
+	}
+
+	for i := 0; i < regAttempts; i++ {
+		err = mvcc.WithTx(r.cn, func(tx mvcc.Tx) (exp error) {
+			res, exp = r.register(tx, s, defs)
+			return exp
+		})
+
+		// Номер заняла параллельная регистрация, при повторе выделим следующий
+		if err == nil || !errx.Is(err, ErrDuplicate) {
+			break
+		}
+	}
+
+	if err != nil {
+		return TableSchema{}, ErrRegister.WithReason(err).WithDebug(errx.Debug{"name": s.Name})
+	}
+
+	return res, nil
+}
+
+/*
+	Table - регистрация коллекции и создание объекта коллекции с выделенным номером.
+
+	Номера индексов из опций должны быть описаны в схеме и совпадать с сохраненными, иначе ErrConflict.
+	Номера индексов BatchIndex проверяются, только если перечислены в его опции, TagIndex перечисляет их сам.
+
+	Вместе с индексом сохраняется отпечаток его определения: вид индекса и признаки уникального,
+	частичного и покрывающего. Если при той же версии определение отличается от сохраненного, возвращается
+	ErrConflict, а при повышении версии (в том числе через Register) сохраняется новое.
+	Сами функции ключей сравнить нельзя, их изменение нужно отмечать версией.
+
+	Проверяет определения только этот метод: NewTable реестр не использует, как и Register без опций.
+	Номеров очередей в опциях коллекции нет, их нужно брать из описания, которое возвращает Register.
+*/
+func (r *v1Registry) Table(s TableSchema, args ...Option) (_ Table, err error) {
+	defs := getOpts(args).indexDefs()
+
+	if s, err = r.save(s, defs); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[uint16]struct{}, len(s.Indexes))
+
+	for i := range s.Indexes {
+		ids[s.Indexes[i].ID] = struct{}{}
+	}
+
+	for idx := range defs {
+		if _, ok := ids[idx]; !ok {
+			return nil, ErrRegister.WithReason(ErrConflict.WithDetail("Index %d is not registered", idx)).WithDebug(errx.Debug{
+				"name": s.Name,
+				"id":   s.ID,
+			})
+		}
+	}
+
+	return NewTable(s.ID, args...), nil
+}
+
+// Tables - все зарегистрированные коллекции, по возрастанию номеров
+func (r *v1Registry) Tables() (res []TableSchema, err error) {
+	var list []fdb.KeyValue
+
+	tx := mvcc.BeginReadOnly(r.cn)
+	defer tx.Cancel()
+
+	if list, err = r.tb.Select(tx).All(); err != nil {
+		return nil, ErrSchema.WithReason(err)
+	}
+
+	dict := make(map[uint16]*TableSchema, len(list))
+	items := make([]*models.SchemaItemT, len(list))
+
+	for i := range list {
+		items[i] = models.GetRootAsSchemaItem(list[i].Value, 0).UnPack()
+
+		if items[i].Kind == sTable {
+			dict[items[i].Id] = &TableSchema{Name: items[i].Name, ID: items[i].Id}
+		}
+	}
+
+	for _, item := range items {
+		tbl, ok := dict[item.Scope]
+
+		if !ok {
+			continue
+		}
+
+		entry := SchemaEntry{Name: item.Name, ID: item.Id, Version: item.Version}
+
+		switch item.Kind {
+		case sIndex:
+			tbl.Indexes = append(tbl.Indexes, entry)
+		case sQueue:
+			tbl.Queues = append(tbl.Queues, entry)
+		}
+	}
+
+	res = make([]TableSchema, 0, len(dict))
+
+	for _, tbl := range dict {
+		sort.Slice(tbl.Indexes, func(i, j int) bool { return tbl.Indexes[i].ID < tbl.Indexes[j].ID })
+		sort.Slice(tbl.Queues, func(i, j int) bool { return tbl.Queues[i].ID < tbl.Queues[j].ID })
+		res = append(res, *tbl)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (r *v1Registry) register(tx mvcc.Tx, s TableSchema, defs map[uint16]uint32) (res TableSchema, err error) {
+	res = TableSchema{Name: s.Name}
+
+	if res.ID, err = r.resolve(tx, sTable, 0, SchemaEntry{Name: s.Name, ID: s.ID}, nil); err != nil {
+		return
+	}
+
+	if res.Indexes, err = r.resolveAll(tx, sIndex, res.ID, s.Indexes, defs); err != nil {
+		return
+	}
+
+	if res.Queues, err = r.resolveAll(tx, sQueue, res.ID, s.Queues, nil); err != nil {
+		return
+	}
+
+	return res, nil
+}
+
+func (r *v1Registry) resolveAll(
+	tx mvcc.Tx,
+	kind byte,
+	scope uint16,
+	list []SchemaEntry,
+	defs map[uint16]uint32,
+) (res []SchemaEntry, err error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	res = make([]SchemaEntry, len(list))
+
+	for i := range list {
+		res[i] = list[i]
+
+		if res[i].ID, err = r.resolve(tx, kind, scope, list[i], defs); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+/*
+	resolve - номер имени из реестра с проверкой совпадения определения, или новая запись реестра.
+
+	Нулевой или не заданный в defs отпечаток определения не проверяется и не сохраняется.
+*/
+func (r *v1Registry) resolve(tx mvcc.Tx, kind byte, scope uint16, e SchemaEntry, defs map[uint16]uint32) (id uint16, err error) {
+	var item *models.SchemaItemT
+
+	key := schemaKey(kind, scope, e.Name)
+	dbg := errx.Debug{"kind": kind, "scope": scope, "name": e.Name, "id": e.ID, "version": e.Version}
+
+	if item, err = r.load(r.tb.Select(tx).PossibleByID(key)); err != nil {
+		return 0, err
+	}
+
+	if item != nil {
+		if e.ID != 0 && e.ID != item.Id {
+			return 0, ErrConflict.WithDetail("Name is registered with ID %d", item.Id).WithDebug(dbg)
+		}
+
+		if e.Version < item.Version {
+			return 0, ErrConflict.WithDetail("Version is older than registered %d", item.Version).WithDebug(dbg)
+		}
+
+		save := e.Version > item.Version
+		item.Version = e.Version
+
+		// С новой версией прежний отпечаток определения больше не действует
+		if save {
+			item.Def = 0
+		}
+
+		if def := defs[item.Id]; def != 0 && def != item.Def {
+			// Без новой версии менять определение нельзя, кроме первой записи отпечатка
+			if item.Def != 0 {
+				return 0, ErrConflict.WithDetail("Definition differs from registered version %d", item.Version).WithDebug(dbg)
+			}
+
+			item.Def = def
+			save = true
+		}
+
+		if save {
+			if err = r.tb.Upsert(tx, fdb.KeyValue{Key: key, Value: fdbx.FlatPack(item)}); err != nil {
+				return 0, err
+			}
+		}
+
+		return item.Id, nil
+	}
+
+	if id = e.ID; id == 0 {
+		if id, err = r.nextID(tx, kind, scope); err != nil {
+			return 0, err
+		}
+	} else {
+		// Номер мог быть выбран вручную другой командой, поэтому проверяем, кому он принадлежит
+		if item, err = r.load(r.tb.Select(tx).ByIndex(regIndex, schemaIDKey(kind, scope, id))); err != nil {
+			return 0, err
+		}
+
+		if item != nil {
+			return 0, ErrConflict.WithDetail("ID is registered with name %s", item.Name).WithDebug(dbg)
+		}
+	}
+
+	item = &models.SchemaItemT{
+		Kind:    kind,
+		Scope:   scope,
+		Id:      id,
+		Version: e.Version,
+		Name:    e.Name,
+		Def:     defs[id],
+	}
+
+	if err = r.tb.Insert(tx, fdb.KeyValue{Key: key, Value: fdbx.FlatPack(item)}); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// nextID - следующий номер после наибольшего занятого
+func (r *v1Registry) nextID(tx mvcc.Tx, kind byte, scope uint16) (_ uint16, err error) {
+	var pair fdb.KeyValue
+
+	limit := uint16(0xFFFF)
+	prefix := fdb.Key{kind, byte(scope >> 8), byte(scope)}
+
+	// Номер реестра занят служебной коллекцией
+	if kind == sTable {
+		limit = regTable - 1
+	}
+
+	if pair, err = r.tb.Select(tx).ByIndex(regIndex, prefix).Reverse().First(); err != nil {
+		if errx.Is(err, ErrNotFound) {
+			return 1, nil
+		}
+		return 0, err
+	}
+
+	last := models.GetRootAsSchemaItem(pair.Value, 0).Id()
+
+	if last >= limit {
+		return 0, ErrRegister.WithDetail("No free IDs left").WithDebug(errx.Debug{"kind": kind, "scope": scope})
+	}
+
+	return last + 1, nil
+}
+
+// load - запись реестра по запросу, или nil, если записи нет
+func (r *v1Registry) load(q Query) (_ *models.SchemaItemT, err error) {
+	var list []fdb.KeyValue
+
+	if list, err = q.All(); err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	return models.GetRootAsSchemaItem(list[0].Value, 0).UnPack(), nil
+}
+
+// validate - проверка описания коллекции до обращения к реестру
+func (s TableSchema) validate() error {
+	if s.Name == "" {
+		return ErrRegister.WithDetail("Table name is required")
+	}
+
+	if s.ID == regTable {
+		return ErrRegister.WithDetail("Table ID %d is reserved", regTable)
+	}
+
+	if err := validateEntries("index", s.Indexes); err != nil {
+		return err
+	}
+
+	return validateEntries("queue", s.Queues)
+}
+
+func validateEntries(kind string, list []SchemaEntry) error {
+	ids := make(map[uint16]string, len(list))
+	names := make(map[string]struct{}, len(list))
+
+	for i := range list {
+		if list[i].Name == "" {
+			return ErrRegister.WithDetail("The %s name is required", kind)
+		}
+
+		if _, ok := names[list[i].Name]; ok {
+			return ErrRegister.WithDetail("Duplicate %s name %s", kind, list[i].Name)
+		}
+
+		names[list[i].Name] = struct{}{}
+
+		if list[i].ID == 0 {
+			continue
+		}
+
+		if name, ok := ids[list[i].ID]; ok {
+			return ErrRegister.WithDetail("Duplicate %s ID %d for %s and %s", kind, list[i].ID, name, list[i].Name)
+		}
+
+		ids[list[i].ID] = list[i].Name
+	}
+
+	return nil
+}
+
+// IndexID - номер индекса по имени, 0 если такого нет
+func (s TableSchema) IndexID(name string) uint16 { return findEntry(s.Indexes, name) }
+
+// QueueID - номер очереди по имени, 0 если такой нет
+func (s TableSchema) QueueID(name string) uint16 { return findEntry(s.Queues, name) }
+
+func findEntry(list []SchemaEntry, name string) uint16 {
+	for i := range list {
+		if list[i].Name == name {
+			return list[i].ID
+		}
+	}
+
+	return 0
+}
+
+// schemaKey - ключ записи реестра: вид, номер коллекции (для индексов и очередей) и имя
+func schemaKey(kind byte, scope uint16, name string) fdb.Key {
+	return fdbx.AppendLeft(fdb.Key(name), kind, byte(scope>>8), byte(scope))
+}
+
+// schemaIDKey - ключ уникального индекса номеров, номер фиксированной длины, чтобы сортировка шла по его значению
+func schemaIDKey(kind byte, scope, id uint16) fdb.Key {
+	return fdb.Key{kind, byte(scope >> 8), byte(scope), byte(id >> 8), byte(id)}
+}
@@ -0,0 +1,181 @@
+package orm
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	NewGeoBoxSelector - выборка по геоиндексу idx строк с точками в прямоугольнике от min до max.
+
+	Если долгота min больше долготы max, прямоугольник проходит через 180-й меридиан.
+	Строки идут в порядке ключей геоиндекса, а не по удаленности.
+*/
+func NewGeoBoxSelector(tx mvcc.Tx, idx uint16, min, max GeoPoint) Selector {
+	boxes := geoBoxes(min, max)
+
+	return &geoSelector{
+		tx:     tx,
+		idx:    idx,
+		ranges: geoCover(boxes),
+		match: func(code uint64) bool {
+			x, y := geoSplit(code)
+
+			for i := range boxes {
+				if boxes[i].has(x, y) {
+					return true
+				}
+			}
+
+			return false
+		},
+	}
+}
+
+/*
+	NewGeoRadiusSelector - выборка по геоиндексу idx строк с точками не дальше radius метров от center.
+
+	Просматриваются ячейки, покрывающие описанный вокруг круга прямоугольник, а лишние точки отсеиваются
+	по точному расстоянию. Строки идут в порядке ключей геоиндекса, а не по удаленности.
+*/
+func NewGeoRadiusSelector(tx mvcc.Tx, idx uint16, center GeoPoint, radius float64) Selector {
+	return &geoSelector{
+		tx:     tx,
+		idx:    idx,
+		ranges: geoCover(geoCircle(center, radius)),
+		match: func(code uint64) bool {
+			return GeoDistance(center, geoPoint(code)) <= radius
+		},
+	}
+}
+
+type geoSelector struct {
+	tx     mvcc.Tx
+	idx    uint16
+	ranges []geoRange
+	match  func(uint64) bool
+}
+
+func (s *geoSelector) Select(ctx context.Context, tbl Table, args ...Option) (<-chan Selected, <-chan error) {
+	list := make(chan Selected)
+	errs := make(chan error, 1)
+
+	go func() {
+		var err error
+		var lastCode uint64
+
+		defer close(list)
+		defer close(errs)
+
+		opts := getOpts(args)
+		skip := len(opts.lastkey) >= 8
+
+		if skip {
+			lastCode = binary.BigEndian.Uint64(opts.lastkey)
+		}
+
+		for i := range s.ranges {
+			rng := s.ranges[i]
+
+			if opts.reverse {
+				rng = s.ranges[len(s.ranges)-1-i]
+			}
+
+			fkey := geoBytes(rng.from)
+			lkey := geoBytes(rng.last)
+			resume := false
+
+			// Диапазоны до последней отданной строки уже пройдены, а с ней - продолжаем после нее
+			if skip {
+				if opts.reverse {
+					if rng.from > lastCode {
+						continue
+					}
+
+					if resume = rng.last >= lastCode; resume {
+						lkey = opts.lastkey
+					}
+				} else {
+					if rng.last < lastCode {
+						continue
+					}
+
+					if resume = rng.from <= lastCode; resume {
+						fkey = opts.lastkey
+					}
+				}
+
+				skip = false
+			}
+
+			if err = s.scan(ctx, tbl, fkey, lkey, resume, opts.reverse, list); err != nil {
+				errs <- ErrSelect.WithReason(err)
+				return
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	return list, errs
+}
+
+// scan - строки из диапазона ключей геоиндекса, точки которых подходят под условие
+func (s *geoSelector) scan(ctx context.Context, tbl Table, fkey, lkey fdb.Key, skip, reverse bool, list chan Selected) (err error) {
+	reqs := []mvcc.Option{
+		mvcc.From(WrapIndexKey(tbl.ID(), s.idx, fkey)),
+		mvcc.Last(WrapIndexKey(tbl.ID(), s.idx, lkey)),
+	}
+
+	if reverse {
+		reqs = append(reqs, mvcc.Reverse())
+	}
+
+	wctx, exit := context.WithCancel(ctx)
+	pairs, errc := s.tx.SeqScan(wctx, reqs...)
+	defer exit()
+
+	bufSize := 100
+	buf := make([]fdb.KeyValue, 0, bufSize)
+	sel := &indexSelector{tx: s.tx, idx: s.idx}
+
+	for item := range pairs {
+		// Как и в выборке по индексу, последняя отданная строка попадает в диапазон первой
+		if skip {
+			skip = false
+			continue
+		}
+
+		// Ячейки покрывают область с запасом, лишние точки отсеиваются до загрузки строк
+		if key := UnwrapIndexKey(item.Key); len(key) < 8 || !s.match(binary.BigEndian.Uint64(key)) {
+			continue
+		}
+
+		if buf = append(buf, item); len(buf) >= bufSize {
+			if err = sel.flush(ctx, tbl.ID(), false, buf, list); err != nil {
+				return
+			}
+			buf = buf[:0]
+		}
+	}
+
+	if len(buf) > 0 {
+		if err = sel.flush(ctx, tbl.ID(), false, buf, list); err != nil {
+			return
+		}
+	}
+
+	for err = range errc {
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
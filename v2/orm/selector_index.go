@@ -43,6 +43,12 @@ func (s *indexSelector) Select(ctx context.Context, tbl Table, args ...Option) (
 		lkey := s.last
 		opts := getOpts(args)
 		skip := len(opts.lastkey) > 0
+		project := tbl.IndexProjection(s.idx)
+
+		if opts.covered && project == nil {
+			errs <- ErrSelect.WithDetail("Index %d has no projection", s.idx)
+			return
+		}
 
 		if skip {
 			if opts.reverse {
@@ -79,7 +85,7 @@ func (s *indexSelector) Select(ctx context.Context, tbl Table, args ...Option) (
 			buf = append(buf, item)
 
 			if len(buf) >= bufSize {
-				if err = s.flush(ctx, tbl.ID(), buf, list); err != nil {
+				if err = s.flush(ctx, tbl.ID(), opts.covered, buf, list); err != nil {
 					errs <- ErrSelect.WithReason(err)
 					return
 				}
@@ -88,7 +94,7 @@ func (s *indexSelector) Select(ctx context.Context, tbl Table, args ...Option) (
 		}
 
 		if len(buf) > 0 {
-			if err = s.flush(ctx, tbl.ID(), buf, list); err != nil {
+			if err = s.flush(ctx, tbl.ID(), opts.covered, buf, list); err != nil {
 				errs <- ErrSelect.WithReason(err)
 				return
 			}
@@ -105,12 +111,47 @@ func (s *indexSelector) Select(ctx context.Context, tbl Table, args ...Option) (
 	return list, errs
 }
 
-func (s *indexSelector) flush(ctx context.Context, tid uint16, buf []fdb.KeyValue, list chan Selected) (err error) {
+func (s *indexSelector) flush(
+	ctx context.Context,
+	tid uint16,
+	covered bool,
+	buf []fdb.KeyValue,
+	list chan Selected,
+) (err error) {
 	var ok bool
 	var pair fdb.KeyValue
 	var res map[string]fdb.KeyValue
 
 	keys := make([]fdb.Key, len(buf))
+
+	// Покрывающий индекс отвечает сам, вместо строк коллекции загружаются проекции
+	if covered {
+		for i := range buf {
+			keys[i] = projectKey(buf[i].Key)
+		}
+
+		if res, err = s.tx.SelectMany(keys); err != nil {
+			return
+		}
+
+		for i := range buf {
+			// Строка индекса записана до появления проекции, ответить из индекса нельзя
+			if pair, ok = res[keys[i].String()]; !ok {
+				return ErrSelect.WithDetail("Index %d requires RebuildIndex for projection", s.idx).WithDebug(errx.Debug{
+					"key": UnwrapIndexKey(buf[i].Key),
+				})
+			}
+
+			select {
+			case list <- Selected{UnwrapIndexKey(buf[i].Key), fdb.KeyValue{Key: WrapTableKey(tid, buf[i].Value), Value: pair.Value}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		return nil
+	}
+
 	for i := range buf {
 		keys[i] = WrapTableKey(tid, buf[i].Value)
 	}
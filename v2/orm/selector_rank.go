@@ -0,0 +1,105 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// Размер пачки загрузки строк коллекции при ранжированной выборке
+const rankBatch = 100
+
+// rankRow - строка ранжированной выборки: ключ для сортировки и продолжения выборки, затем ключ строки
+type rankRow struct {
+	last fdb.Key
+	pkey fdb.Key
+}
+
+// rankSort - сортировка строк по ключу ранжирования, в обратном порядке - по убыванию
+func rankSort(rank []rankRow, reverse bool) {
+	sort.Slice(rank, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(rank[i].last, rank[j].last) > 0
+		}
+		return bytes.Compare(rank[i].last, rank[j].last) < 0
+	})
+}
+
+/*
+	rankFlush - загрузка строк коллекции в порядке ранжирования, пачками по мере выборки.
+
+	Строки должны быть отсортированы через rankSort в том же порядке. Если указан lastkey,
+	выборка продолжается строго после последней отданной строки.
+*/
+func rankFlush(
+	ctx context.Context,
+	tx mvcc.Tx,
+	tid uint16,
+	rank []rankRow,
+	lastkey fdb.Key,
+	reverse bool,
+	list chan Selected,
+) (err error) {
+	if len(lastkey) > 0 {
+		from := sort.Search(len(rank), func(i int) bool {
+			if reverse {
+				return bytes.Compare(rank[i].last, lastkey) < 0
+			}
+			return bytes.Compare(rank[i].last, lastkey) > 0
+		})
+		rank = rank[from:]
+	}
+
+	for len(rank) > 0 {
+		size := len(rank)
+
+		if size > rankBatch {
+			size = rankBatch
+		}
+
+		if err = rankLoad(ctx, tx, tid, rank[:size], list); err != nil {
+			return
+		}
+
+		rank = rank[size:]
+	}
+
+	return nil
+}
+
+// rankLoad - загрузка одной пачки строк коллекции
+func rankLoad(ctx context.Context, tx mvcc.Tx, tid uint16, rank []rankRow, list chan Selected) (err error) {
+	var ok bool
+	var pair fdb.KeyValue
+	var res map[string]fdb.KeyValue
+
+	keys := make([]fdb.Key, len(rank))
+	for i := range rank {
+		keys[i] = WrapTableKey(tid, rank[i].pkey)
+	}
+
+	if res, err = tx.SelectMany(keys); err != nil {
+		return
+	}
+
+	for i := range keys {
+		if pair, ok = res[keys[i].String()]; !ok {
+			return ErrNotFound.WithDebug(errx.Debug{
+				"id": keys[i],
+			})
+		}
+
+		select {
+		case list <- Selected{rank[i].last, pair}:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package orm
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// Виды условий полнотекстового поиска
+const (
+	tMatch  byte = 1
+	tPrefix byte = 2
+	tAnd    byte = 3
+	tOr     byte = 4
+)
+
+// TextQuery - условие полнотекстового поиска, строится функциями TextMatch, TextPrefix, TextAnd и TextOr
+type TextQuery struct {
+	kind  byte
+	text  string
+	items []TextQuery
+}
+
+// TextMatch - строки, в которых есть все слова текста
+func TextMatch(text string) TextQuery { return TextQuery{kind: tMatch, text: text} }
+
+// TextPrefix - строки со всеми словами текста, где последнее слово может быть началом слова строки
+func TextPrefix(text string) TextQuery { return TextQuery{kind: tPrefix, text: text} }
+
+// TextAnd - строки, подходящие под все условия
+func TextAnd(items ...TextQuery) TextQuery { return TextQuery{kind: tAnd, items: items} }
+
+// TextOr - строки, подходящие хотя бы под одно условие
+func TextOr(items ...TextQuery) TextQuery { return TextQuery{kind: tOr, items: items} }
+
+/*
+	NewTextSelector - выборка по полнотекстовому индексу idx, по убыванию релевантности.
+
+	Релевантность строки - сумма по словам запроса кол-ва вхождений слова в строку, умноженного на его редкость
+	среди найденных строк (TF-IDF). Все найденные ключи строк ранжируются в памяти, поэтому индекс
+	рассчитан на небольшие коллекции. Строки с одинаковой релевантностью идут в порядке ключей.
+*/
+func NewTextSelector(tx mvcc.Tx, idx uint16, query TextQuery) Selector {
+	return &textSelector{
+		tx:    tx,
+		idx:   idx,
+		query: query,
+	}
+}
+
+type textSelector struct {
+	tx    mvcc.Tx
+	idx   uint16
+	query TextQuery
+}
+
+// textHits - найденные по слову или префиксу строки: кол-во вхождений по ключу строки
+type textHits map[string]uint32
+
+func (s *textSelector) Select(ctx context.Context, tbl Table, args ...Option) (<-chan Selected, <-chan error) {
+	list := make(chan Selected)
+	errs := make(chan error, 1)
+
+	go func() {
+		var err error
+
+		defer close(list)
+		defer close(errs)
+
+		opts := getOpts(args)
+		hits := make(map[string]textHits, 8)
+
+		if err = s.scan(ctx, tbl, s.query, hits); err != nil {
+			errs <- ErrSelect.WithReason(err)
+			return
+		}
+
+		if err = rankFlush(ctx, s.tx, tbl.ID(), s.rank(tbl, hits, opts.reverse), opts.lastkey, opts.reverse, list); err != nil {
+			errs <- ErrSelect.WithReason(err)
+			return
+		}
+	}()
+
+	return list, errs
+}
+
+// scan - выборка из индекса строк по всем словам условия, каждое слово выбирается один раз
+func (s *textSelector) scan(ctx context.Context, tbl Table, query TextQuery, hits map[string]textHits) (err error) {
+	switch query.kind {
+	case tAnd, tOr:
+		for i := range query.items {
+			if err = s.scan(ctx, tbl, query.items[i], hits); err != nil {
+				return
+			}
+		}
+
+		return nil
+	}
+
+	terms, err := s.terms(tbl, query)
+
+	if err != nil {
+		return
+	}
+
+	for _, term := range terms {
+		if _, ok := hits[term]; ok {
+			continue
+		}
+
+		if hits[term], err = s.hits(ctx, tbl, term); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// terms - слова условия после анализаторов индекса. Полное слово оканчивается нулевым байтом, как в ключе индекса
+func (s *textSelector) terms(tbl Table, query TextQuery) (res []string, err error) {
+	words := tbl.IndexTerms(s.idx, query.text)
+
+	if words == nil {
+		return nil, ErrSelect.WithDetail("Index %d is not a text index", s.idx)
+	}
+
+	res = make([]string, len(words))
+
+	for i := range words {
+		res[i] = words[i] + "\x00"
+	}
+
+	if query.kind == tPrefix && len(res) > 0 {
+		res[len(res)-1] = words[len(words)-1]
+	}
+
+	return res, nil
+}
+
+// hits - строки индекса по слову или префиксу, вхождения разных слов одного префикса складываются
+func (s *textSelector) hits(ctx context.Context, tbl Table, term string) (res textHits, err error) {
+	skey := WrapIndexKey(tbl.ID(), s.idx, fdb.Key(term))
+	res = make(textHits, 64)
+
+	wctx, exit := context.WithCancel(ctx)
+	pairs, errc := s.tx.SeqScan(wctx, mvcc.From(skey), mvcc.Last(skey))
+	defer exit()
+
+	for item := range pairs {
+		if num, ok := textFreq(UnwrapIndexKey(item.Key)); ok {
+			res[string(item.Value)] += uint32(num)
+		}
+	}
+
+	for err = range errc {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// rank - подходящие под условие строки, по убыванию релевантности (или по возрастанию, в обратном порядке)
+func (s *textSelector) rank(tbl Table, hits map[string]textHits, reverse bool) []rankRow {
+	docs := make(map[string]struct{}, 64)
+
+	for _, rows := range hits {
+		for pkey := range rows {
+			docs[pkey] = struct{}{}
+		}
+	}
+
+	// Редкость слова считается среди всех найденных строк
+	idf := make(map[string]float64, len(hits))
+
+	for term, rows := range hits {
+		idf[term] = math.Log(1 + float64(len(docs))/float64(len(rows)))
+	}
+
+	found := s.match(tbl, s.query, hits, idf)
+	res := make([]rankRow, 0, len(found))
+
+	for pkey, score := range found {
+		// Релевантность неотрицательная, поэтому порядок ее битов совпадает с порядком чисел, инверсия - по убыванию
+		last := make(fdb.Key, 8, 8+len(pkey))
+		binary.BigEndian.PutUint64(last, ^math.Float64bits(score))
+		last = append(last, pkey...)
+		res = append(res, rankRow{last: last, pkey: fdb.Key(pkey)})
+	}
+
+	rankSort(res, reverse)
+	return res
+}
+
+// match - строки, подходящие под условие, с их релевантностью
+func (s *textSelector) match(tbl Table, query TextQuery, hits map[string]textHits, idf map[string]float64) map[string]float64 {
+	var res map[string]float64
+
+	switch query.kind {
+	case tOr:
+		res = make(map[string]float64, 64)
+
+		for i := range query.items {
+			for pkey, score := range s.match(tbl, query.items[i], hits, idf) {
+				res[pkey] += score
+			}
+		}
+
+		return res
+	case tAnd:
+		for i := range query.items {
+			res = textAnd(res, s.match(tbl, query.items[i], hits, idf), i == 0)
+		}
+
+		return res
+	}
+
+	// Ошибки уже проверены при выборке слов
+	terms, _ := s.terms(tbl, query)
+
+	for i, term := range terms {
+		part := make(map[string]float64, len(hits[term]))
+
+		for pkey, num := range hits[term] {
+			part[pkey] = float64(num) * idf[term]
+		}
+
+		res = textAnd(res, part, i == 0)
+	}
+
+	return res
+}
+
+// textAnd - пересечение результатов с суммой релевантности
+func textAnd(res, part map[string]float64, first bool) map[string]float64 {
+	if first {
+		return part
+	}
+
+	for pkey := range res {
+		if score, ok := part[pkey]; ok {
+			res[pkey] += score
+		} else {
+			delete(res, pkey)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,99 @@
+package orm
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	vectorSelector - выборка строк коллекции по возрастанию расстояния их векторов до вектора запроса.
+
+	Векторы просматриваемых списков ранжируются в памяти, а строки коллекции загружаются пачками по мере выборки.
+	Строки с одинаковым расстоянием идут в порядке ключей.
+*/
+type vectorSelector struct {
+	v      *v1Vectors
+	tx     mvcc.Tx
+	vec    []float32
+	probes int
+}
+
+func (s *vectorSelector) Select(ctx context.Context, tbl Table, args ...Option) (<-chan Selected, <-chan error) {
+	list := make(chan Selected)
+	errs := make(chan error, 1)
+
+	go func() {
+		var err error
+		var gen byte
+		var vec []float32
+		var rank []rankRow
+		var cents [][]float32
+
+		defer close(list)
+		defer close(errs)
+
+		opts := getOpts(args)
+
+		if vec, err = s.v.norm(s.vec); err != nil {
+			errs <- ErrSelect.WithReason(err)
+			return
+		}
+
+		if gen, cents, err = s.v.centers(s.tx); err != nil {
+			errs <- ErrSelect.WithReason(err)
+			return
+		}
+
+		for _, num := range vectorProbe(cents, vec, s.v.metric, s.probes) {
+			if rank, err = s.scan(ctx, gen, num, vec, rank); err != nil {
+				errs <- ErrSelect.WithReason(err)
+				return
+			}
+		}
+
+		rankSort(rank, opts.reverse)
+
+		if err = rankFlush(ctx, s.tx, tbl.ID(), rank, opts.lastkey, opts.reverse, list); err != nil {
+			errs <- ErrSelect.WithReason(err)
+			return
+		}
+	}()
+
+	return list, errs
+}
+
+// scan - расстояния до векторов списка num поколения gen. Расстояние неотрицательное, поэтому порядок его битов совпадает с порядком чисел
+func (s *vectorSelector) scan(ctx context.Context, gen byte, num uint16, vec []float32, rank []rankRow) (_ []rankRow, err error) {
+	var usr fdb.KeyValue
+
+	tbid := s.v.tb.ID()
+	skey := WrapTableKey(tbid, s.v.entryKey(gen, num, nil))
+
+	wctx, exit := context.WithCancel(ctx)
+	pairs, errc := s.tx.SeqScan(wctx, mvcc.From(skey), mvcc.Last(skey))
+	defer exit()
+
+	for item := range pairs {
+		if usr, err = newUsrPair(s.tx, tbid, item); err != nil {
+			return
+		}
+
+		pkey := usr.Key[3:]
+		last := make(fdb.Key, 8, 8+len(pkey))
+		binary.BigEndian.PutUint64(last, math.Float64bits(vectorDist(s.v.metric, vec, vectorValue(usr.Value))))
+		rank = append(rank, rankRow{last: append(last, pkey...), pkey: pkey})
+	}
+
+	for err = range errc {
+		if err != nil {
+			return
+		}
+	}
+
+	return rank, nil
+}
@@ -0,0 +1,158 @@
+package orm
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// TypedKey - допустимые типы ключей типизированной коллекции
+type TypedKey interface {
+	~string | ~[]byte
+}
+
+// TypedPair - пара ключ-значение типизированной коллекции
+type TypedPair[K TypedKey, V any] struct {
+	Key   K
+	Value V
+}
+
+// TypedFilter - фильтр выборки типизированной коллекции
+type TypedFilter[K TypedKey, V any] func(K, V) (ok bool, err error)
+
+// TypedTable - обертка коллекции, работающая с типизированными ключами и значениями
+type TypedTable[K TypedKey, V any] interface {
+	// Обычная коллекция, на случай если нужны сырые данные
+	Table() Table
+
+	Get(mvcc.Tx, K) (V, error)
+	Put(mvcc.Tx, K, V) error
+	Insert(mvcc.Tx, K, V) error
+	Delete(mvcc.Tx, ...K) error
+
+	Select(mvcc.Tx) TypedQuery[K, V]
+	Cursor(mvcc.Tx, string) (TypedQuery[K, V], error)
+}
+
+// TypedQuery - запрос к типизированной коллекции, результаты распаковываются кодеком
+type TypedQuery[K TypedKey, V any] interface {
+	// Обычный запрос, на случай если нужны сырые данные
+	Query() Query
+
+	ByID(ids ...K) TypedQuery[K, V]
+	PossibleByID(ids ...K) TypedQuery[K, V]
+	ByIndex(idx uint16, query fdb.Key) TypedQuery[K, V]
+	ByIndexRange(idx uint16, from, last fdb.Key) TypedQuery[K, V]
+	BySelector(Selector) TypedQuery[K, V]
+
+	Forward() TypedQuery[K, V]
+	Reverse() TypedQuery[K, V]
+	Page(int) TypedQuery[K, V]
+	Limit(int) TypedQuery[K, V]
+	Where(TypedFilter[K, V]) TypedQuery[K, V]
+
+	All() ([]TypedPair[K, V], error)
+	Next() ([]TypedPair[K, V], error)
+	First() (TypedPair[K, V], error)
+	Delete() error
+	Empty() bool
+
+	Save() (string, error)
+	Drop() error
+}
+
+/*
+	NewTypedTable - типизированная коллекция поверх обычной, значения упаковываются кодеком.
+
+	Индексы по значениям удобно объявлять через IndexOf и MultiIndexOf с тем же кодеком:
+
+		codec := orm.NewJSONCodec[User]()
+		users := orm.NewTypedTable[string](UserTable, codec,
+			orm.IndexOf(codec, UserEmail, func(u User) (fdb.Key, error) { return fdb.Key(u.Email), nil }),
+		)
+*/
+func NewTypedTable[K TypedKey, V any](id uint16, codec Codec[V], args ...Option) TypedTable[K, V] {
+	return &v1TypedTable[K, V]{
+		tb:    NewTable(id, args...),
+		codec: codec,
+	}
+}
+
+type v1TypedTable[K TypedKey, V any] struct {
+	tb    Table
+	codec Codec[V]
+}
+
+func (t *v1TypedTable[K, V]) Table() Table { return t.tb }
+
+func (t *v1TypedTable[K, V]) Get(tx mvcc.Tx, key K) (val V, err error) {
+	var pair fdb.KeyValue
+
+	if pair, err = t.tb.Select(tx).ByID(fdb.Key(key)).First(); err != nil {
+		return val, ErrSelect.WithReason(err)
+	}
+
+	if val, err = t.codec.Decode(pair.Value); err != nil {
+		return val, ErrSelect.WithReason(ErrValUnpack.WithReason(err))
+	}
+
+	return val, nil
+}
+
+func (t *v1TypedTable[K, V]) Put(tx mvcc.Tx, key K, val V) (err error) {
+	var pair fdb.KeyValue
+
+	if pair, err = t.encode(key, val); err != nil {
+		return ErrUpsert.WithReason(err)
+	}
+
+	return t.tb.Upsert(tx, pair)
+}
+
+func (t *v1TypedTable[K, V]) Insert(tx mvcc.Tx, key K, val V) (err error) {
+	var pair fdb.KeyValue
+
+	if pair, err = t.encode(key, val); err != nil {
+		return ErrUpsert.WithReason(err)
+	}
+
+	return t.tb.Insert(tx, pair)
+}
+
+func (t *v1TypedTable[K, V]) Delete(tx mvcc.Tx, keys ...K) error {
+	return t.tb.Delete(tx, typedKeys(keys)...)
+}
+
+func (t *v1TypedTable[K, V]) Select(tx mvcc.Tx) TypedQuery[K, V] {
+	return &v1TypedQuery[K, V]{q: t.tb.Select(tx), codec: t.codec}
+}
+
+func (t *v1TypedTable[K, V]) Cursor(tx mvcc.Tx, id string) (_ TypedQuery[K, V], err error) {
+	var q Query
+
+	if q, err = t.tb.Cursor(tx, id); err != nil {
+		return nil, err
+	}
+
+	return &v1TypedQuery[K, V]{q: q, codec: t.codec}, nil
+}
+
+func (t *v1TypedTable[K, V]) encode(key K, val V) (_ fdb.KeyValue, err error) {
+	var buf []byte
+
+	if buf, err = t.codec.Encode(val); err != nil {
+		return fdb.KeyValue{}, ErrValPack.WithReason(err)
+	}
+
+	return fdb.KeyValue{Key: fdb.Key(key), Value: buf}, nil
+}
+
+func typedKeys[K TypedKey](keys []K) []fdb.Key {
+	res := make([]fdb.Key, len(keys))
+
+	for i := range keys {
+		res[i] = fdb.Key(keys[i])
+	}
+
+	return res
+}
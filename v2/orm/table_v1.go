@@ -1,14 +1,16 @@
 package orm
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
-	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/golang/glog"
 	"github.com/shestakovda/errx"
+	"github.com/shestakovda/typex"
 
 	"github.com/shestakovda/fdbx/v2"
 	"github.com/shestakovda/fdbx/v2/db"
@@ -17,15 +19,61 @@ import (
 )
 
 func NewTable(id uint16, args ...Option) Table {
-	return &v1Table{
+	t := &v1Table{
 		id:      id,
 		options: getOpts(args),
 	}
+
+	// Родительская коллекция должна знать о ссылках, чтобы выполнять действия при удалении своих строк
+	for idx, fk := range t.options.foreign {
+		if parent, ok := fk.parent.(*v1Table); ok {
+			parent.reference(tableRef{child: t, idx: idx, foreignKey: fk})
+		}
+	}
+
+	return t
 }
 
 type v1Table struct {
 	options
 	id uint16
+
+	rmux  sync.RWMutex
+	refs  []tableRef
+	views []materializer
+}
+
+// materializer - структура, которая изменяется вместе со строками коллекции, в той же транзакции
+type materializer interface {
+	apply(tx mvcc.Tx, list []RowChange) error
+}
+
+// materialize - представление или индекс векторов, которые надо изменять вместе со строками коллекции
+func (t *v1Table) materialize(v materializer) {
+	t.rmux.Lock()
+	defer t.rmux.Unlock()
+	t.views = append(t.views, v)
+}
+
+func (t *v1Table) materialized() []materializer {
+	t.rmux.RLock()
+	defer t.rmux.RUnlock()
+	return t.views
+}
+
+/*
+	exact - опции записи строк с учетом счетчиков, представлений и индексов векторов.
+
+	Они изменяются при коммите по старым значениям строк, поэтому заменять и удалять можно только версии
+	завершенных транзакций. Иначе отмена транзакции, чью незакоммиченную версию заменили, оставила бы их расхождение.
+	Версии незавершенных транзакций дают ErrConflict, как в Update.
+*/
+func (t *v1Table) exact(opts ...mvcc.Option) []mvcc.Option {
+	if t.options.counters || len(t.materialized()) > 0 {
+		return append(opts, mvcc.Conflict())
+	}
+
+	return opts
 }
 
 func (t *v1Table) ID() uint16 { return t.id }
@@ -52,13 +100,182 @@ func (t *v1Table) Delete(tx mvcc.Tx, keys ...fdb.Key) (err error) {
 		cp[i] = WrapTableKey(t.id, keys[i])
 	}
 
-	if err = tx.Delete(cp, mvcc.OnDelete(t.onDelete)); err != nil {
+	run := t.newTriggerRun(true)
+
+	if err = run.write(tx, func(args ...mvcc.Option) error {
+		return tx.Delete(cp, t.exact(append(args, mvcc.OnDelete(run.onDrop))...)...)
+	}); err != nil {
+		return ErrDelete.WithReason(err)
+	}
+
+	if err = run.after(tx, keys); err != nil {
 		return ErrDelete.WithReason(err)
 	}
 
 	return nil
 }
 
+/*
+	Truncate - логическое удаление всех строк коллекции и ключей ее индексов.
+
+	Строки удаляются в рамках транзакции, поэтому для остальных транзакций они пропадут только после коммита.
+	Ключи индексов и проекции покрывающих индексов удаляются целиком по префиксу, без вычисления по значениям строк.
+	Устаревшие версии и BLOB, как и при обычном удалении, будут удалены очисткой. Если ведутся счетчики, представления или индексы векторов,
+	то для их изменения строки удаляются с вычислением ключей индексов, как при обычном удалении. Так же удаляются строки,
+	на которые ссылаются другие коллекции, чтобы выполнить действия внешних ключей.
+*/
+func (t *v1Table) Truncate(tx mvcc.Tx) (err error) {
+	var run *triggerRun
+
+	// Триггеры при очистке не вызываются, но изменения строк нужны для счетчиков, представлений и индексов векторов
+	if t.options.counters || len(t.references()) > 0 || len(t.materialized()) > 0 {
+		run = t.newTriggerRun(false)
+	}
+
+	if err = t.truncate(tx, WrapTableKey(t.id, nil), run); err != nil {
+		return ErrTruncate.WithReason(err)
+	}
+
+	if err = t.truncate(tx, fdb.Key{byte(t.id >> 8), byte(t.id), nsIndex}, nil); err != nil {
+		return ErrTruncate.WithReason(err)
+	}
+
+	if err = t.truncate(tx, fdb.Key{byte(t.id >> 8), byte(t.id), nsProject}, nil); err != nil {
+		return ErrTruncate.WithReason(err)
+	}
+
+	return nil
+}
+
+// truncate - удаление всех актуальных строк по префиксу, пачками. Строки коллекции удаляются с обработчиками, если задан run
+func (t *v1Table) truncate(tx mvcc.Tx, prefix fdb.Key, run *triggerRun) (err error) {
+	var list []fdb.KeyValue
+
+	from := prefix
+
+	for {
+		if list, err = tx.ListAll(context.Background(),
+			mvcc.From(from),
+			mvcc.Last(prefix),
+			mvcc.Limit(truncateBatch),
+		); err != nil {
+			return
+		}
+
+		if len(list) == 0 {
+			return nil
+		}
+
+		keys := make([]fdb.Key, len(list))
+
+		for i := range list {
+			keys[i] = list[i].Key
+		}
+
+		if run == nil {
+			if err = tx.Delete(keys); err != nil {
+				return
+			}
+		} else {
+			if err = run.write(tx, func(args ...mvcc.Option) error {
+				return tx.Delete(keys, t.exact(append(args, mvcc.OnDelete(run.onDrop))...)...)
+			}); err != nil {
+				return
+			}
+
+			for i := range keys {
+				keys[i] = UnwrapTableKey(keys[i])
+			}
+
+			if err = run.after(tx, keys); err != nil {
+				return
+			}
+		}
+
+		if len(list) < truncateBatch {
+			return nil
+		}
+
+		// Следующая пачка строго после последнего удаленного ключа
+		from = fdbx.AppendRight(list[len(list)-1].Key, 0x00)
+	}
+}
+
+/*
+	Drop - физическое удаление всех данных коллекции: строк со всеми версиями, BLOB, индексов, очередей,
+	курсоров и служебных отметок очистки и перестроения индексов.
+
+	Все служебные ключи коллекции, включая аренду и отметки прогресса автоочистки, отметки перестроения индексов,
+	счетчики и проекции, лежат под ее префиксом и удаляются вместе с ним. Вне префикса коллекция ничего не пишет:
+	блокировки SharedLock и сигнальные ключи Watch ставятся по ключам, которые передал пользователь,
+	и освобождаются транзакциями, которые их взяли.
+
+	Удаление не транзакционное и выполняется одной очисткой диапазона, поэтому незавершенные транзакции
+	потеряют свои изменения коллекции. Использовать только для коллекций, с которыми больше никто не работает.
+*/
+func (t *v1Table) Drop(cn db.Connection) (err error) {
+	skey := mvcc.WrapKey(fdb.Key{byte(t.id >> 8), byte(t.id)})
+
+	if err = cn.Write(func(w db.Writer) error {
+		w.Erase(skey, skey)
+		return nil
+	}); err != nil {
+		return ErrDrop.WithReason(err)
+	}
+
+	return nil
+}
+
+/*
+	Update - изменение значения строки коллекции по ключу.
+
+	Чтение строки, вызов обработчика и запись нового значения идут в одной физической транзакции
+	под эксклюзивной блокировкой строки, поэтому параллельная физическая запись той же строки приведет к повтору.
+	Если строку уже изменила или удалила еще не завершенная логическая транзакция, возвращается mvcc.ErrConflict,
+	и изменение нужно повторить в новой транзакции после ее завершения.
+	Транзакция, которая не отмечала активность дольше mvcc.AliveTimeout, считается потерянной и отменяется.
+	Обработчик может быть вызван несколько раз, побочных эффектов в нем быть не должно.
+	Если строки нет, возвращается ErrNotFound.
+*/
+func (t *v1Table) Update(tx mvcc.Tx, key fdb.Key, hdl UpdateHandler) (err error) {
+	run := t.newTriggerRun(true)
+	lock := func(_ mvcc.Tx, w db.Writer, pair fdb.KeyValue) (exp error) {
+		var usr fdb.KeyValue
+		var sys fdb.KeyValue
+
+		if usr, exp = newUsrPair(tx, t.id, pair); exp != nil {
+			return
+		}
+
+		if usr.Value, exp = hdl(usr.Value); exp != nil {
+			return
+		}
+
+		if sys, exp = newSysPair(tx, t.id, usr); exp != nil {
+			return
+		}
+
+		return tx.Upsert([]fdb.KeyValue{sys}, mvcc.Writer(w), mvcc.OnInsert(run.onInsert), mvcc.OnDelete(run.onDelete))
+	}
+
+	if err = run.write(tx, func(args ...mvcc.Option) (exp error) {
+		_, exp = tx.Select(WrapTableKey(t.id, key), append(args, mvcc.Exclusive(lock), mvcc.Conflict())...)
+		return
+	}); err != nil {
+		if errx.Is(err, mvcc.ErrNotFound) {
+			return ErrUpdate.WithReason(ErrNotFound.WithReason(err))
+		}
+
+		return ErrUpdate.WithReason(err)
+	}
+
+	if err = run.after(tx, []fdb.Key{key}); err != nil {
+		return ErrUpdate.WithReason(err)
+	}
+
+	return nil
+}
+
 func (t *v1Table) upsert(tx mvcc.Tx, unique bool, pairs ...fdb.KeyValue) (err error) {
 	if len(pairs) == 0 {
 		return nil
@@ -71,23 +288,38 @@ func (t *v1Table) upsert(tx mvcc.Tx, unique bool, pairs ...fdb.KeyValue) (err er
 		}
 	}
 
+	run := t.newTriggerRun(true)
 	opts := []mvcc.Option{
-		mvcc.OnInsert(t.onInsert),
-		mvcc.OnDelete(t.onDelete),
+		mvcc.OnInsert(run.onInsert),
+		mvcc.OnDelete(run.onDelete),
 	}
 
 	if unique {
 		opts = append(opts, mvcc.OnUpdate(t.onUpdate))
 	}
 
-	if err = tx.Upsert(cp, opts...); err != nil {
+	if err = run.write(tx, func(args ...mvcc.Option) error {
+		return tx.Upsert(cp, t.exact(append(args, opts...)...)...)
+	}); err != nil {
 		return ErrUpsert.WithReason(err)
 	}
 
+	if run.active() {
+		keys := make([]fdb.Key, len(pairs))
+
+		for i := range pairs {
+			keys[i] = pairs[i].Key
+		}
+
+		if err = run.after(tx, keys); err != nil {
+			return ErrUpsert.WithReason(err)
+		}
+	}
+
 	return nil
 }
 
-func (t *v1Table) onInsert(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err error) {
+func (t *v1Table) onInsert(tx mvcc.Tx, w db.Writer, pair fdb.KeyValue) (err error) {
 	if len(t.options.batchidx) == 0 {
 		return nil
 	}
@@ -102,7 +334,13 @@ func (t *v1Table) onInsert(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err erro
 	pval := usr.Value
 	pkey := usr.Key
 	rows := make([]fdb.KeyValue, 0, 32)
+	var uniq map[uint16][]fdb.KeyValue
 	var dict map[uint16][]fdb.Key
+	var skip map[uint16]bool
+
+	if skip, err = t.skipIndexes(usr); err != nil {
+		return ErrIdxUpsert.WithReason(err)
+	}
 
 	for k := range t.options.batchidx {
 		if dict, err = t.options.batchidx[k](pval); err != nil {
@@ -114,18 +352,54 @@ func (t *v1Table) onInsert(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err erro
 		}
 
 		for idx, keys := range dict {
+			if skip[idx] {
+				continue
+			}
+
 			for i := range keys {
 				if len(keys[i]) == 0 {
 					continue
 				}
-				rows = append(rows, fdb.KeyValue{
-					Key:   fdbx.AppendRight(WrapIndexKey(t.id, idx, keys[i]), pkey...),
-					Value: pkey,
-				})
+
+				if _, ok := t.options.foreign[idx]; ok {
+					if err = t.checkForeign(tx, w, idx, keys[i]); err != nil {
+						return
+					}
+				}
+
+				row := fdb.KeyValue{Key: t.indexKey(idx, keys[i], pkey), Value: pkey}
+
+				if _, ok := t.options.project[idx]; ok {
+					var proj fdb.KeyValue
+
+					if proj, err = t.projectRow(idx, row.Key, pval); err != nil {
+						return ErrIdxUpsert.WithReason(err)
+					}
+
+					rows = append(rows, proj)
+				}
+
+				if _, ok := t.options.unique[idx]; ok {
+					if uniq == nil {
+						uniq = make(map[uint16][]fdb.KeyValue, len(t.options.unique))
+					}
+					uniq[idx] = append(uniq[idx], row)
+					continue
+				}
+
+				rows = append(rows, row)
 			}
 		}
 	}
 
+	// Уникальные ключи проверяются в той же физической транзакции, что и вставка строки,
+	// включая еще не завершенные транзакции, так что параллельная вставка приведет к конфликту
+	for idx := range uniq {
+		if err = tx.Upsert(uniq[idx], mvcc.Writer(w), mvcc.OnDelete(t.onUnique(idx, pkey))); err != nil {
+			return ErrIdxUpsert.WithReason(err)
+		}
+	}
+
 	if err = tx.Upsert(rows); err != nil {
 		return ErrIdxUpsert.WithReason(err)
 	}
@@ -139,6 +413,54 @@ func (t *v1Table) onUpdate(_ mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err error
 	})
 }
 
+// onUnique - проверка, что уникальный ключ индекса не занят другой строкой
+func (t *v1Table) onUnique(idx uint16, pkey fdb.Key) mvcc.RowHandler {
+	return func(_ mvcc.Tx, _ db.Writer, pair fdb.KeyValue) error {
+		if bytes.Equal(pair.Value, pkey) {
+			return nil
+		}
+
+		return ErrDuplicate.WithDebug(errx.Debug{
+			"index": idx,
+			"key":   UnwrapIndexKey(pair.Key),
+			"id":    fdb.Key(pair.Value),
+		})
+	}
+}
+
+// IndexFilter - условие частичного индекса, чтобы применить его к запросу через Where. Для полного индекса nil
+func (t *v1Table) IndexFilter(idx uint16) Filter { return t.options.partial[idx] }
+
+// skipIndexes - частичные индексы, в которые строка не попадает по условию
+func (t *v1Table) skipIndexes(usr fdb.KeyValue) (res map[uint16]bool, err error) {
+	var ok bool
+
+	if len(t.options.partial) == 0 {
+		return nil, nil
+	}
+
+	res = make(map[uint16]bool, len(t.options.partial))
+
+	for idx, where := range t.options.partial {
+		if ok, err = where(usr); err != nil {
+			return nil, ErrFilter.WithReason(err).WithDebug(errx.Debug{"index": idx})
+		}
+
+		res[idx] = !ok
+	}
+
+	return res, nil
+}
+
+// indexKey - системный ключ строки индекса. У уникального индекса ключ строки в него не входит
+func (t *v1Table) indexKey(idx uint16, key, pkey fdb.Key) fdb.Key {
+	if _, ok := t.options.unique[idx]; ok {
+		return WrapIndexKey(t.id, idx, key)
+	}
+
+	return fdbx.AppendRight(WrapIndexKey(t.id, idx, key), pkey...)
+}
+
 func (t *v1Table) onDelete(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err error) {
 	var usr fdb.KeyValue
 
@@ -155,6 +477,11 @@ func (t *v1Table) onDelete(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err erro
 	rows := make([]fdb.Key, 0, 32)
 	pkey := UnwrapTableKey(pair.Key)
 	var dict map[uint16][]fdb.Key
+	var skip map[uint16]bool
+
+	if skip, err = t.skipIndexes(usr); err != nil {
+		return ErrIdxDelete.WithReason(err)
+	}
 
 	for k := range t.options.batchidx {
 		if dict, err = t.options.batchidx[k](uval); err != nil {
@@ -166,11 +493,19 @@ func (t *v1Table) onDelete(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err erro
 		}
 
 		for idx, keys := range dict {
+			if skip[idx] {
+				continue
+			}
+
 			for i := range keys {
 				if len(keys[i]) == 0 {
 					continue
 				}
-				rows = append(rows, fdbx.AppendRight(WrapIndexKey(t.id, idx, keys[i]), pkey...))
+				rows = append(rows, t.indexKey(idx, keys[i], pkey))
+
+				if _, ok := t.options.project[idx]; ok {
+					rows = append(rows, projectKey(rows[len(rows)-1]))
+				}
 			}
 		}
 	}
@@ -182,6 +517,16 @@ func (t *v1Table) onDelete(tx mvcc.Tx, _ db.Writer, pair fdb.KeyValue) (err erro
 	return nil
 }
 
+/*
+	Autovacuum - периодическая очистка коллекции, пока не будет отменен контекст.
+
+	Запускать можно в каждом экземпляре приложения: перед очисткой берется аренда в БД,
+	поэтому в один момент коллекцию очищает только один экземпляр. Аренда продлевается во время очистки,
+	а если экземпляр пропал, то после ее истечения очистку продолжит другой, с сохраненного прогресса.
+
+	По умолчанию очистка запускается раз в сутки, в случайный момент окна с 00:00 до 06:00.
+	Окна можно задать опцией VacuumWindow, либо вместо них интервал опцией VacuumWait.
+*/
 func (t *v1Table) Autovacuum(ctx context.Context, cn db.Connection, args ...Option) {
 	var err error
 	var tbid [2]byte
@@ -190,6 +535,7 @@ func (t *v1Table) Autovacuum(ctx context.Context, cn db.Connection, args ...Opti
 	binary.BigEndian.PutUint16(tbid[:], t.id)
 	tkey := fdb.Key(tbid[:]).String()
 	opts := getOpts(args)
+	holder := []byte(typex.NewUUID())
 
 	defer func() {
 		// Перезапуск только в случае ошибки
@@ -199,7 +545,7 @@ func (t *v1Table) Autovacuum(ctx context.Context, cn db.Connection, args ...Opti
 			// И только если мы вообще можем еще запускать
 			if ctx.Err() == nil {
 				// Тогда стартуем заново и в s.wait ничего не ставим
-				go t.Autovacuum(ctx, cn)
+				go t.Autovacuum(ctx, cn, args...)
 				return
 			}
 		}
@@ -219,81 +565,278 @@ func (t *v1Table) Autovacuum(ctx context.Context, cn db.Connection, args ...Opti
 	// Работать должен постоянно
 	glog.Errorf("Start autovacuum on %s", tkey)
 	for ctx.Err() == nil {
-
-		// Выбираем случайное время с 00:00 до 06:00
-		// Чтобы делать темные делишки под покровом ночи
-		if opts.vwait > 0 {
-			timer = time.NewTimer(opts.vwait)
-		} else {
-			now := time.Now()
-			min := rand.Intn(60)
-			hour := rand.Intn(7)
-			when := time.Date(now.Year(), now.Month(), now.Day()+1, hour, min, 00, 00, now.Location())
-			timer = time.NewTimer(when.Sub(now))
-		}
+		timer = time.NewTimer(opts.vacuumDelay(time.Now()))
 
 		select {
 		case <-timer.C:
-			glog.Errorf("Run vacuum on %s", tkey)
-
-			if err = t.Vacuum(cn); err != nil {
+			if err = t.autovacuum(ctx, cn, holder, tkey, opts, args); err != nil {
 				return
 			}
-
-			glog.Errorf("Complete vacuum on %s", tkey)
 		case <-ctx.Done():
+			timer.Stop()
 			return
 		}
 	}
 }
 
-func (t *v1Table) Vacuum(dbc db.Connection) error {
-	if exp := mvcc.WithTx(dbc, func(tx mvcc.Tx) (err error) {
+// autovacuum - очистка, если пришло ее время и удалось взять аренду
+func (t *v1Table) autovacuum(
+	ctx context.Context,
+	cn db.Connection,
+	holder []byte,
+	tkey string,
+	opts options,
+	args []Option,
+) (err error) {
+	var ok bool
+	var rep VacuumReport
+
+	if ok, err = t.acquireLease(cn, holder, opts); err != nil || !ok {
+		return
+	}
 
-		// Этот запрос очищает только данные. Для них должен быть обработчик очистки BLOB
-		if err = tx.Vacuum(WrapTableKey(t.id, nil), mvcc.OnVacuum(t.onVacuum)); err != nil {
-			return
+	lost := make(chan struct{})
+	stop := make(chan struct{})
+	vctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Если аренду продлить не удалось, очистку прерываем - ее продолжит тот, кто аренду забрал
+	go func() {
+		defer close(stop)
+		renewLease(vctx, cancel, lost, cn, t.vacuumKey(vLease, nil), holder, opts.vlease)
+	}()
+
+	glog.Errorf("Run vacuum on %s", tkey)
+
+	// Отмена контекста прерывает очистку, прогресс сохранится до следующего запуска
+	rep, err = t.Vacuum(cn, append(args, VacuumContext(vctx))...)
+
+	// Дожидаемся остановки продления, чтобы оно не вернуло аренду после освобождения
+	cancel()
+	<-stop
+
+	if err != nil {
+		select {
+		case <-lost:
+			glog.Errorf("Lost vacuum lease on %s: %+v", tkey, rep)
+			return nil
+		default:
 		}
 
-		// Отдельно очистка всех индексов
-		if err = tx.Vacuum(fdbx.SkipRight(WrapIndexKey(t.id, 0, nil), 2)); err != nil {
-			return
+		if exp := t.releaseLease(cn, holder, false); exp != nil {
+			glog.Errorf("Release vacuum lease on %s: %s", tkey, exp)
 		}
 
-		// Отдельно очистка всех очередей
-		if err = tx.Vacuum(fdbx.SkipRight(WrapQueueKey(t.id, 0, nil, 0, nil), 3)); err != nil {
+		return
+	}
+
+	if err = t.releaseLease(cn, holder, true); err != nil {
+		return
+	}
+
+	glog.Errorf("Complete vacuum on %s: %+v", tkey, rep)
+	return nil
+}
+
+/*
+	Vacuum - очистка устаревших версий строк коллекции: данных, индексов, очередей и курсоров.
+
+	Префиксы очищаются по очереди, прогресс каждого из них сохраняется в БД в той же физической транзакции,
+	в которой удаляются строки. Если очистку прервать (ошибкой, падением или через VacuumContext),
+	следующий запуск продолжит с того же места. Так долгую очистку можно разбить на несколько коротких запусков.
+	После того, как пройдены все префиксы, прогресс сбрасывается и следующий запуск начинает сначала.
+
+	С опцией VacuumWorkers каждый префикс делится по границам шардов FDB и очищается в несколько потоков.
+*/
+func (t *v1Table) Vacuum(dbc db.Connection, args ...Option) (rep VacuumReport, err error) {
+	var part mvcc.VacuumReport
+	var marks map[byte]fdb.Key
+
+	start := time.Now()
+	opts := t.vacuumOpts(getOpts(args))
+
+	// Физические транзакции очистки могут повторяться, поэтому BLOB считаем по уникальным ключам
+	// При очистке в несколько потоков обработчик вызывается параллельно
+	var bmux sync.Mutex
+	blobs := make(map[string]struct{}, 64)
+	onVacuum := func(tx mvcc.Tx, w db.Writer, p fdb.KeyValue) (exp error) {
+		var bkey fdb.Key
+
+		if bkey, exp = t.onVacuum(tx, w, p); exp != nil {
 			return
 		}
 
+		if bkey != nil {
+			bmux.Lock()
+			blobs[bkey.String()] = struct{}{}
+			bmux.Unlock()
+		}
+
+		return nil
+	}
+
+	// Порядок важен, номер этапа сохраняется вместе с прогрессом
+	stages := []struct {
+		prefix fdb.Key
+		result *uint64
+		extra  []mvcc.Option
+	}{
+		// Этот запрос очищает только данные. Для них должен быть обработчик очистки BLOB
+		{WrapTableKey(t.id, nil), &rep.Versions, []mvcc.Option{mvcc.OnVacuum(onVacuum)}},
+		// Отдельно очистка всех индексов
+		{fdbx.SkipRight(WrapIndexKey(t.id, 0, nil), 2), &rep.Indexes, nil},
+		// Отдельно очистка всех очередей
+		{fdbx.SkipRight(WrapQueueKey(t.id, 0, nil, 0, nil), 3), &rep.Queues, nil},
 		// Отдельно очистка всех курсоров
-		if err = tx.Vacuum(WrapQueryKey(t.id, nil)); err != nil {
-			return
+		{WrapQueryKey(t.id, nil), &rep.Queries, nil},
+		// Отдельно очистка проекций покрывающих индексов
+		{fdb.Key{byte(t.id >> 8), byte(t.id), nsProject}, &rep.Indexes, nil},
+	}
+
+	if marks, err = t.vacuumMarks(dbc); err != nil {
+		return rep, ErrVacuum.WithReason(err)
+	}
+
+	if err = mvcc.WithTx(dbc, func(tx mvcc.Tx) (exp error) {
+		for i := range stages {
+			stage := byte(i)
+			mark, ok := marks[stage]
+
+			// Пустая отметка - этап уже пройден в одном из прошлых запусков
+			if ok && len(mark) == 0 {
+				continue
+			}
+
+			last := i == len(stages)-1
+			vopt := make([]mvcc.Option, 0, len(opts)+len(stages[i].extra)+2)
+			vopt = append(vopt, opts...)
+			vopt = append(vopt, stages[i].extra...)
+			vopt = append(vopt, mvcc.OnVacuumPart(func(w db.Writer, next fdb.Key) error {
+				// Весь цикл очистки завершен, прогресс больше не нужен
+				if last && len(next) == 0 {
+					w.Erase(t.vacuumKey(vMark, nil), t.vacuumKey(vMark, nil))
+					return nil
+				}
+
+				w.Upsert(fdb.KeyValue{Key: t.vacuumKey(vMark, fdb.Key{stage}), Value: next})
+				return nil
+			}))
+
+			if ok {
+				vopt = append(vopt, mvcc.From(mark))
+			}
+
+			part, exp = tx.Vacuum(stages[i].prefix, vopt...)
+			rep.add(part)
+			*stages[i].result = part.Removed
+
+			if exp != nil {
+				return
+			}
 		}
 
 		return nil
-	}); exp != nil {
-		return ErrVacuum.WithReason(exp)
+	}); err != nil {
+		rep.BLOBs = uint64(len(blobs))
+		rep.Duration = time.Since(start)
+		return rep, ErrVacuum.WithReason(err)
 	}
-	return nil
+
+	rep.BLOBs = uint64(len(blobs))
+	rep.Duration = time.Since(start)
+	return rep, nil
 }
 
-func (t *v1Table) onVacuum(tx mvcc.Tx, w db.Writer, p fdb.KeyValue) (err error) {
+// vacuumKey - служебный ключ состояния очистки, вне пространства версий строк
+func (t *v1Table) vacuumKey(flag byte, key fdb.Key) fdb.Key {
+	return mvcc.WrapKey(fdbx.AppendLeft(key, byte(t.id>>8), byte(t.id), nsVacuum, flag))
+}
+
+// vacuumMarks - загрузка прогресса прошлых запусков очистки: последний обработанный ключ по номеру этапа
+func (t *v1Table) vacuumMarks(dbc db.Connection) (res map[byte]fdb.Key, err error) {
+	skey := t.vacuumKey(vMark, nil)
+	res = make(map[byte]fdb.Key, 4)
+
+	if err = dbc.Read(func(r db.Reader) error {
+		rows := r.List(skey, skey, 0, false, false).GetSliceOrPanic()
+
+		for i := range rows {
+			// Пропускаем байт базы данных, он добавляется при выборке
+			if key := rows[i].Key[1:]; len(key) == len(skey)+1 {
+				res[key[len(skey)]] = rows[i].Value
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, ErrVacuum.WithReason(err)
+	}
+
+	return res, nil
+}
+
+func (r *VacuumReport) add(part mvcc.VacuumReport) {
+	r.Rows += part.Rows
+	r.Physical += part.Physical
+}
+
+// vacuumOpts - опции очистки с учетом настроек коллекции по умолчанию
+func (t *v1Table) vacuumOpts(opts options) []mvcc.Option {
+	res := make([]mvcc.Option, 0, 4)
+
+	if opts.vrate == 0 {
+		opts.vrate = t.options.vrate
+	}
+
+	if opts.vsize == 0 {
+		opts.vsize = t.options.vsize
+	}
+
+	if opts.vworkers == 0 {
+		opts.vworkers = t.options.vworkers
+	}
+
+	if opts.vrate > 0 {
+		res = append(res, mvcc.VacuumRate(opts.vrate))
+	}
+
+	if opts.vsize > 0 {
+		res = append(res, mvcc.VacuumBytes(opts.vsize))
+	}
+
+	if opts.vworkers > 1 {
+		res = append(res, mvcc.VacuumWorkers(opts.vworkers))
+	}
+
+	if opts.vctx != nil {
+		res = append(res, mvcc.VacuumContext(opts.vctx))
+	}
+
+	return res
+}
+
+// onVacuum - удаление BLOB устаревшей версии строки, возвращает ключ удаленного BLOB
+func (t *v1Table) onVacuum(tx mvcc.Tx, w db.Writer, p fdb.KeyValue) (_ fdb.Key, err error) {
 	var mod models.ValueT
 
 	val := p.Value
 
 	if len(val) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	models.GetRootAsValue(val, 0).UnPackTo(&mod)
 
 	// Если значение лежит в BLOB, надо удалить
-	if mod.Blob {
-		if err = tx.DropBLOB(WrapBlobKey(t.id, mod.Data), mvcc.Writer(w)); err != nil {
-			return ErrVacuum.WithReason(err)
-		}
+	if !mod.Blob {
+		return nil, nil
 	}
 
-	return nil
+	bkey := WrapBlobKey(t.id, mod.Data)
+
+	if err = tx.DropBLOB(bkey, mvcc.Writer(w)); err != nil {
+		return nil, ErrVacuum.WithReason(err)
+	}
+
+	return bkey, nil
 }
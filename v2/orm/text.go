@@ -0,0 +1,146 @@
+package orm
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2"
+)
+
+// Tokenize - слова текста после обработки анализаторами по порядку. Слово - последовательность букв и цифр
+func Tokenize(text string, args ...Analyzer) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i := range args {
+		words = args[i](words)
+	}
+
+	return words
+}
+
+// LowerCase - приведение слов к нижнему регистру
+func LowerCase() Analyzer {
+	return func(words []string) []string {
+		for i := range words {
+			words[i] = strings.ToLower(words[i])
+		}
+
+		return words
+	}
+}
+
+// StopWords - удаление слов, которые не нужно индексировать. Сравнение точное, поэтому обычно идет после LowerCase
+func StopWords(list ...string) Analyzer {
+	stop := make(map[string]struct{}, len(list))
+
+	for i := range list {
+		stop[list[i]] = struct{}{}
+	}
+
+	return func(words []string) []string {
+		res := words[:0]
+
+		for i := range words {
+			if _, ok := stop[words[i]]; !ok {
+				res = append(res, words[i])
+			}
+		}
+
+		return res
+	}
+}
+
+// Stemming - приведение слов к основе функцией stem, например SuffixStemmer или внешним стеммером
+func Stemming(stem func(string) string) Analyzer {
+	return func(words []string) []string {
+		res := words[:0]
+
+		for i := range words {
+			if word := stem(words[i]); word != "" {
+				res = append(res, word)
+			}
+		}
+
+		return res
+	}
+}
+
+/*
+	SuffixStemmer - простейший стеммер, который отбрасывает самое длинное из окончаний слова.
+
+	Окончание отбрасывается, только если от слова останется не меньше min букв, поэтому короткие слова не меняются.
+	Для точного стемминга лучше подключить через Stemming полноценный стеммер нужного языка.
+*/
+func SuffixStemmer(min int, suffixes ...string) func(string) string {
+	list := make([]string, len(suffixes))
+	copy(list, suffixes)
+	sort.Slice(list, func(i, j int) bool { return len(list[i]) > len(list[j]) })
+
+	return func(word string) string {
+		for i := range list {
+			if !strings.HasSuffix(word, list[i]) {
+				continue
+			}
+
+			if base := word[:len(word)-len(list[i])]; utf8.RuneCountInString(base) >= min {
+				return base
+			}
+		}
+
+		return word
+	}
+}
+
+// IndexTerms - слова текста так, как их сохраняет полнотекстовый индекс. Для остальных индексов nil
+func (t *v1Table) IndexTerms(idx uint16, text string) []string {
+	args, ok := t.options.analyzers[idx]
+
+	if !ok {
+		return nil
+	}
+
+	return Tokenize(text, args...)
+}
+
+// textKeys - ключи полнотекстового индекса: слово, нулевой байт и кол-во вхождений слова в текст строки
+func textKeys(terms []string) []fdb.Key {
+	freq := make(map[string]uint16, len(terms))
+
+	for _, term := range terms {
+		// Нулевой байт отделяет слово от кол-ва вхождений, поэтому в слове его быть не может
+		if term == "" || strings.IndexByte(term, 0x00) >= 0 {
+			continue
+		}
+
+		if freq[term] < math.MaxUint16 {
+			freq[term]++
+		}
+	}
+
+	keys := make([]fdb.Key, 0, len(freq))
+
+	for term, num := range freq {
+		keys = append(keys, fdbx.AppendRight(fdb.Key(term), 0x00, byte(num>>8), byte(num)))
+	}
+
+	return keys
+}
+
+// textFreq - кол-во вхождений слова из ключа строки полнотекстового индекса
+func textFreq(key fdb.Key) (uint16, bool) {
+	i := bytes.IndexByte(key, 0x00)
+
+	if i < 0 || len(key) < i+3 {
+		return 0, false
+	}
+
+	return uint16(key[i+1])<<8 | uint16(key[i+2]), true
+}
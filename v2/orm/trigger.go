@@ -0,0 +1,190 @@
+package orm
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+// triggerRun - изменения строк одной операции записи по ключам, для триггеров, счетчиков, представлений и индексов векторов
+type triggerRun struct {
+	t    *v1Table
+	trig bool
+	olds map[string][]byte
+	done map[string]RowChange
+}
+
+// newTriggerRun - изменения строк собираются, только если они нужны триггерам (когда trig), счетчикам, представлениям или индексам векторов
+func (t *v1Table) newTriggerRun(trig bool) *triggerRun {
+	trig = trig && (len(t.options.before) > 0 || len(t.options.after) > 0)
+
+	if !trig && !t.options.counters && len(t.materialized()) == 0 {
+		return &triggerRun{t: t}
+	}
+
+	return &triggerRun{
+		t:    t,
+		trig: trig,
+		olds: make(map[string][]byte, 8),
+		done: make(map[string]RowChange, 8),
+	}
+}
+
+func (r *triggerRun) active() bool { return r.done != nil }
+
+/*
+	write - физическая транзакция операции записи, в которой собираются изменения строк.
+
+	FDB повторяет физическую транзакцию при конфликтах, а изменения прошлой попытки не применились,
+	поэтому собранные ими старые значения и изменения сбрасываются в начале каждой попытки.
+	Без сбора изменений операция выполняет физическую транзакцию сама, как обычно.
+*/
+func (r *triggerRun) write(tx mvcc.Tx, hdl func(args ...mvcc.Option) error) error {
+	if !r.active() {
+		return hdl()
+	}
+
+	return tx.Conn().Write(func(w db.Writer) error {
+		r.olds = make(map[string][]byte, len(r.olds))
+		r.done = make(map[string]RowChange, len(r.done))
+		return hdl(mvcc.Writer(w))
+	})
+}
+
+// onDelete - замена строки при вставке: старое значение запоминается до вызова onInsert для того же ключа
+func (r *triggerRun) onDelete(tx mvcc.Tx, w db.Writer, pair fdb.KeyValue) (err error) {
+	var usr fdb.KeyValue
+
+	if r.active() {
+		if usr, err = newUsrPair(tx, r.t.id, pair); err != nil {
+			return ErrTrigger.WithReason(err)
+		}
+
+		r.olds[usr.Key.String()] = usr.Value
+	}
+
+	return r.t.onDelete(tx, w, pair)
+}
+
+// onInsert - вставка или изменение строки, триггеры до записи могут ее отменить
+func (r *triggerRun) onInsert(tx mvcc.Tx, w db.Writer, pair fdb.KeyValue) (err error) {
+	var usr fdb.KeyValue
+
+	if !r.active() {
+		return r.t.onInsert(tx, w, pair)
+	}
+
+	if usr, err = newUsrPair(tx, r.t.id, pair); err != nil {
+		return ErrTrigger.WithReason(err)
+	}
+
+	skey := usr.Key.String()
+	chg := RowChange{Kind: ChangeInsert, Key: usr.Key, New: usr.Value}
+
+	if old, ok := r.olds[skey]; ok {
+		chg.Kind = ChangeUpdate
+		chg.Old = old
+		delete(r.olds, skey)
+	}
+
+	if err = r.before(tx, chg); err != nil {
+		return
+	}
+
+	if err = r.t.onInsert(tx, w, pair); err != nil {
+		return
+	}
+
+	r.done[skey] = chg
+	return nil
+}
+
+// onDrop - удаление строки, триггеры до записи могут его отменить
+func (r *triggerRun) onDrop(tx mvcc.Tx, w db.Writer, pair fdb.KeyValue) (err error) {
+	var usr fdb.KeyValue
+
+	if !r.active() {
+		return r.t.onDrop(tx, w, pair)
+	}
+
+	if usr, err = newUsrPair(tx, r.t.id, pair); err != nil {
+		return ErrTrigger.WithReason(err)
+	}
+
+	chg := RowChange{Kind: ChangeDelete, Key: usr.Key, Old: usr.Value}
+
+	if err = r.before(tx, chg); err != nil {
+		return
+	}
+
+	if err = r.t.onDrop(tx, w, pair); err != nil {
+		return
+	}
+
+	r.done[usr.Key.String()] = chg
+	return nil
+}
+
+func (r *triggerRun) before(tx mvcc.Tx, chg RowChange) (err error) {
+	if !r.trig {
+		return nil
+	}
+
+	for i := range r.t.options.before {
+		if err = r.t.options.before[i](tx, chg); err != nil {
+			return ErrTrigger.WithReason(err).WithDebug(errx.Debug{"table": r.t.id, "key": chg.Key, "kind": chg.Kind})
+		}
+	}
+
+	return nil
+}
+
+/*
+	after - счетчики, представления, индексы векторов и триггеры после записи, в порядке ключей операции.
+
+	Физическая транзакция записи может повторяться, поэтому изменения собираются по ключам,
+	а обрабатываются только после ее завершения, ровно по разу на каждую измененную строку.
+*/
+func (r *triggerRun) after(tx mvcc.Tx, keys []fdb.Key) (err error) {
+	if !r.active() {
+		return nil
+	}
+
+	list := make([]RowChange, 0, len(r.done))
+
+	for _, key := range keys {
+		skey := key.String()
+
+		// Ключ мог повториться в одной операции, а изменение строки одно
+		if chg, ok := r.done[skey]; ok {
+			list = append(list, chg)
+			delete(r.done, skey)
+		}
+	}
+
+	if err = r.t.count(tx, list); err != nil {
+		return
+	}
+
+	for _, v := range r.t.materialized() {
+		if err = v.apply(tx, list); err != nil {
+			return
+		}
+	}
+
+	if !r.trig {
+		return nil
+	}
+
+	for _, chg := range list {
+		for i := range r.t.options.after {
+			if err = r.t.options.after[i](tx, chg); err != nil {
+				return ErrTrigger.WithReason(err).WithDebug(errx.Debug{"table": r.t.id, "key": chg.Key, "kind": chg.Kind})
+			}
+		}
+	}
+
+	return nil
+}
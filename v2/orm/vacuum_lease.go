@@ -0,0 +1,272 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+)
+
+// Окно по умолчанию - с 00:00 до 06:00, чтобы делать темные делишки под покровом ночи
+var defaultWindows = []vacuumWindow{{from: 0, to: 6 * time.Hour}}
+
+// vacuumWindow - окно времени автоочистки, смещения от начала суток по местному времени
+type vacuumWindow struct {
+	from time.Duration
+	to   time.Duration
+}
+
+// size - длительность окна, с учетом перехода через полночь
+func (w vacuumWindow) size() time.Duration {
+	if w.to > w.from {
+		return w.to - w.from
+	}
+
+	return w.to - w.from + 24*time.Hour
+}
+
+func (o options) vacuumWindows() []vacuumWindow {
+	if len(o.vwins) == 0 {
+		return defaultWindows
+	}
+
+	return o.vwins
+}
+
+// vacuumWindow - начало окна очистки, в которое попадает указанный момент
+func (o options) vacuumWindow(now time.Time) (start time.Time, ok bool) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	for _, w := range o.vacuumWindows() {
+		from := day.Add(w.from)
+
+		if w.to > w.from {
+			if !now.Before(from) && now.Before(day.Add(w.to)) {
+				return from, true
+			}
+			continue
+		}
+
+		// Окно переходит через полночь, значит могли начать еще вчера
+		if !now.Before(from) {
+			return from, true
+		}
+
+		if now.Before(day.Add(w.to)) {
+			return day.AddDate(0, 0, -1).Add(w.from), true
+		}
+	}
+
+	return start, false
+}
+
+// vacuumDelay - через сколько пора проверить, не нужна ли очистка
+func (o options) vacuumDelay(now time.Time) time.Duration {
+	var size time.Duration
+	var next time.Time
+
+	// С интервалом проверяем раз в интервал, а нужна ли очистка - решаем по времени прошлой
+	if o.vwait > 0 {
+		return o.vwait
+	}
+
+	// Внутри окна пробуем взять аренду не чаще, чем она истекает, со случайным сдвигом
+	if _, ok := o.vacuumWindow(now); ok {
+		return o.vlease + time.Duration(rand.Int63n(int64(o.vlease)))
+	}
+
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	for _, w := range o.vacuumWindows() {
+		from := day.Add(w.from)
+
+		if !from.After(now) {
+			from = day.AddDate(0, 0, 1).Add(w.from)
+		}
+
+		if next.IsZero() || from.Before(next) {
+			next = from
+			size = w.size()
+		}
+	}
+
+	// Случайный момент в первой половине окна, чтобы коллекции не очищались все разом
+	if size /= 2; size > 0 {
+		return next.Sub(now) + time.Duration(rand.Int63n(int64(size)))
+	}
+
+	return next.Sub(now)
+}
+
+// vacuumDue - пора ли запускать очистку, если прошлая полная очистка завершилась в момент done
+func (o options) vacuumDue(now, done time.Time) bool {
+	if o.vwait > 0 {
+		return now.Sub(done) >= o.vwait
+	}
+
+	start, ok := o.vacuumWindow(now)
+	return ok && done.Before(start)
+}
+
+// acquireLease - попытка взять аренду очистки коллекции, если пришло время очистки
+func (t *v1Table) acquireLease(cn db.Connection, holder []byte, opts options) (ok bool, err error) {
+	key := t.vacuumKey(vLease, nil)
+
+	if err = cn.Write(func(w db.Writer) (exp error) {
+		var done time.Time
+		var till time.Time
+
+		ok = false
+		now := time.Now()
+
+		if val := w.Data(t.vacuumKey(vDone, nil)); len(val) > 0 {
+			if done, exp = fdbx.Byte2Time(val); exp != nil {
+				return
+			}
+		}
+
+		if !opts.vacuumDue(now, done) {
+			return nil
+		}
+
+		// Свою аренду можно взять повторно, чужую - только если она истекла
+		if val := w.Data(key); len(val) > 8 && !bytes.Equal(val[8:], holder) {
+			if till, exp = fdbx.Byte2Time(val); exp != nil {
+				return
+			}
+
+			if till.After(now) {
+				return nil
+			}
+		}
+
+		w.Upsert(fdb.KeyValue{Key: key, Value: leaseValue(now.Add(opts.vlease), holder)})
+		ok = true
+		return nil
+	}); err != nil {
+		return false, ErrVacuum.WithReason(err)
+	}
+
+	return ok, nil
+}
+
+// renewLease - продление аренды, пока идет работа. Если продлить не удалось, работа отменяется
+func renewLease(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	lost chan struct{},
+	cn db.Connection,
+	key fdb.Key,
+	holder []byte,
+	ttl time.Duration,
+) {
+	tick := time.NewTicker(ttl / 3)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		ok := false
+
+		if err := cn.Write(func(w db.Writer) error {
+			ok = false
+
+			// Аренду уже забрали, пока мы не успели продлить
+			if val := w.Data(key); len(val) <= 8 || !bytes.Equal(val[8:], holder) {
+				return nil
+			}
+
+			w.Upsert(fdb.KeyValue{Key: key, Value: leaseValue(time.Now().Add(ttl), holder)})
+			ok = true
+			return nil
+		}); err != nil || !ok {
+			close(lost)
+			cancel()
+			return
+		}
+	}
+}
+
+// releaseLease - освобождение аренды и, если очистка завершена, сохранение времени завершения
+func (t *v1Table) releaseLease(cn db.Connection, holder []byte, done bool) (err error) {
+	key := t.vacuumKey(vLease, nil)
+
+	if err = cn.Write(func(w db.Writer) error {
+		if val := w.Data(key); len(val) > 8 && bytes.Equal(val[8:], holder) {
+			w.Delete(key)
+		}
+
+		if done {
+			w.Upsert(fdb.KeyValue{Key: t.vacuumKey(vDone, nil), Value: fdbx.Time2Byte(time.Now())})
+		}
+
+		return nil
+	}); err != nil {
+		return ErrVacuum.WithReason(err)
+	}
+
+	return nil
+}
+
+// waitLease - ожидание аренды: свою можно взять повторно, чужую - только когда она истечет или будет освобождена
+func waitLease(ctx context.Context, cn db.Connection, key fdb.Key, holder []byte, ttl time.Duration) (err error) {
+	for {
+		ok := false
+
+		if err = cn.Write(func(w db.Writer) (exp error) {
+			var till time.Time
+
+			ok = false
+			now := time.Now()
+
+			if val := w.Data(key); len(val) > 8 && !bytes.Equal(val[8:], holder) {
+				if till, exp = fdbx.Byte2Time(val); exp != nil {
+					return
+				}
+
+				if till.After(now) {
+					return nil
+				}
+			}
+
+			w.Upsert(fdb.KeyValue{Key: key, Value: leaseValue(now.Add(ttl), holder)})
+			ok = true
+			return nil
+		}); err != nil || ok {
+			return err
+		}
+
+		timer := time.NewTimer(ttl/3 + time.Duration(rand.Int63n(int64(ttl/3)+1)))
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// dropLease - освобождение аренды, если она все еще наша
+func dropLease(cn db.Connection, key fdb.Key, holder []byte) error {
+	return cn.Write(func(w db.Writer) error {
+		if val := w.Data(key); len(val) > 8 && bytes.Equal(val[8:], holder) {
+			w.Delete(key)
+		}
+		return nil
+	})
+}
+
+// leaseValue - значение аренды: время истечения и владелец
+func leaseValue(till time.Time, holder []byte) []byte {
+	return fdbx.AppendRight(fdbx.Time2Byte(till), holder...)
+}
@@ -0,0 +1,584 @@
+package orm
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	NewVectorIndex - индекс векторов размерности dim строк коллекции src для поиска ближайших соседей.
+
+	Векторы хранятся строками служебной коллекции id и изменяются при каждой вставке, изменении и удалении строк src,
+	включая Truncate, в той же логической транзакции, поэтому поиск видит изменения текущей транзакции.
+
+	Пока индекс не разбит на списки, поиск точный: просматриваются и сравниваются с запросом все векторы.
+	С опцией VectorLists при Rebuild векторы разбиваются на списки методом k-means, центры списков сохраняются
+	в служебных ключах, а новые векторы попадают в список ближайшего центра. Тогда поиск приближенный:
+	просматриваются только списки с ближайшими к запросу центрами, их кол-во задает опция VectorProbes (по умолчанию 1).
+
+	Векторы хранятся версиями строк, как в коллекции, поэтому каждое изменение оставляет устаревшую версию.
+	Их нужно очищать так же, как строки коллекции, через Vacuum или Autovacuum индекса.
+
+	Номер id - отдельное пространство ключей, он не должен совпадать с номерами коллекций.
+	Коллекция src должна быть создана через NewTable. Строки, записанные до создания индекса,
+	учитываются только после Rebuild.
+
+	Поддерживает опцию RebuildLease.
+*/
+func NewVectorIndex(id uint16, src Table, dim int, metric VectorMetric, f IndexVector, args ...Option) VectorIndex {
+	v := &v1Vectors{
+		id:      id,
+		dim:     dim,
+		src:     src,
+		tb:      NewTable(id),
+		metric:  metric,
+		vector:  f,
+		options: getOpts(args),
+	}
+
+	if tb, ok := src.(*v1Table); ok {
+		tb.materialize(v)
+	}
+
+	return v
+}
+
+type v1Vectors struct {
+	options
+	id     uint16
+	dim    int
+	src    Table
+	tb     Table
+	metric VectorMetric
+	vector IndexVector
+}
+
+func (v *v1Vectors) ID() uint16 { return v.id }
+
+// Nearest - строки коллекции по возрастанию расстояния до vec. Опция VectorProbes меняет кол-во списков для этой выборки
+func (v *v1Vectors) Nearest(tx mvcc.Tx, vec []float32, args ...Option) Query {
+	probes := v.options.probes
+
+	if opts := getOpts(args); opts.probes > 0 {
+		probes = opts.probes
+	}
+
+	return NewQuery(v.src, tx).BySelector(&vectorSelector{v: v, tx: tx, vec: vec, probes: probes})
+}
+
+/*
+	Rebuild - пересчет индекса с нуля по всем строкам коллекции, с разбиением на списки по опции VectorLists.
+
+	Пересчет идет под арендой (см. RebuildLease): пока она действует, коммит транзакций, изменивших коллекцию,
+	завершается ошибкой ErrVector, а сам пересчет сначала дожидается транзакций, начатых до взятия аренды.
+	Поэтому строки коллекции не меняются, пока они читаются пачками в разных физических транзакциях.
+	Все векторы держатся в памяти на время разбиения.
+
+	Новые центры и векторы записываются пачками в отдельное поколение ключей, а поиск и изменения строк
+	до конца пересчета используют прежнее. Переключение на новое поколение выполняется одной физической транзакцией,
+	после чего прежнее удаляется: поиск, начатый до переключения, может не увидеть часть строк.
+	Транзакция, изменившая строки до переключения, а коммит выполняющая после него, завершается ошибкой ErrVector.
+	Если пересчет прервался, прежнее поколение остается действующим, а недописанное удалит следующий пересчет.
+
+	Нельзя вызывать внутри незавершенной транзакции, которая что-то изменяла: пересчет будет ждать ее завершения.
+*/
+func (v *v1Vectors) Rebuild(ctx context.Context, cn db.Connection) (rep VectorReport, err error) {
+	var gen byte
+	var vec []float32
+	var lease *rebuildLease
+
+	start := time.Now()
+	keys := make([]fdb.Key, 0, vectorBatch)
+	vecs := make([][]float32, 0, vectorBatch)
+
+	defer func() { rep.Duration = time.Since(start) }()
+
+	if lease, err = takeRebuild(ctx, cn, v.stateKey(gLease), v.options.rlease); err != nil {
+		return rep, ErrVector.WithReason(err)
+	}
+
+	defer func() {
+		if exp := lease.release(cn); exp != nil && err == nil {
+			err = ErrVector.WithReason(exp)
+		}
+	}()
+
+	tx := mvcc.Begin(cn)
+	defer tx.Cancel()
+
+	pairs, errs := v.src.Select(tx).Sequence(lease.ctx)
+
+	for pair := range pairs {
+		rep.Rows++
+
+		if vec, err = v.load(pair.Value); err != nil {
+			return rep, ErrVector.WithReason(err).WithDebug(errx.Debug{"index": v.id, "key": pair.Key})
+		}
+
+		if vec != nil {
+			keys = append(keys, pair.Key)
+			vecs = append(vecs, vec)
+		}
+	}
+
+	for err = range errs {
+		if err != nil {
+			return rep, ErrVector.WithReason(err)
+		}
+	}
+
+	if err = lease.ctx.Err(); err != nil {
+		return rep, ErrVector.WithReason(err)
+	}
+
+	cents := vectorTrain(vecs, v.options.lists, v.metric)
+
+	// Новое поколение могло остаться от прерванного пересчета, его очищаем и сразу пишем центры
+	if err = cn.Write(func(w db.Writer) error {
+		gen = v.generation(w.Reader) ^ 1
+		v.erase(w, gen)
+
+		for i := range cents {
+			w.Upsert(fdb.KeyValue{Key: v.centerKey(gen, uint16(i)), Value: vectorBytes(cents[i])})
+		}
+
+		return nil
+	}); err != nil {
+		return rep, ErrVector.WithReason(err)
+	}
+
+	for i := 0; i < len(keys); i += vectorBatch {
+		size := len(keys) - i
+
+		if size > vectorBatch {
+			size = vectorBatch
+		}
+
+		part := make([]fdb.KeyValue, size)
+
+		for j := range part {
+			part[j] = fdb.KeyValue{
+				Key:   v.entryKey(gen, vectorList(cents, vecs[i+j], v.metric), keys[i+j]),
+				Value: vectorBytes(vecs[i+j]),
+			}
+		}
+
+		wtx := mvcc.Begin(cn)
+
+		if err = v.tb.Upsert(wtx, part...); err != nil {
+			wtx.Cancel()
+			return rep, ErrVector.WithReason(err)
+		}
+
+		if err = wtx.Commit(); err != nil {
+			return rep, ErrVector.WithReason(err)
+		}
+
+		rep.Vectors += uint64(size)
+	}
+
+	if err = cn.Write(func(w db.Writer) error {
+		if !lease.owned(w) {
+			return ErrVector.WithDetail("Vector rebuild lease lost")
+		}
+
+		w.Upsert(fdb.KeyValue{Key: v.stateKey(gGen), Value: []byte{gen}})
+		v.erase(w, gen^1)
+		return nil
+	}); err != nil {
+		return rep, ErrVector.WithReason(err)
+	}
+
+	rep.Lists = uint64(len(cents))
+	return rep, nil
+}
+
+// Drop - физическое удаление всех векторов, центров списков и сохраненных курсоров выборок индекса
+func (v *v1Vectors) Drop(cn db.Connection) (err error) {
+	if err = v.tb.Drop(cn); err != nil {
+		return ErrVector.WithReason(err)
+	}
+
+	return nil
+}
+
+// Vacuum - очистка устаревших версий векторов, поддерживает те же опции, что и очистка коллекции
+func (v *v1Vectors) Vacuum(cn db.Connection, args ...Option) (rep VacuumReport, err error) {
+	if rep, err = v.tb.Vacuum(cn, args...); err != nil {
+		return rep, ErrVector.WithReason(err)
+	}
+
+	return rep, nil
+}
+
+// Autovacuum - периодическая очистка устаревших версий векторов, пока не будет отменен контекст, как у коллекции
+func (v *v1Vectors) Autovacuum(ctx context.Context, cn db.Connection, args ...Option) {
+	v.tb.Autovacuum(ctx, cn, args...)
+}
+
+/*
+	apply - изменение векторов по изменениям строк операции. Если список вектора не поменялся, он просто перезаписывается.
+
+	Векторы пишутся в действующее поколение индекса. Если к коммиту идет пересчет или поколение уже сменилось,
+	коммит завершается ошибкой: записанные векторы не попали бы в новое поколение.
+*/
+func (v *v1Vectors) apply(tx mvcc.Tx, list []RowChange) (err error) {
+	var gen byte
+	var vec []float32
+	var cents [][]float32
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	if gen, cents, err = v.centers(tx); err != nil {
+		return ErrVector.WithReason(err)
+	}
+
+	tx.OnCommit(func(w db.Writer) error {
+		busy, exp := rebuildBusy(w.Reader, v.stateKey(gLease))
+
+		if exp != nil {
+			return ErrVector.WithReason(exp)
+		}
+
+		if busy || v.generation(w.Reader) != gen {
+			return ErrVector.WithDetail("Vector index %d is being rebuilt", v.id)
+		}
+
+		return nil
+	})
+
+	drop := make(map[string]fdb.Key, len(list))
+	save := make([]fdb.KeyValue, 0, len(list))
+
+	for i := range list {
+		// Строка с неподходящим вектором в индекс не попала, поэтому ее старое значение пропускаем
+		if list[i].Kind != ChangeInsert {
+			if vec, _ = v.load(list[i].Old); vec != nil {
+				key := v.entryKey(gen, vectorList(cents, vec, v.metric), list[i].Key)
+				drop[string(key)] = key
+			}
+		}
+
+		if list[i].Kind != ChangeDelete {
+			if vec, err = v.load(list[i].New); err != nil {
+				return ErrVector.WithReason(err).WithDebug(errx.Debug{"index": v.id, "key": list[i].Key})
+			}
+
+			if vec != nil {
+				key := v.entryKey(gen, vectorList(cents, vec, v.metric), list[i].Key)
+				save = append(save, fdb.KeyValue{Key: key, Value: vectorBytes(vec)})
+				delete(drop, string(key))
+			}
+		}
+	}
+
+	if len(drop) > 0 {
+		keys := make([]fdb.Key, 0, len(drop))
+
+		for _, key := range drop {
+			keys = append(keys, key)
+		}
+
+		if err = v.tb.Delete(tx, keys...); err != nil {
+			return ErrVector.WithReason(err)
+		}
+	}
+
+	if len(save) > 0 {
+		if err = v.tb.Upsert(tx, save...); err != nil {
+			return ErrVector.WithReason(err)
+		}
+	}
+
+	return nil
+}
+
+// load - вектор строки для индекса: проверяется размерность, для косинусного расстояния вектор нормируется
+func (v *v1Vectors) load(val []byte) (vec []float32, err error) {
+	if vec, err = v.vector(val); err != nil || len(vec) == 0 {
+		return nil, err
+	}
+
+	return v.norm(vec)
+}
+
+// norm - копия вектора, пригодная для сравнения с векторами индекса
+func (v *v1Vectors) norm(vec []float32) (_ []float32, err error) {
+	if len(vec) != v.dim {
+		return nil, ErrValPack.WithDetail("Invalid vector size %d, expected %d", len(vec), v.dim)
+	}
+
+	var sum float64
+	res := make([]float32, len(vec))
+
+	for i := range vec {
+		if math.IsNaN(float64(vec[i])) || math.IsInf(float64(vec[i]), 0) {
+			return nil, ErrValPack.WithDetail("Invalid vector value at %d", i)
+		}
+
+		res[i] = vec[i]
+		sum += float64(vec[i]) * float64(vec[i])
+	}
+
+	if v.metric != VectorCosine {
+		return res, nil
+	}
+
+	if sum == 0 {
+		return nil, ErrValPack.WithDetail("Zero vector has no cosine distance")
+	}
+
+	vectorScale(res, sum)
+	return res, nil
+}
+
+// centers - действующее поколение индекса и его центры списков по порядку номеров. Пока индекс не разбит на списки, их нет
+func (v *v1Vectors) centers(tx mvcc.Tx) (gen byte, res [][]float32, err error) {
+	err = tx.Conn().Read(func(r db.Reader) error {
+		gen = v.generation(r)
+		skey := mvcc.WrapKey(fdb.Key{byte(v.id >> 8), byte(v.id), nsVector, gen})
+		rows := r.List(skey, skey, 0, false, false).GetSliceOrPanic()
+		res = make([][]float32, len(rows))
+
+		for i := range rows {
+			res[i] = vectorValue(rows[i].Value)
+		}
+
+		return nil
+	})
+
+	return gen, res, err
+}
+
+// centerKey - служебный ключ центра списка в поколении gen
+func (v *v1Vectors) centerKey(gen byte, num uint16) fdb.Key {
+	return mvcc.WrapKey(fdb.Key{byte(v.id >> 8), byte(v.id), nsVector, gen, byte(num >> 8), byte(num)})
+}
+
+// entryKey - ключ вектора в служебной коллекции: поколение, номер списка и ключ строки
+func (v *v1Vectors) entryKey(gen byte, num uint16, key fdb.Key) fdb.Key {
+	res := make(fdb.Key, 3, 3+len(key))
+	res[0] = gen
+	binary.BigEndian.PutUint16(res[1:], num)
+	return append(res, key...)
+}
+
+// stateKey - служебный ключ пересчета: аренда или действующее поколение индекса
+func (v *v1Vectors) stateKey(kind byte) fdb.Key {
+	return mvcc.WrapKey(fdb.Key{byte(v.id >> 8), byte(v.id), nsState, kind})
+}
+
+// generation - действующее поколение индекса. Пока индекс не пересчитывали, оно нулевое
+func (v *v1Vectors) generation(r db.Reader) byte {
+	if val := r.Data(v.stateKey(gGen)); len(val) > 0 {
+		return val[0]
+	}
+
+	return 0
+}
+
+// erase - физическое удаление центров и всех версий векторов поколения gen
+func (v *v1Vectors) erase(w db.Writer, gen byte) {
+	ckey := mvcc.WrapKey(fdb.Key{byte(v.id >> 8), byte(v.id), nsVector, gen})
+	vkey := mvcc.WrapKey(WrapTableKey(v.tb.ID(), fdb.Key{gen}))
+	w.Erase(ckey, ckey)
+	w.Erase(vkey, vkey)
+}
+
+// VectorDistance - расстояние между векторами одной размерности
+func VectorDistance(metric VectorMetric, a, b []float32) float64 {
+	if metric != VectorCosine {
+		return vectorDist(metric, a, b)
+	}
+
+	var dot, na, nb float64
+
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 1
+	}
+
+	return math.Max(0, 1-dot/math.Sqrt(na*nb))
+}
+
+// vectorDist - расстояние между векторами индекса, для косинусного расстояния они уже нормированы. Не бывает отрицательным
+func vectorDist(metric VectorMetric, a, b []float32) float64 {
+	var sum float64
+
+	if metric == VectorCosine {
+		for i := range a {
+			sum += float64(a[i]) * float64(b[i])
+		}
+
+		return math.Max(0, 1-sum)
+	}
+
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+
+	return math.Sqrt(sum)
+}
+
+// vectorList - номер списка с ближайшим к вектору центром. Без списков все векторы в нулевом
+func vectorList(cents [][]float32, vec []float32, metric VectorMetric) uint16 {
+	best := 0
+	dist := math.Inf(1)
+
+	for i := range cents {
+		if d := vectorDist(metric, cents[i], vec); d < dist {
+			best, dist = i, d
+		}
+	}
+
+	return uint16(best)
+}
+
+// vectorProbe - номера списков с probes ближайшими к вектору центрами
+func vectorProbe(cents [][]float32, vec []float32, metric VectorMetric, probes int) []uint16 {
+	if len(cents) == 0 {
+		return []uint16{0}
+	}
+
+	dist := make([]float64, len(cents))
+	nums := make([]uint16, len(cents))
+
+	for i := range cents {
+		nums[i] = uint16(i)
+		dist[i] = vectorDist(metric, cents[i], vec)
+	}
+
+	sort.SliceStable(nums, func(i, j int) bool { return dist[nums[i]] < dist[nums[j]] })
+
+	if probes < 1 {
+		probes = 1
+	}
+
+	if probes < len(nums) {
+		nums = nums[:probes]
+	}
+
+	return nums
+}
+
+/*
+	vectorTrain - центры списков для векторов методом k-means.
+
+	Начальные центры берутся из векторов равномерно по порядку, поэтому результат не случайный.
+	Для косинусного расстояния центры нормируются после каждой итерации. Если списков меньше двух, их нет.
+*/
+func vectorTrain(vecs [][]float32, lists int, metric VectorMetric) [][]float32 {
+	if lists > len(vecs) {
+		lists = len(vecs)
+	}
+
+	if lists < 2 {
+		return nil
+	}
+
+	cents := make([][]float32, lists)
+
+	for i := range cents {
+		cents[i] = append([]float32(nil), vecs[i*len(vecs)/lists]...)
+	}
+
+	owner := make([]uint16, len(vecs))
+
+	for iter := 0; iter < vectorIters; iter++ {
+		moved := iter == 0
+
+		for i := range vecs {
+			if num := vectorList(cents, vecs[i], metric); num != owner[i] {
+				owner[i] = num
+				moved = true
+			}
+		}
+
+		if !moved {
+			break
+		}
+
+		sums := make([][]float64, lists)
+		cnts := make([]int, lists)
+
+		for i := range vecs {
+			num := owner[i]
+
+			if sums[num] == nil {
+				sums[num] = make([]float64, len(vecs[i]))
+			}
+
+			for j := range vecs[i] {
+				sums[num][j] += float64(vecs[i][j])
+			}
+
+			cnts[num]++
+		}
+
+		// Опустевший список сохраняет прежний центр
+		for num := range cents {
+			if cnts[num] == 0 {
+				continue
+			}
+
+			var sum float64
+
+			for j := range cents[num] {
+				cents[num][j] = float32(sums[num][j] / float64(cnts[num]))
+				sum += float64(cents[num][j]) * float64(cents[num][j])
+			}
+
+			if metric == VectorCosine && sum > 0 {
+				vectorScale(cents[num], sum)
+			}
+		}
+	}
+
+	return cents
+}
+
+// vectorScale - нормирование вектора по сумме квадратов его значений
+func vectorScale(vec []float32, sum float64) {
+	norm := math.Sqrt(sum)
+
+	for i := range vec {
+		vec[i] = float32(float64(vec[i]) / norm)
+	}
+}
+
+func vectorBytes(vec []float32) []byte {
+	buf := make([]byte, 4*len(vec))
+
+	for i := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(vec[i]))
+	}
+
+	return buf
+}
+
+func vectorValue(buf []byte) []float32 {
+	vec := make([]float32, len(buf)/4)
+
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+
+	return vec
+}
@@ -0,0 +1,533 @@
+package orm
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2"
+	"github.com/shestakovda/fdbx/v2/db"
+	"github.com/shestakovda/fdbx/v2/models"
+	"github.com/shestakovda/fdbx/v2/mvcc"
+)
+
+/*
+	NewView - материализованное представление коллекции src: строки группируются по ключу group,
+	для каждой группы ведется кол-во строк и суммы показателей из опции ViewSum.
+
+	Представление изменяется при каждой вставке, изменении и удалении строк коллекции, включая Truncate,
+	в той же логической транзакции. Изменения групп собираются по операциям и атомарно прибавляются при коммите,
+	поэтому параллельные транзакции не конфликтуют на общих группах и не теряют изменений друг друга.
+	Как и счетчики, до коммита представление изменений текущей транзакции не учитывает.
+
+	Номер id - отдельное пространство ключей, он не должен совпадать с номерами коллекций.
+	Коллекция src должна быть создана через NewTable. Строки, записанные до создания представления,
+	учитываются только после Rebuild.
+
+	Поддерживает опцию RebuildLease.
+*/
+func NewView(id uint16, src Table, group ViewGroup, args ...Option) View {
+	v := &v1View{
+		id:      id,
+		src:     src,
+		tb:      NewTable(id),
+		group:   group,
+		options: getOpts(args),
+	}
+
+	if tb, ok := src.(*v1Table); ok {
+		tb.materialize(v)
+	}
+
+	return v
+}
+
+type v1View struct {
+	options
+	id    uint16
+	src   Table
+	tb    Table
+	group ViewGroup
+}
+
+func (v *v1View) ID() uint16 { return v.id }
+
+func (v *v1View) Select(tx mvcc.Tx) Query {
+	return NewQuery(v.tb, tx).BySelector(&viewSelector{v: v, tx: tx})
+}
+
+// Get - строка представления по ключу группы. Если в группе нет строк, возвращается ErrNotFound
+func (v *v1View) Get(tx mvcc.Tx, group fdb.Key) (res ViewRow, err error) {
+	if err = tx.Conn().Read(func(r db.Reader) error {
+		gen := v.generation(r)
+		cnt := r.Data(v.viewKey(gen, 0, group))
+
+		if viewValue(cnt) <= 0 {
+			return ErrNotFound.WithDebug(errx.Debug{"view": v.id, "group": group})
+		}
+
+		res = v.read(r, gen, []fdb.Key{group}, [][]byte{cnt})[0]
+		return nil
+	}); err != nil {
+		return res, ErrView.WithReason(err)
+	}
+
+	return res, nil
+}
+
+/*
+	Rebuild - пересчет представления с нуля по всем строкам коллекции.
+
+	Пересчет идет под арендой (см. RebuildLease): пока она действует, коммит транзакций, изменивших коллекцию,
+	завершается ошибкой ErrView, а сам пересчет сначала дожидается транзакций, начатых до взятия аренды.
+	Поэтому строки коллекции не меняются, пока они читаются пачками в разных физических транзакциях.
+
+	Новые группы записываются пачками в отдельное поколение ключей, а выборки до конца пересчета видят прежнее.
+	Переключение на новое поколение и удаление прежнего выполняются одной физической транзакцией.
+	Если пересчет прервался, прежнее поколение остается действующим, а недописанное удалит следующий пересчет.
+
+	Нельзя вызывать внутри незавершенной транзакции, которая что-то изменяла: пересчет будет ждать ее завершения.
+*/
+func (v *v1View) Rebuild(ctx context.Context, cn db.Connection) (rep ViewReport, err error) {
+	var gen byte
+	var lease *rebuildLease
+
+	start := time.Now()
+	delta := make(map[string][]int64, viewBatch)
+
+	defer func() { rep.Duration = time.Since(start) }()
+
+	if lease, err = takeRebuild(ctx, cn, v.stateKey(gLease), v.options.rlease); err != nil {
+		return rep, ErrView.WithReason(err)
+	}
+
+	defer func() {
+		if exp := lease.release(cn); exp != nil && err == nil {
+			err = ErrView.WithReason(exp)
+		}
+	}()
+
+	tx := mvcc.Begin(cn)
+	defer tx.Cancel()
+
+	pairs, errs := v.src.Select(tx).Sequence(lease.ctx)
+
+	for pair := range pairs {
+		rep.Rows++
+
+		if err = v.add(delta, 1, pair.Value); err != nil {
+			return rep, ErrView.WithReason(err)
+		}
+	}
+
+	for err = range errs {
+		if err != nil {
+			return rep, ErrView.WithReason(err)
+		}
+	}
+
+	if err = lease.ctx.Err(); err != nil {
+		return rep, ErrView.WithReason(err)
+	}
+
+	groups := make([]string, 0, len(delta))
+
+	for group := range delta {
+		groups = append(groups, group)
+	}
+
+	// Новое поколение могло остаться от прерванного пересчета, его очищаем
+	if err = cn.Write(func(w db.Writer) error {
+		gen = v.generation(w.Reader) ^ 1
+		w.Erase(v.genKey(gen), v.genKey(gen))
+		return nil
+	}); err != nil {
+		return rep, ErrView.WithReason(err)
+	}
+
+	for i := 0; i < len(groups); i += viewBatch {
+		part := groups[i:]
+
+		if len(part) > viewBatch {
+			part = part[:viewBatch]
+		}
+
+		if err = cn.Write(func(w db.Writer) error {
+			for _, group := range part {
+				for j, num := range delta[group] {
+					if num != 0 {
+						w.Upsert(fdb.KeyValue{Key: v.viewKey(gen, byte(j), fdb.Key(group)), Value: viewBytes(num)})
+					}
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return rep, ErrView.WithReason(err)
+		}
+
+		rep.Groups += uint64(len(part))
+	}
+
+	if err = cn.Write(func(w db.Writer) error {
+		if !lease.owned(w) {
+			return ErrView.WithDetail("View rebuild lease lost")
+		}
+
+		w.Upsert(fdb.KeyValue{Key: v.stateKey(gGen), Value: []byte{gen}})
+		w.Erase(v.genKey(gen^1), v.genKey(gen^1))
+		return nil
+	}); err != nil {
+		return rep, ErrView.WithReason(err)
+	}
+
+	return rep, nil
+}
+
+// Drop - физическое удаление всех групп представления и сохраненных курсоров его выборок
+func (v *v1View) Drop(cn db.Connection) (err error) {
+	if err = v.tb.Drop(cn); err != nil {
+		return ErrView.WithReason(err)
+	}
+
+	return nil
+}
+
+/*
+	apply - изменение групп представления по изменениям строк операции, атомарными прибавлениями при коммите.
+
+	Пока идет пересчет, коммит завершается ошибкой: строки, которые пересчет уже прочитал, менять нельзя.
+*/
+func (v *v1View) apply(tx mvcc.Tx, list []RowChange) (err error) {
+	delta := make(map[string][]int64, 8)
+
+	for i := range list {
+		if list[i].Kind != ChangeInsert {
+			if err = v.add(delta, -1, list[i].Old); err != nil {
+				return ErrView.WithReason(err).WithDebug(errx.Debug{"view": v.id, "key": list[i].Key})
+			}
+		}
+
+		if list[i].Kind != ChangeDelete {
+			if err = v.add(delta, 1, list[i].New); err != nil {
+				return ErrView.WithReason(err).WithDebug(errx.Debug{"view": v.id, "key": list[i].Key})
+			}
+		}
+	}
+
+	if len(delta) == 0 {
+		return nil
+	}
+
+	tx.OnCommit(func(w db.Writer) error {
+		busy, exp := rebuildBusy(w.Reader, v.stateKey(gLease))
+
+		if exp != nil {
+			return ErrView.WithReason(exp)
+		}
+
+		if busy {
+			return ErrView.WithDetail("View %d is being rebuilt", v.id)
+		}
+
+		gen := v.generation(w.Reader)
+
+		for group, nums := range delta {
+			for j := range nums {
+				if nums[j] == 0 {
+					continue
+				}
+
+				// Обнулившиеся значения удаляем, чтобы опустевшие группы не копились
+				key := v.viewKey(gen, byte(j), fdb.Key(group))
+				w.Increment(key, nums[j])
+				w.Vanish(key)
+			}
+		}
+
+		return nil
+	})
+
+	return nil
+}
+
+// add - прибавление строки к ее группе: кол-во строк и показатели со знаком sign
+func (v *v1View) add(delta map[string][]int64, sign int64, val []byte) (err error) {
+	var num int64
+	var group fdb.Key
+
+	if group, err = v.group(val); err != nil || len(group) == 0 {
+		return
+	}
+
+	nums, ok := delta[string(group)]
+
+	if !ok {
+		nums = make([]int64, len(v.options.measures)+1)
+		delta[string(group)] = nums
+	}
+
+	nums[0] += sign
+
+	for j := range v.options.measures {
+		if num, err = v.options.measures[j](val); err != nil {
+			return
+		}
+
+		nums[j+1] += sign * num
+	}
+
+	return nil
+}
+
+// read - строки групп поколения gen по уже прочитанным кол-вам строк, суммы показателей читаются параллельно
+func (v *v1View) read(r db.Reader, gen byte, groups []fdb.Key, counts [][]byte) []ViewRow {
+	sums := make([][]fdb.FutureByteSlice, len(groups))
+
+	for i := range groups {
+		sums[i] = make([]fdb.FutureByteSlice, len(v.options.measures))
+
+		for j := range sums[i] {
+			sums[i][j] = r.Item(v.viewKey(gen, byte(j+1), groups[i]))
+		}
+	}
+
+	res := make([]ViewRow, len(groups))
+
+	for i := range groups {
+		res[i] = ViewRow{
+			Group: groups[i],
+			Count: viewValue(counts[i]),
+			Sums:  make([]int64, len(sums[i])),
+		}
+
+		for j := range sums[i] {
+			res[i].Sums[j] = viewValue(sums[i][j].MustGet())
+		}
+	}
+
+	return res
+}
+
+// viewKey - служебный ключ значения группы в поколении gen: 0 - кол-во строк, дальше суммы показателей по порядку
+func (v *v1View) viewKey(gen, field byte, group fdb.Key) fdb.Key {
+	return mvcc.WrapKey(fdbx.AppendLeft(group, byte(v.id>>8), byte(v.id), nsView, gen, field))
+}
+
+// genKey - префикс всех значений групп поколения gen
+func (v *v1View) genKey(gen byte) fdb.Key {
+	return mvcc.WrapKey(fdb.Key{byte(v.id >> 8), byte(v.id), nsView, gen})
+}
+
+// stateKey - служебный ключ пересчета: аренда или действующее поколение групп
+func (v *v1View) stateKey(kind byte) fdb.Key {
+	return mvcc.WrapKey(fdb.Key{byte(v.id >> 8), byte(v.id), nsState, kind})
+}
+
+// generation - действующее поколение групп. Пока представление не пересчитывали, оно нулевое
+func (v *v1View) generation(r db.Reader) byte {
+	if val := r.Data(v.stateKey(gGen)); len(val) > 0 {
+		return val[0]
+	}
+
+	return 0
+}
+
+// ParseViewRow - разбор пары из выборки представления
+func ParseViewRow(pair fdb.KeyValue) (res ViewRow, err error) {
+	if len(pair.Value) < 8 || len(pair.Value)%8 != 0 {
+		return res, ErrValUnpack.WithDetail("Invalid view row size %d", len(pair.Value))
+	}
+
+	res.Group = pair.Key
+	res.Count = viewValue(pair.Value)
+	res.Sums = make([]int64, len(pair.Value)/8-1)
+
+	for j := range res.Sums {
+		res.Sums[j] = viewValue(pair.Value[8*(j+1):])
+	}
+
+	return res, nil
+}
+
+// value - значение строки представления в выборке: кол-во строк и суммы подряд
+func (r ViewRow) value() []byte {
+	buf := make([]byte, 8*(len(r.Sums)+1))
+	binary.LittleEndian.PutUint64(buf, uint64(r.Count))
+
+	for j := range r.Sums {
+		binary.LittleEndian.PutUint64(buf[8*(j+1):], uint64(r.Sums[j]))
+	}
+
+	return buf
+}
+
+// viewValue - значение после атомарных прибавлений, отсутствующее значение равно нулю
+func viewValue(val []byte) int64 {
+	if len(val) < 8 {
+		return 0
+	}
+
+	return int64(binary.LittleEndian.Uint64(val))
+}
+
+func viewBytes(num int64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(num))
+	return buf[:]
+}
+
+// viewSelector - выборка групп представления в порядке их ключей
+type viewSelector struct {
+	v  *v1View
+	tx mvcc.Tx
+}
+
+func (s *viewSelector) Select(ctx context.Context, _ Table, args ...Option) (<-chan Selected, <-chan error) {
+	list := make(chan Selected)
+	errs := make(chan error, 1)
+
+	go func() {
+		var err error
+		var rows []ViewRow
+		var last fdb.Key
+		var done bool
+
+		defer close(list)
+		defer close(errs)
+
+		opts := getOpts(args)
+
+		if len(opts.lastkey) > 0 {
+			last = opts.lastkey
+		}
+
+		for !done {
+			if err = s.tx.Conn().Read(func(r db.Reader) (exp error) {
+				var bound fdb.Key
+				var part []fdb.KeyValue
+
+				// Поколение могло смениться между пачками, поэтому границу задаем ключом группы
+				gen := s.v.generation(r)
+				skey := s.v.viewKey(gen, 0, nil)
+
+				if last != nil {
+					bound = s.v.viewKey(gen, 0, last)
+				}
+
+				if part, exp = s.part(r, skey, bound, opts.reverse); exp != nil {
+					return
+				}
+
+				groups := make([]fdb.Key, len(part))
+				counts := make([][]byte, len(part))
+
+				for i := range part {
+					groups[i] = part[i].Key[len(skey):]
+					counts[i] = part[i].Value
+				}
+
+				rows = s.v.read(r, gen, groups, counts)
+				done = len(part) < viewBatch
+
+				if len(part) > 0 {
+					last = groups[len(groups)-1]
+				}
+
+				return nil
+			}); err != nil {
+				errs <- ErrSelect.WithReason(err)
+				return
+			}
+
+			for i := range rows {
+				// Счетчик мог еще не обнулиться в пределах пачки чужой транзакции
+				if rows[i].Count <= 0 {
+					continue
+				}
+
+				pair := fdb.KeyValue{
+					Key:   WrapTableKey(s.v.id, rows[i].Group),
+					Value: fdbx.FlatPack(&models.ValueT{Data: rows[i].value()}),
+				}
+
+				select {
+				case list <- Selected{rows[i].Group, pair}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return list, errs
+}
+
+// part - пачка счетчиков строк групп строго после границы bound (или до нее, в обратном порядке)
+func (s *viewSelector) part(r db.Reader, skey, bound fdb.Key, reverse bool) (res []fdb.KeyValue, err error) {
+	from := skey
+	last := skey
+
+	if !reverse {
+		if bound != nil {
+			from = fdbx.AppendRight(bound, 0x00)
+		}
+
+		return viewRows(r.List(from, last, viewBatch, false, false).GetSliceOrPanic()), nil
+	}
+
+	if bound == nil {
+		return viewRows(r.List(from, last, viewBatch, true, false).GetSliceOrPanic()), nil
+	}
+
+	// Ключей меньше границы, отличающихся от нее только хвостом нулей, нет в диапазоне - читаем их отдельно
+	last, exact := viewBefore(skey, bound)
+	res = make([]fdb.KeyValue, 0, viewBatch)
+
+	for i := range exact {
+		if val := r.Data(exact[i]); len(val) > 0 {
+			res = append(res, fdb.KeyValue{Key: exact[i], Value: val})
+		}
+	}
+
+	if last != nil && len(res) < viewBatch {
+		res = append(res, viewRows(r.List(from, last, uint64(viewBatch-len(res)), true, false).GetSliceOrPanic())...)
+	}
+
+	return res, nil
+}
+
+// viewRows - пропускаем байт базы данных, он добавляется при выборке
+func viewRows(rows []fdb.KeyValue) []fdb.KeyValue {
+	for i := range rows {
+		rows[i].Key = rows[i].Key[1:]
+	}
+
+	return rows
+}
+
+/*
+	viewBefore - граница выборки в обратном порядке строго до ключа key.
+
+	Диапазон по префиксу last включает все ключи меньше key, кроме самого key без хвоста нулевых байт:
+	они меньше key, но больше любого префикса last, поэтому возвращаются отдельно в exact, по убыванию.
+*/
+func viewBefore(skey, key fdb.Key) (last fdb.Key, exact []fdb.Key) {
+	n := len(key)
+
+	for n > len(skey) && key[n-1] == 0 {
+		if n--; n > len(skey) {
+			exact = append(exact, key[:n])
+		}
+	}
+
+	if n == len(skey) {
+		return nil, exact
+	}
+
+	last = fdbx.AppendRight(key[:n-1], key[n-1]-1)
+	return last, exact
+}
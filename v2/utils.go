@@ -2,7 +2,6 @@ package fdbx
 
 import (
 	"context"
-	"encoding/binary"
 	"os"
 	"os/signal"
 	"sync"
@@ -11,6 +10,8 @@ import (
 
 	fbs "github.com/google/flatbuffers/go"
 	"github.com/shestakovda/errx"
+
+	"github.com/shestakovda/fdbx/v2/keys"
 )
 
 var fbsPool = sync.Pool{New: func() interface{} { return fbs.NewBuilder(128) }}
@@ -25,22 +26,22 @@ var ExitSignals = []os.Signal{
 	syscall.SIGTERM,
 }
 
-// Time2Byte - преобразователь времени в массив байт
+// Time2Byte - преобразователь времени в массив байт фиксированной длины, см. keys.AppendFixedTime
 func Time2Byte(t time.Time) []byte {
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], uint64(t.UTC().UnixNano()))
-	return buf[:]
+	return keys.AppendFixedTime(nil, t)
 }
 
-// Byte2Time - преобразователь времени в массив байт
+// Byte2Time - преобразователь массива байт во время, см. keys.FixedTime
 func Byte2Time(buf []byte) (time.Time, error) {
-	if len(buf) < 8 {
-		return time.Time{}, ErrByte2Time.WithDebug(errx.Debug{
+	t, err := keys.FixedTime(buf)
+
+	if err != nil {
+		return time.Time{}, ErrByte2Time.WithReason(err).WithDebug(errx.Debug{
 			"buf": buf,
 		})
 	}
 
-	return time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8]))).UTC(), nil
+	return t, nil
 }
 
 func FlatPack(obj FlatPacker) []byte {